@@ -0,0 +1,285 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/viert/metricsearch/pkg/config"
+	"github.com/viert/metricsearch/pkg/mstree"
+	"github.com/viert/metricsearch/pkg/web"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_CONFIG_FILE = "/etc/metricsearch.conf"
+)
+
+var (
+	logfileName string
+	logfile     *os.File
+	log         *logging.Logger = logging.MustGetLogger("metricsearch")
+)
+
+func reopenLog() {
+	var err error
+	if logfile != nil {
+		logfile.Close()
+	}
+	logfile, err = os.OpenFile(logfileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0644))
+	if err != nil {
+		return
+	}
+	backend := logging.NewLogBackend(logfile, "", 0)
+	logging.SetBackend(backend)
+}
+
+func hupCatcher() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for _ = range c {
+		log.Debug("HUP signal catched, reopening logfile %s", logfileName)
+		reopenLog()
+	}
+}
+
+// newTree creates a tree configured according to conf
+func newTree(conf *config.Config) (*mstree.MSTree, error) {
+	tree, err := mstree.NewTree(conf.IndexDirectory, conf.SyncBufferSize, conf.ValidateTokens)
+	if err != nil {
+		return nil, err
+	}
+	err = tree.SetIndexFormat(conf.IndexFormat)
+	if err != nil {
+		log.Critical("Invalid index_format: %s", err.Error())
+		return nil, err
+	}
+	err = tree.SetIndexCompression(conf.IndexCompression)
+	if err != nil {
+		log.Critical("Invalid index_compression: %s", err.Error())
+		return nil, err
+	}
+	err = tree.SetIndexStore(conf.IndexStore)
+	if err != nil {
+		log.Critical("Invalid index_store: %s", err.Error())
+		return nil, err
+	}
+	err = tree.SetWriterPool(conf.SyncWriters, conf.MaxOpenFiles)
+	if err != nil {
+		log.Critical("Invalid index writers configuration: %s", err.Error())
+		return nil, err
+	}
+	err = tree.SetSyncOverflow(conf.SyncOverflow, time.Duration(conf.SyncOverflowTimeout)*time.Millisecond)
+	if err != nil {
+		log.Critical("Invalid sync_overflow configuration: %s", err.Error())
+		return nil, err
+	}
+	err = tree.SetStorage(conf.Storage)
+	if err != nil {
+		log.Critical("Invalid storage: %s", err.Error())
+		return nil, err
+	}
+	return tree, nil
+}
+
+// startTree starts background jobs of a loaded tree
+func startTree(conf *config.Config, tree *mstree.MSTree) error {
+	if conf.WAL {
+		err := tree.StartWAL(conf.WALFsync, time.Duration(conf.WALFsyncInterval)*time.Millisecond)
+		if err != nil {
+			return fmt.Errorf("Error starting write-ahead log: %s", err.Error())
+		}
+	}
+	tree.StartCompactor(time.Duration(conf.CompactInterval)*time.Second, conf.CompactRatio)
+	tree.StartOverflowDrainer(time.Second)
+	tree.StartMerger(time.Duration(conf.MergeInterval) * time.Second)
+	if conf.WhisperWatchDir != "" {
+		err := tree.WatchWhisper(conf.WhisperWatchDir, time.Duration(conf.WhisperRescan)*time.Second)
+		if err != nil {
+			return fmt.Errorf("Error watching whisper storage: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// openSnapshot opens a snapshot file or downloads it from /admin/snapshot
+// of a running peer
+func openSnapshot(source string) (io.ReadCloser, error) {
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Post(source, "text/plain", nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s responded with %s", source, resp.Status)
+		}
+		return resp.Body, nil
+	}
+	return os.Open(source)
+}
+
+func main() {
+	var format string
+	var confFile, reindexFile, convertFormat, restoreSource, whisperDir string
+	var whisperMaxAge time.Duration
+	var stdinImport bool
+	flag.StringVar(&confFile, "c", DEFAULT_CONFIG_FILE, "metricsearch config filename")
+	flag.StringVar(&reindexFile, "reindex", "", "reindex from plain text metrics file")
+	flag.StringVar(&convertFormat, "convert", "", "convert index files to the given format (text or binary) and exit")
+	flag.BoolVar(&stdinImport, "stdin", false, "reindex from stdin")
+	flag.StringVar(&whisperDir, "import-whisper", "", "add metrics of .wsp files in the whisper storage directory to the index and exit")
+	flag.DurationVar(&whisperMaxAge, "whisper-max-age", 0, "import only whisper files modified within this duration, i.e. 720h")
+	flag.StringVar(&restoreSource, "restore", "", "replace the index with a snapshot file or the /admin/snapshot url of a peer before starting")
+	flag.Parse()
+
+	conf := config.Load(confFile)
+
+	switch conf.Log {
+	case "syslog":
+		backend, err := logging.NewSyslogBackend("metricsearch")
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		logging.SetBackend(backend)
+		format = "%{program} %{level} %{message}"
+	case "":
+		format = "%{color}%{level} %{color:reset}%{message}"
+	default:
+		logfileName = conf.Log
+		reopenLog()
+		go hupCatcher()
+		format = "[%{time:2006-01-02 15:04:05}] %{level} %{message}"
+	}
+	logging.SetFormatter(logging.MustStringFormatter(format))
+	logging.SetLevel(conf.LogLevel, "metricsearch")
+
+	tree, err := newTree(conf)
+	if err != nil {
+		log.Critical("No way to continue, exiting.")
+		return
+	}
+
+	log.Debug("Configuring runtime: GCPercent(%d), MaxCores(%d), MaxThreads(%d)", conf.GCPercent, conf.MaxCores, conf.MaxThreads)
+	runtime.GOMAXPROCS(conf.MaxCores)
+	debug.SetGCPercent(conf.GCPercent)
+	debug.SetMaxThreads(conf.MaxThreads)
+
+	if restoreSource != "" {
+		src, err := openSnapshot(restoreSource)
+		if err != nil {
+			log.Critical("Error opening snapshot: %s", err.Error())
+			return
+		}
+		err = tree.Restore(src)
+		src.Close()
+		if err != nil {
+			log.Critical("Error restoring snapshot, keeping the previous index: %s", err.Error())
+			return
+		}
+		log.Notice("Index restored from %s", restoreSource)
+	}
+
+	if whisperDir != "" {
+		err := tree.LoadIndex()
+		if err != nil {
+			log.Critical("Error loading index, not importing: %s", err.Error())
+			return
+		}
+		var since time.Time
+		if whisperMaxAge > 0 {
+			since = time.Now().Add(-whisperMaxAge)
+		}
+		defer tree.Close()
+		// a one-shot import, nothing else runs meanwhile
+		debug.SetGCPercent(-1)
+		count, err := tree.ImportWhisper(whisperDir, since)
+		if err != nil {
+			log.Critical("Error importing whisper files: %s", err.Error())
+			return
+		}
+		if conf.SyncBufferSize <= 0 {
+			// nothing is synced to index files without writers
+			err = tree.DumpIndex()
+			if err != nil {
+				log.Critical("Error dumping index: %s", err.Error())
+				return
+			}
+		}
+		log.Notice("%d whisper files imported", count)
+		return
+	}
+
+	if convertFormat != "" {
+		err := tree.SetIndexFormat(convertFormat)
+		if err != nil {
+			log.Critical(err.Error())
+			return
+		}
+		err = tree.LoadIndex()
+		if err != nil {
+			log.Critical("Error loading index, not converting: %s", err.Error())
+			return
+		}
+		err = tree.DumpIndex()
+		if err != nil {
+			log.Critical("Error converting index: %s", err.Error())
+			return
+		}
+		log.Notice("Index converted to %s format", convertFormat)
+		return
+	}
+
+	// Reindexing replaces the current index generation as a whole only
+	// when the new one is completely written, no need to drop it first
+	if stdinImport || reindexFile != "" {
+		// the process exits once it's done, nothing else runs meanwhile
+		debug.SetGCPercent(-1)
+	}
+	if stdinImport {
+		err := tree.LoadTxtReader(os.Stdin, -1)
+		if err != nil {
+			log.Critical("Reindexing error, exiting.")
+			return
+		}
+		log.Notice("Reindexing complete")
+		return
+	}
+
+	if reindexFile != "" {
+		err := tree.LoadTxt(reindexFile, -1)
+		if err != nil {
+			log.Critical("Reindexing error, exiting.")
+			return
+		} else {
+			log.Notice("Reindexing complete")
+			return
+		}
+	} else {
+		tree.LoadIndex()
+		err = startTree(conf, tree)
+		if err != nil {
+			log.Critical(err.Error())
+			return
+		}
+		server := web.NewServer(tree, conf.SelfMonitor, conf.SelfMonitorPrefix)
+		server.SetSearchTimeout(time.Duration(conf.SearchTimeout) * time.Millisecond)
+		server.SetWhisperRoot(conf.WhisperImportRoot)
+		server.EnableReindex(func() (*mstree.MSTree, error) {
+			return newTree(conf)
+		}, func(t *mstree.MSTree) error {
+			return startTree(conf, t)
+		})
+		addr := fmt.Sprintf("%s:%d", conf.Host, conf.Port)
+		server.Start(addr)
+	}
+
+}
@@ -0,0 +1,10 @@
+module github.com/viert/metricsearch
+
+go 1.21
+
+require (
+	github.com/op/go-logging v0.0.0-20160315200505-970db520ece7
+	go.etcd.io/bbolt v1.3.10
+)
+
+require golang.org/x/sys v0.22.0 // indirect
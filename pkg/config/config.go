@@ -0,0 +1,281 @@
+package config
+
+import (
+	logging "github.com/op/go-logging"
+	"strconv"
+	"strings"
+)
+
+type Config struct {
+	Host                string
+	Port                int
+	IndexDirectory      string
+	SyncBufferSize      int
+	GCPercent           int
+	MaxCores            int
+	MaxThreads          int
+	LogLevel            logging.Level
+	Log                 string
+	SelfMonitor         bool
+	SelfMonitorPrefix   string
+	ValidateTokens      bool
+	CompactInterval     int
+	CompactRatio        float64
+	IndexFormat         string
+	IndexCompression    string
+	IndexStore          string
+	WAL                 bool
+	WALFsync            string
+	WALFsyncInterval    int
+	SyncWriters         int
+	MaxOpenFiles        int
+	SyncOverflow        string
+	SyncOverflowTimeout int
+	WhisperWatchDir     string
+	WhisperRescan       int
+	WhisperImportRoot   string
+	Storage             string
+	MergeInterval       int
+	SearchTimeout       int
+}
+
+var (
+	log           *logging.Logger = logging.MustGetLogger("metricsearch")
+	defaultConfig *Config         = &Config{
+		Host:                "",
+		Port:                7000,
+		IndexDirectory:      "/var/lib/metricsearch/index",
+		SyncBufferSize:      1000,
+		GCPercent:           100,
+		MaxCores:            8,
+		MaxThreads:          10000,
+		LogLevel:            logging.DEBUG,
+		Log:                 "",
+		CompactInterval:     600,
+		CompactRatio:        2.0,
+		IndexFormat:         "binary",
+		IndexCompression:    "none",
+		IndexStore:          "files",
+		WALFsync:            "interval",
+		WALFsyncInterval:    100,
+		SyncWriters:         8,
+		MaxOpenFiles:        256,
+		SyncOverflow:        "block",
+		SyncOverflowTimeout: 1000,
+		WhisperWatchDir:     "",
+		WhisperRescan:       3600,
+		WhisperImportRoot:   "",
+		Storage:             "memory",
+		MergeInterval:       600,
+		SearchTimeout:       30000,
+	}
+)
+
+func Load(filename string) *Config {
+	props, err := loadProperties(filename)
+	if err != nil {
+		log.Error(err.Error())
+		log.Notice("Using configuration defaults")
+		return defaultConfig
+	}
+	config := new(Config)
+	config.Host, err = props.GetString("main.host")
+	if err != nil {
+		config.Host = defaultConfig.Host
+	}
+	config.Port, err = props.GetInt("main.port")
+	if err != nil {
+		config.Port = defaultConfig.Port
+	}
+	config.IndexDirectory, err = props.GetString("main.index_directory")
+	if err != nil {
+		config.IndexDirectory = defaultConfig.IndexDirectory
+	}
+	config.SyncBufferSize, err = props.GetInt("main.sync_buffer_size")
+	if err != nil {
+		config.SyncBufferSize = defaultConfig.SyncBufferSize
+	}
+	config.GCPercent, err = props.GetInt("runtime.gc_percent")
+	if err != nil {
+		config.GCPercent = defaultConfig.GCPercent
+	}
+	config.MaxCores, err = props.GetInt("runtime.max_cores")
+	if err != nil {
+		config.MaxCores = defaultConfig.MaxCores
+	}
+	config.MaxThreads, err = props.GetInt("runtime.max_threads")
+	if err != nil {
+		config.MaxThreads = defaultConfig.MaxThreads
+	}
+	config.Log, err = props.GetString("main.log")
+	if err != nil {
+		config.Log = defaultConfig.Log
+	}
+	indexFormat, err := props.GetString("main.index_format")
+	if err != nil {
+		config.IndexFormat = defaultConfig.IndexFormat
+	} else {
+		config.IndexFormat = strings.ToLower(indexFormat)
+	}
+	indexCompression, err := props.GetString("main.index_compression")
+	if err != nil {
+		config.IndexCompression = defaultConfig.IndexCompression
+	} else {
+		config.IndexCompression = strings.ToLower(indexCompression)
+	}
+	indexStore, err := props.GetString("main.index_store")
+	if err != nil {
+		config.IndexStore = defaultConfig.IndexStore
+	} else {
+		config.IndexStore = strings.ToLower(indexStore)
+	}
+	wal, err := props.GetString("main.wal")
+	if err == nil {
+		switch strings.ToLower(wal) {
+		case "on":
+			fallthrough
+		case "1":
+			fallthrough
+		case "yes":
+			fallthrough
+		case "true":
+			config.WAL = true
+		default:
+			config.WAL = false
+		}
+	}
+	walFsync, err := props.GetString("main.wal_fsync")
+	if err != nil {
+		config.WALFsync = defaultConfig.WALFsync
+	} else {
+		config.WALFsync = strings.ToLower(walFsync)
+	}
+	config.WALFsyncInterval, err = props.GetInt("main.wal_fsync_interval")
+	if err != nil {
+		config.WALFsyncInterval = defaultConfig.WALFsyncInterval
+	}
+	config.CompactInterval, err = props.GetInt("main.compact_interval")
+	if err != nil {
+		config.CompactInterval = defaultConfig.CompactInterval
+	}
+	compactRatio, err := props.GetString("main.compact_ratio")
+	if err == nil {
+		config.CompactRatio, err = strconv.ParseFloat(compactRatio, 64)
+	}
+	if err != nil {
+		config.CompactRatio = defaultConfig.CompactRatio
+	}
+	config.SyncWriters, err = props.GetInt("main.sync_writers")
+	if err != nil {
+		config.SyncWriters = defaultConfig.SyncWriters
+	}
+	config.MaxOpenFiles, err = props.GetInt("main.max_open_files")
+	if err != nil {
+		config.MaxOpenFiles = defaultConfig.MaxOpenFiles
+	}
+	syncOverflow, err := props.GetString("main.sync_overflow")
+	if err != nil {
+		config.SyncOverflow = defaultConfig.SyncOverflow
+	} else {
+		config.SyncOverflow = strings.ToLower(syncOverflow)
+	}
+	config.SyncOverflowTimeout, err = props.GetInt("main.sync_overflow_timeout")
+	if err != nil {
+		config.SyncOverflowTimeout = defaultConfig.SyncOverflowTimeout
+	}
+	config.WhisperWatchDir, err = props.GetString("main.whisper_watch_dir")
+	if err != nil {
+		config.WhisperWatchDir = defaultConfig.WhisperWatchDir
+	}
+	config.WhisperRescan, err = props.GetInt("main.whisper_rescan_interval")
+	if err != nil {
+		config.WhisperRescan = defaultConfig.WhisperRescan
+	}
+	config.WhisperImportRoot, err = props.GetString("main.whisper_import_root")
+	if err != nil {
+		config.WhisperImportRoot = defaultConfig.WhisperImportRoot
+	}
+	storage, err := props.GetString("main.storage")
+	if err != nil {
+		config.Storage = defaultConfig.Storage
+	} else {
+		config.Storage = strings.ToLower(storage)
+	}
+	config.MergeInterval, err = props.GetInt("main.merge_interval")
+	if err != nil {
+		config.MergeInterval = defaultConfig.MergeInterval
+	}
+	config.SearchTimeout, err = props.GetInt("main.search_timeout")
+	if err != nil {
+		config.SearchTimeout = defaultConfig.SearchTimeout
+	}
+	validateTokens, err := props.GetString("main.validate_tokens")
+	if err == nil {
+		switch strings.ToLower(validateTokens) {
+		case "on":
+			fallthrough
+		case "1":
+			fallthrough
+		case "yes":
+			fallthrough
+		case "true":
+			config.ValidateTokens = true
+		default:
+			config.ValidateTokens = false
+		}
+	}
+
+	logLevel, err := props.GetString("main.log_level")
+	if err != nil {
+		config.LogLevel = defaultConfig.LogLevel
+	} else {
+		switch strings.ToLower(logLevel) {
+		case "debug":
+			config.LogLevel = logging.DEBUG
+		case "error":
+			config.LogLevel = logging.ERROR
+		case "info":
+			config.LogLevel = logging.INFO
+		case "critical":
+			config.LogLevel = logging.CRITICAL
+		case "notice":
+			config.LogLevel = logging.NOTICE
+		case "warning":
+			config.LogLevel = logging.WARNING
+		default:
+			config.LogLevel = defaultConfig.LogLevel
+		}
+	}
+	dsSync, err := props.GetString("main.no_sync")
+	if err == nil {
+		dsSync = strings.ToLower(dsSync)
+		if dsSync == "true" {
+			config.SyncBufferSize = -1
+		}
+	}
+	selfMonitor, err := props.GetString("main.self_monitor")
+	if err == nil {
+		switch strings.ToLower(selfMonitor) {
+		case "on":
+			fallthrough
+		case "1":
+			fallthrough
+		case "yes":
+			fallthrough
+		case "true":
+			config.SelfMonitor = true
+		default:
+			config.SelfMonitor = false
+		}
+	}
+	selfMonitorPrefix, err := props.GetString("main.self_monitor_prefix")
+	if err != nil {
+		config.SelfMonitorPrefix = ""
+	} else {
+		if strings.HasSuffix(selfMonitorPrefix, ".") {
+			selfMonitorPrefix = selfMonitorPrefix[0:len(selfMonitorPrefix)]
+		}
+		config.SelfMonitorPrefix = selfMonitorPrefix
+	}
+	return config
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// properties holds values of an ini-style config file, keys are prefixed
+// with the section they're found in, i.e. "main.port"
+type properties map[string]string
+
+func loadProperties(filename string) (properties, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	props := make(properties)
+	section := ""
+	lineNo := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("%s:%d: invalid section header '%s'", filename, lineNo, line)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		eqPos := strings.Index(line, "=")
+		if eqPos == -1 {
+			return nil, fmt.Errorf("%s:%d: '=' expected in '%s'", filename, lineNo, line)
+		}
+		key := strings.TrimSpace(line[:eqPos])
+		if section != "" {
+			key = section + "." + key
+		}
+		props[key] = strings.TrimSpace(line[eqPos+1:])
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, err
+	}
+	return props, nil
+}
+
+func (p properties) GetString(key string) (string, error) {
+	value, ok := p[key]
+	if !ok {
+		return "", fmt.Errorf("key '%s' not found", key)
+	}
+	return value, nil
+}
+
+func (p properties) GetInt(key string) (int, error) {
+	value, err := p.GetString(key)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
@@ -0,0 +1,203 @@
+package mstree
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A snapshot of the whole tree is a tar archive of binary snapshots, one
+// <token>.bidx entry per first level token, exactly the files DumpIndex
+// writes in binary format. Restoring it makes a new index generation out of
+// them. In the mapped storage mode the archive also has the trie file,
+// the delta is merged into it before the snapshot is taken. The last entry
+// is ARCHIVE_END holding the number of entries before it, archives without
+// it are truncated.
+
+const ARCHIVE_END = "snapshot.end"
+
+// writeArchive writes the tar snapshot of the tree. Inserts are blocked
+// only while the tree is copied, the copy is serialized without the lock.
+func (t *MSTree) writeArchive(w io.Writer) (int, error) {
+	t.freezeLock.Lock()
+	_, children := t.Root.contents()
+	snapshots := make([]*snapshotCollector, len(children))
+	for i, child := range children {
+		snapshots[i] = collectSnapshot(child.node)
+	}
+	t.freezeLock.Unlock()
+
+	tw := tar.NewWriter(w)
+	buf := new(bytes.Buffer)
+	mtime := time.Now()
+	count := 0
+	if t.mapped != nil {
+		err := writeArchiveEntry(tw, TRIE_FILE, t.mapped.data, mtime)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	for i, sc := range snapshots {
+		buf.Reset()
+		var err error
+		if t.compression == COMPRESSION_GZIP {
+			gz := gzip.NewWriter(buf)
+			err = sc.write(gz)
+			if err == nil {
+				err = gz.Close()
+			}
+		} else {
+			err = sc.write(buf)
+		}
+		if err == nil {
+			err = writeArchiveEntry(tw, children[i].token+SNAPSHOT_SUFFIX, buf.Bytes(), mtime)
+		}
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+	err := writeArchiveEntry(tw, ARCHIVE_END, []byte(strconv.Itoa(count)), mtime)
+	if err != nil {
+		return count, err
+	}
+	return count, tw.Close()
+}
+
+func writeArchiveEntry(tw *tar.Writer, name string, data []byte, mtime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: mtime,
+	}
+	err := tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Snapshot streams a point-in-time snapshot of the whole tree to w. The
+// snapshot is prepared in a temporary file first, inserts are blocked only
+// while the tree is copied and not for the time of streaming.
+func (t *MSTree) Snapshot(w io.Writer) error {
+	tm := time.Now()
+	// removed on startup by cleanupGenerations if left behind
+	tmpFile := filepath.Join(t.indexDir, fmt.Sprintf("snapshot-%d.tar%s", time.Now().UnixNano(), TMP_SUFFIX))
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile)
+	defer f.Close()
+
+	if t.storage == STORAGE_MAPPED {
+		// the trie only changes with compactLock held
+		t.compactLock.Lock()
+		err = t.merge()
+		if err != nil {
+			t.compactLock.Unlock()
+			return err
+		}
+	}
+	count, err := t.writeArchive(f)
+	if t.storage == STORAGE_MAPPED {
+		t.compactLock.Unlock()
+	}
+	if err != nil {
+		return err
+	}
+	t.log.Info("Snapshot of %d index files prepared in %s", count, time.Now().Sub(tm).String())
+	_, err = f.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// Restore replaces the index on disk with a snapshot written by Snapshot,
+// the tree must be empty and LoadIndex is to be called afterwards
+func (t *MSTree) Restore(r io.Reader) error {
+	if !t.Root.isLeaf() || t.mapped != nil {
+		return fmt.Errorf("tree is not empty, can't restore")
+	}
+	t.pauseWriters()
+	defer t.resumeWriters()
+	genDir, err := newGeneration(t.indexDir)
+	if err != nil {
+		return err
+	}
+	store, _ := t.openIndexStore(t.storeKind, genDir)
+	count, err := restoreArchive(r, genDir)
+	if err == nil {
+		err = t.switchTo(genDir, store)
+	}
+	if err != nil {
+		store.Drop()
+		os.RemoveAll(genDir)
+		return err
+	}
+	t.log.Notice("%d index files restored from snapshot", count)
+	return nil
+}
+
+func restoreArchive(r io.Reader, genDir string) (int, error) {
+	tr := tar.NewReader(r)
+	count := 0
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return count, &SnapshotError{"snapshot archive is truncated"}
+		}
+		if err != nil {
+			return count, err
+		}
+		name := hdr.Name
+		if name == ARCHIVE_END {
+			data, err := io.ReadAll(io.LimitReader(tr, 32))
+			if err != nil {
+				return count, err
+			}
+			if expected, err := strconv.Atoi(string(data)); err != nil || expected != count {
+				return count, &SnapshotError{fmt.Sprintf("snapshot archive has %d entries, '%s' expected", count, data)}
+			}
+			return count, nil
+		}
+		if strings.ContainsAny(name, "/\\") || (!strings.HasSuffix(name, SNAPSHOT_SUFFIX) && name != TRIE_FILE) || name == SNAPSHOT_SUFFIX {
+			return count, &SnapshotError{fmt.Sprintf("unexpected snapshot entry '%s'", name)}
+		}
+		err = restoreFile(filepath.Join(genDir, name), tr)
+		if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
+
+func restoreFile(filename string, r io.Reader) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
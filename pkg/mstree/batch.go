@@ -0,0 +1,43 @@
+package mstree
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// searchMemo caches intermediate search levels by the query prefix they
+// were computed for, so queries of one batch sharing a prefix (which is
+// typical for dashboards) walk it only once.
+type searchMemo struct {
+	lock   *sync.Mutex
+	root   map[string]*node
+	levels map[string]map[string]*node
+}
+
+func newSearchMemo(root *node) *searchMemo {
+	rootLevel := map[string]*node{"": root}
+	return &searchMemo{new(sync.Mutex), rootLevel, make(map[string]map[string]*node)}
+}
+
+// search returns nothing useful once ctx is done: levels cut short by the
+// cancellation stay in the memo, so the whole batch must be abandoned.
+func (m *searchMemo) search(ctx context.Context, pattern string) []string {
+	tokens := strings.Split(pattern, ".")
+	nodesToSearch := m.root
+	for i, token := range tokens {
+		// tokens never contain dots so the prefix is unambiguous
+		prefix := strings.Join(tokens[:i+1], ".")
+		m.lock.Lock()
+		level, ok := m.levels[prefix]
+		m.lock.Unlock()
+		if !ok {
+			level = searchStep(ctx, nodesToSearch, token)
+			m.lock.Lock()
+			m.levels[prefix] = level
+			m.lock.Unlock()
+		}
+		nodesToSearch = level
+	}
+	return searchResults(nodesToSearch)
+}
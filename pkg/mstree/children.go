@@ -0,0 +1,258 @@
+package mstree
+
+import (
+	"sort"
+	"strings"
+)
+
+// High fan-out nodes keep their children in a map along with the sorted
+// array of child tokens, so wildcard patterns having a literal prefix look
+// up only the range of tokens starting with it. Brackets in the prefix are
+// expanded into several ranges. Patterns with a literal suffix use the
+// array of reversed tokens instead, it's built by the first such query on
+// a node and maintained afterwards. Both arrays get new tokens appended and
+// are sorted lazily by the next lookup.
+
+const (
+	// bracket expansion stops once a pattern turns into more prefixes
+	MAX_PATTERN_PREFIXES = 256
+)
+
+type childMap struct {
+	children map[string]*node
+	// keys holds child tokens sorted, except for the last `unsorted`
+	// entries appended since the previous sortedKeys() call
+	keys     []string
+	unsorted int
+	// rkeys holds reversed child tokens the same way, nil until the
+	// first suffix lookup
+	rkeys     []string
+	runsorted int
+}
+
+func newChildMap(children []*node) *childMap {
+	m := &childMap{children: make(map[string]*node, len(children)), keys: make([]string, len(children))}
+	for i, child := range children {
+		m.children[child.token] = child
+		m.keys[i] = child.token
+	}
+	return m
+}
+
+func (m *childMap) add(child *node) {
+	m.children[child.token] = child
+	m.keys = append(m.keys, child.token)
+	m.unsorted++
+	if m.rkeys != nil {
+		m.rkeys = append(m.rkeys, reverseString(child.token))
+		m.runsorted++
+	}
+}
+
+// removeSorted returns keys without key, a new array is allocated as
+// readers may hold the previous one
+func removeSorted(keys []string, key string) []string {
+	i := sort.SearchStrings(keys, key)
+	if i < len(keys) && keys[i] == key {
+		return append(keys[:i:i], keys[i+1:]...)
+	}
+	return keys
+}
+
+func (m *childMap) remove(token string) {
+	delete(m.children, token)
+	m.keys = removeSorted(m.sortedKeys(), token)
+	if m.rkeys != nil {
+		m.rkeys = removeSorted(m.sortedReversed(), reverseString(token))
+	}
+}
+
+// mergeSorted sorts the unsorted tail of keys and merges it with the
+// sorted head
+func mergeSorted(keys []string, unsorted int) []string {
+	split := len(keys) - unsorted
+	head, tail := keys[:split], keys[split:]
+	sort.Strings(tail)
+	if split == 0 {
+		return keys
+	}
+	merged := make([]string, 0, len(keys))
+	i, j := 0, 0
+	for i < len(head) && j < len(tail) {
+		if head[i] < tail[j] {
+			merged = append(merged, head[i])
+			i++
+		} else {
+			merged = append(merged, tail[j])
+			j++
+		}
+	}
+	merged = append(merged, head[i:]...)
+	merged = append(merged, tail[j:]...)
+	return merged
+}
+
+func (m *childMap) sortedKeys() []string {
+	if m.unsorted > 0 {
+		m.keys = mergeSorted(m.keys, m.unsorted)
+		m.unsorted = 0
+	}
+	return m.keys
+}
+
+func (m *childMap) sortedReversed() []string {
+	if m.rkeys == nil {
+		m.rkeys = make([]string, 0, len(m.children))
+		for token := range m.children {
+			m.rkeys = append(m.rkeys, reverseString(token))
+		}
+		sort.Strings(m.rkeys)
+		m.runsorted = 0
+	}
+	if m.runsorted > 0 {
+		m.rkeys = mergeSorted(m.rkeys, m.runsorted)
+		m.runsorted = 0
+	}
+	return m.rkeys
+}
+
+// prefixRange returns the range of sorted keys starting with prefix
+func prefixRange(keys []string, prefix string) (int, int) {
+	lo := sort.SearchStrings(keys, prefix)
+	hi := lo + sort.Search(len(keys)-lo, func(i int) bool {
+		return !strings.HasPrefix(keys[lo+i], prefix)
+	})
+	return lo, hi
+}
+
+// candidates calls fn for every child token which may match pattern
+func (m *childMap) candidates(pattern string, fn func(k string)) {
+	keys := m.sortedKeys()
+	if !narrowable(pattern) {
+		for _, k := range keys {
+			fn(k)
+		}
+		return
+	}
+	prefixes := literalPrefixes(pattern)
+	ranges := make([][2]int, len(prefixes))
+	total := 0
+	for i, prefix := range prefixes {
+		lo, hi := prefixRange(keys, prefix)
+		ranges[i] = [2]int{lo, hi}
+		total += hi - lo
+	}
+	if suffix := literalSuffix(pattern); suffix != "" && total > 0 {
+		rkeys := m.sortedReversed()
+		lo, hi := prefixRange(rkeys, reverseString(suffix))
+		if hi-lo < total {
+			for _, rk := range rkeys[lo:hi] {
+				fn(reverseString(rk))
+			}
+			return
+		}
+	}
+	for _, r := range ranges {
+		for _, k := range keys[r[0]:r[1]] {
+			fn(k)
+		}
+	}
+}
+
+func reverseString(s string) string {
+	b := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		b[len(s)-1-i] = s[i]
+	}
+	return string(b)
+}
+
+// narrowable tells if pattern has only characters which are literal both
+// for the plain matching and for the regular expression the pattern is
+// turned into, so its literal prefix and suffix must be matched as is
+func narrowable(pattern string) bool {
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_' || c == ':' || c == '/' || c == '-':
+		case c == '*' || c == '?' || c == '[' || c == ']' || c == '^':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// bracketChars returns the characters a bracket expression matches, ok is
+// false for negations and anything but plain characters and ranges
+func bracketChars(expr string) ([]byte, bool) {
+	if expr == "" || expr[0] == '^' {
+		return nil, false
+	}
+	seen := make(map[byte]bool)
+	chars := make([]byte, 0)
+	for i := 0; i < len(expr); i++ {
+		from, to := expr[i], expr[i]
+		if from == '[' || from == '^' {
+			return nil, false
+		}
+		if i+2 < len(expr) && expr[i+1] == '-' {
+			to = expr[i+2]
+			i += 2
+		}
+		if to < from {
+			return nil, false
+		}
+		for c := int(from); c <= int(to); c++ {
+			if !seen[byte(c)] {
+				seen[byte(c)] = true
+				chars = append(chars, byte(c))
+			}
+		}
+	}
+	return chars, true
+}
+
+// literalPrefixes returns prefixes every token matching pattern starts
+// with one of, brackets are expanded into their characters
+func literalPrefixes(pattern string) []string {
+	prefixes := []string{""}
+	for i := 0; i < len(pattern); {
+		c := pattern[i]
+		switch c {
+		case '*', '?', ']', '^':
+			return prefixes
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return prefixes
+			}
+			chars, ok := bracketChars(pattern[i+1 : i+end])
+			if !ok || len(prefixes)*len(chars) > MAX_PATTERN_PREFIXES {
+				return prefixes
+			}
+			next := make([]string, 0, len(prefixes)*len(chars))
+			for _, prefix := range prefixes {
+				for _, ch := range chars {
+					next = append(next, prefix+string(ch))
+				}
+			}
+			prefixes = next
+			i += end + 1
+		default:
+			for j := range prefixes {
+				prefixes[j] += string(c)
+			}
+			i++
+		}
+	}
+	return prefixes
+}
+
+// literalSuffix returns the part of pattern after its last special
+// character
+func literalSuffix(pattern string) string {
+	i := strings.LastIndexAny(pattern, "*?[]^")
+	return pattern[i+1:]
+}
@@ -0,0 +1,175 @@
+package mstree
+
+import (
+	"time"
+)
+
+const (
+	// files smaller than that are never compacted by the background job
+	COMPACT_MIN_SIZE = 64 * 1024
+)
+
+// compaction is a handshake between a compactor and an index writer. The
+// writer keeps appending while the compactor takes a snapshot of the
+// subtree, then the writer commits the snapshot along with whatever was
+// appended in the meantime. A nil snapshot is sent to finish when taking it
+// failed.
+type compaction struct {
+	token   string
+	started chan bool
+	finish  chan StoreSnapshot
+	done    chan error
+}
+
+func (t *MSTree) compactToken(indexToken string) error {
+	t.Root.Lock()
+	idxNode := t.Root.child(indexToken)
+	t.Root.Unlock()
+	if idxNode == nil {
+		// all the metrics of the token are deleted
+		idxNode = newNode()
+	}
+	iw := t.writerFor(indexToken)
+
+	tm := time.Now()
+	c := &compaction{indexToken, make(chan bool, 1), make(chan StoreSnapshot, 1), make(chan error, 1)}
+	iw.compact <- c
+	<-c.started
+	s, err := t.store.Snapshot(indexToken, idxNode)
+	if err != nil {
+		c.finish <- nil
+		<-c.done
+		return err
+	}
+	c.finish <- s
+	err = <-c.done
+	if err != nil {
+		return err
+	}
+	if idxNode.empty() {
+		t.log.Notice("%s.idx of deleted metrics removed in %s", indexToken, time.Now().Sub(tm).String())
+		return nil
+	}
+	t.log.Notice("%s.idx compacted in %s", indexToken, time.Now().Sub(tm).String())
+	return nil
+}
+
+// deletedTokens returns first level tokens the store has data of while the
+// tree has no metrics of them anymore. Metrics can't be deleted in the
+// mapped storage mode where the tree holds the delta only.
+func (t *MSTree) deletedTokens() []string {
+	if t.storage == STORAGE_MAPPED {
+		return nil
+	}
+	stored, err := t.store.Tokens()
+	if err != nil {
+		t.log.Error("Error listing stored tokens: %s", err.Error())
+		return nil
+	}
+	deleted := make([]string, 0)
+	t.Root.Lock()
+	for _, token := range stored {
+		if t.Root.child(token) == nil {
+			deleted = append(deleted, token)
+		}
+	}
+	t.Root.Unlock()
+	return deleted
+}
+
+// Compact rewrites every index file from the in-memory tree getting rid of
+// duplicate lines, files of tokens whose metrics are all deleted are
+// removed. Add is not blocked while compacting.
+func (t *MSTree) Compact() error {
+	if !t.enableSync {
+		return nil
+	}
+	t.compactLock.Lock()
+	defer t.compactLock.Unlock()
+
+	t.Root.Lock()
+	tokens := append([]string(nil), t.Root.sortedKeys()...)
+	t.Root.Unlock()
+
+	tokens = append(tokens, t.deletedTokens()...)
+
+	var globalErr error = nil
+	for _, token := range tokens {
+		err := t.compactToken(token)
+		if err != nil {
+			t.log.Error("Error compacting %s.idx: %s", token, err.Error())
+			globalErr = err
+		}
+	}
+	return globalErr
+}
+
+// compactGrown compacts tokens whose stored data has grown more than ratio times
+// since they've been seen first or compacted last time and removes data of
+// tokens having no metrics left
+func (t *MSTree) compactGrown(baseSizes map[string]int64, ratio float64) {
+	t.compactLock.Lock()
+	defer t.compactLock.Unlock()
+
+	for _, token := range t.deletedTokens() {
+		err := t.compactToken(token)
+		if err != nil {
+			t.log.Error("Error removing %s.idx: %s", token, err.Error())
+			continue
+		}
+		delete(baseSizes, token)
+	}
+
+	t.Root.Lock()
+	tokens := append([]string(nil), t.Root.sortedKeys()...)
+	t.Root.Unlock()
+
+	for _, token := range tokens {
+		size := t.store.Size(token)
+		if size < 0 {
+			continue
+		}
+		base, ok := baseSizes[token]
+		if !ok || size < base {
+			baseSizes[token] = size
+			continue
+		}
+		if float64(size) < float64(max(base, COMPACT_MIN_SIZE))*ratio {
+			continue
+		}
+		err := t.compactToken(token)
+		if err != nil {
+			t.log.Error("Error compacting %s.idx: %s", token, err.Error())
+			continue
+		}
+		size = t.store.Size(token)
+		if size >= 0 {
+			baseSizes[token] = size
+		}
+	}
+}
+
+// StartCompactor checks index files every interval and compacts the ones
+// grown more than ratio times
+func (t *MSTree) StartCompactor(interval time.Duration, ratio float64) {
+	if !t.enableSync || interval <= 0 || ratio <= 1 {
+		t.log.Notice("Background index compaction disabled")
+		return
+	}
+	t.log.Notice("Starting background index compactor, interval %s, ratio %.2f", interval.String(), ratio)
+	t.watchers.Add(1)
+	go func() {
+		defer t.watchers.Done()
+		baseSizes := make(map[string]int64)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.compactGrown(baseSizes, ratio)
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,125 @@
+package mstree
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Index files and snapshots may be gzip compressed, they keep their names
+// and are told apart by the gzip magic bytes. Text index files are appended
+// with separate gzip members, a reader sees concatenated members as one
+// stream. A file is never mixed: appends to an existing file follow its
+// compression whatever the current setting is, dumps and compactions
+// rewrite files with the current setting.
+
+const (
+	COMPRESSION_NONE = "none"
+	COMPRESSION_GZIP = "gzip"
+)
+
+var (
+	GZIP_MAGIC = []byte{0x1f, 0x8b}
+)
+
+type compressedReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (cr *compressedReader) Close() error {
+	cr.Reader.Close()
+	return cr.f.Close()
+}
+
+type plainReader struct {
+	*bufio.Reader
+	f *os.File
+}
+
+func (pr *plainReader) Close() error {
+	return pr.f.Close()
+}
+
+// openIndexReader returns a reader of the decompressed contents of an index
+// file or a snapshot
+func openIndexReader(filename string) (io.ReadCloser, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReaderSize(f, 1024*1024)
+	magic, _ := br.Peek(len(GZIP_MAGIC))
+	if !bytes.Equal(magic, GZIP_MAGIC) {
+		return &plainReader{br, f}, nil
+	}
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		f.Close()
+		return nil, &IdxFileError{fmt.Sprintf("invalid gzip stream: %s", err.Error())}
+	}
+	return &compressedReader{gz, f}, nil
+}
+
+// isCompressed tells if an existing file is gzip compressed, empty and
+// missing files are not
+func isCompressed(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	defer f.Close()
+	magic := make([]byte, len(GZIP_MAGIC))
+	_, err = io.ReadFull(f, magic)
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(magic, GZIP_MAGIC), nil
+}
+
+// appendIdxRecords appends records to an index file, as a separate gzip
+// member if compressed
+func appendIdxRecords(f *os.File, compressed bool, header bool, lines []string) error {
+	if !header && len(lines) == 0 {
+		return nil
+	}
+	w := bufio.NewWriter(f)
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if compressed {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	if header {
+		writeIdxHeader(out)
+	}
+	for _, line := range lines {
+		writeIdxRecord(out, line)
+	}
+	if gz != nil {
+		err := gz.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// SetIndexCompression sets the compression of files written by DumpIndex
+// and Compact and of index files created by writers started after the call
+func (t *MSTree) SetIndexCompression(compression string) error {
+	if compression != COMPRESSION_NONE && compression != COMPRESSION_GZIP {
+		return fmt.Errorf("unsupported index compression '%s'", compression)
+	}
+	t.compression = compression
+	return nil
+}
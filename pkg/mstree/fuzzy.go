@@ -0,0 +1,162 @@
+package mstree
+
+import (
+	"container/heap"
+	"context"
+	"strings"
+)
+
+type ScoredMetric struct {
+	Path  string
+	Score float64
+}
+
+type fuzzyMatcher struct {
+	queryTokens []string
+	cache       map[string][]float64
+	limit       int
+	results     scoredHeap
+}
+
+// scoredHeap is a min-heap keeping the best `limit` results seen so far
+type scoredHeap []ScoredMetric
+
+func (h scoredHeap) Len() int { return len(h) }
+func (h scoredHeap) Less(i, j int) bool {
+	if h[i].Score == h[j].Score {
+		return h[i].Path > h[j].Path
+	}
+	return h[i].Score < h[j].Score
+}
+func (h scoredHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *scoredHeap) Push(x interface{}) { *h = append(*h, x.(ScoredMetric)) }
+func (h *scoredHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func splitFuzzyQuery(query string) []string {
+	return strings.FieldsFunc(query, func(r rune) bool {
+		return r == '.' || r == ' ' || r == '\t'
+	})
+}
+
+func levenshtein(a, b string) int {
+	if len(a) == 0 {
+		return len(b)
+	}
+	if len(b) == 0 {
+		return len(a)
+	}
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// similarity is 1 for equal tokens and 0 for completely different ones
+func similarity(a, b string) float64 {
+	maxLen := max(len(a), len(b))
+	if maxLen == 0 {
+		return 1
+	}
+	return 1 - float64(levenshtein(a, b))/float64(maxLen)
+}
+
+// tokenScores returns the similarity of token to every query token.
+// Metric trees repeat the same tokens a lot so results are cached.
+func (m *fuzzyMatcher) tokenScores(token string) []float64 {
+	if scores, ok := m.cache[token]; ok {
+		return scores
+	}
+	scores := make([]float64, len(m.queryTokens))
+	for i, qt := range m.queryTokens {
+		scores[i] = similarity(qt, token)
+	}
+	m.cache[token] = scores
+	return scores
+}
+
+func (m *fuzzyMatcher) offer(path string, best []float64) {
+	var score float64
+	for _, s := range best {
+		score += s
+	}
+	score /= float64(len(best))
+	if score <= 0 {
+		return
+	}
+	if m.limit > 0 && len(m.results) == m.limit {
+		worst := m.results[0]
+		if score < worst.Score || (score == worst.Score && path > worst.Path) {
+			return
+		}
+		heap.Pop(&m.results)
+	}
+	heap.Push(&m.results, ScoredMetric{path, score})
+}
+
+// walk carries the best similarity found on the path so far for every query
+// token, so that each leaf is scored by how well its tokens cover the query.
+// Children are copied under the node lock and walked without it, the walk
+// returns false once ctx is done.
+func (m *fuzzyMatcher) walk(ctx context.Context, n *node, prefix string, best []float64) bool {
+	suffix, children := n.contents()
+	if suffix != nil {
+		leafBest := append([]float64(nil), best...)
+		for _, token := range suffix {
+			m.cover(leafBest, token)
+		}
+		m.offer(joinPath(prefix, suffix...), leafBest)
+		return true
+	}
+	if len(children) == 0 {
+		if prefix != "" {
+			m.offer(prefix, best)
+		}
+		return true
+	}
+	// leaves are cheap, ctx is checked by branches only
+	if ctx.Err() != nil {
+		return false
+	}
+	for _, child := range children {
+		childBest := append([]float64(nil), best...)
+		m.cover(childBest, child.token)
+		if !m.walk(ctx, child.node, joinPath(prefix, child.token), childBest) {
+			return false
+		}
+	}
+	return true
+}
+
+// cover raises best similarities found on a path with the ones of token
+func (m *fuzzyMatcher) cover(best []float64, token string) {
+	for i, s := range m.tokenScores(token) {
+		best[i] = max(best[i], s)
+	}
+}
+
+// sorted drains the heap into a slice ordered by descending score
+func (m *fuzzyMatcher) sorted() []ScoredMetric {
+	results := make([]ScoredMetric, len(m.results))
+	for i := len(results) - 1; i >= 0; i-- {
+		results[i] = heap.Pop(&m.results).(ScoredMetric)
+	}
+	return results
+}
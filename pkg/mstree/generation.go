@@ -0,0 +1,134 @@
+package mstree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Index files live in a generation directory inside indexDir. The active
+// generation is the one pointed by the "current" symlink, so a whole new
+// index can be prepared aside and then switched to with a single atomic
+// rename. Indexes created before generations were introduced keep .idx
+// files right in indexDir, it's treated as the active generation until the
+// first switch.
+
+const (
+	CURRENT_GENERATION_LINK = "current"
+	GENERATION_PREFIX       = "gen-"
+	TMP_SUFFIX              = ".tmp"
+)
+
+func currentGeneration(indexDir string) (string, error) {
+	target, err := os.Readlink(filepath.Join(indexDir, CURRENT_GENERATION_LINK))
+	if err != nil {
+		if os.IsNotExist(err) {
+			// legacy flat layout
+			return indexDir, nil
+		}
+		return "", err
+	}
+	return filepath.Join(indexDir, target), nil
+}
+
+// cleanupGenerations removes leftovers of switches interrupted by a crash:
+// generations other than the current one and temporary files
+func cleanupGenerations(log *packageLogger, indexDir string, genDir string) error {
+	files, err := ioutil.ReadDir(indexDir)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		fName := filepath.Join(indexDir, file.Name())
+		if fName == genDir {
+			continue
+		}
+		if (file.IsDir() && strings.HasPrefix(file.Name(), GENERATION_PREFIX)) || strings.HasSuffix(file.Name(), TMP_SUFFIX) {
+			log.Notice("Removing stale index generation file %s", fName)
+			err = os.RemoveAll(fName)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if genDir != indexDir {
+		files, err = ioutil.ReadDir(genDir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), TMP_SUFFIX) {
+				err = os.Remove(filepath.Join(genDir, file.Name()))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func newGeneration(indexDir string) (string, error) {
+	genDir := filepath.Join(indexDir, fmt.Sprintf("%s%d", GENERATION_PREFIX, time.Now().UnixNano()))
+	err := os.Mkdir(genDir, os.FileMode(0755))
+	if err != nil {
+		return "", err
+	}
+	return genDir, nil
+}
+
+// linkGeneration atomically makes genDir the current generation, the
+// previous one is left to be removed by removeGeneration
+func linkGeneration(indexDir string, genDir string) error {
+	err := syncDir(genDir)
+	if err != nil {
+		return err
+	}
+	tmpLink := filepath.Join(indexDir, CURRENT_GENERATION_LINK+TMP_SUFFIX)
+	os.Remove(tmpLink)
+	err = os.Symlink(filepath.Base(genDir), tmpLink)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpLink, filepath.Join(indexDir, CURRENT_GENERATION_LINK))
+	if err != nil {
+		return err
+	}
+	return syncDir(indexDir)
+}
+
+// removeGeneration removes a generation which is not the current one
+// anymore, failing to do that is not critical as leftovers are removed on
+// startup
+func removeGeneration(log *packageLogger, indexDir string, prevGenDir string) {
+	if prevGenDir == indexDir {
+		files, err := ioutil.ReadDir(indexDir)
+		if err != nil {
+			log.Error("Error cleaning up legacy index files: %s", err.Error())
+			return
+		}
+		for _, file := range files {
+			name := file.Name()
+			if strings.HasSuffix(name, ".idx") || strings.HasSuffix(name, SNAPSHOT_SUFFIX) || name == BOLT_FILE || name == TRIE_FILE || isWALSegment(name) || isOverflowFile(name) {
+				os.Remove(filepath.Join(indexDir, name))
+			}
+		}
+		return
+	}
+	err := os.RemoveAll(prevGenDir)
+	if err != nil {
+		log.Error("Error removing previous index generation %s: %s", prevGenDir, err.Error())
+	}
+}
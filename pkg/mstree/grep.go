@@ -0,0 +1,316 @@
+package mstree
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	NGRAM_SIZE         = 3
+	TOKEN_INDEX_SHARDS = 64
+	SMALL_POSTINGS_MAX = 8
+)
+
+// tokenIndex is an inverted index used for substring search. Every distinct
+// token is split into n-grams once, so the n-gram lists grow with the number
+// of distinct tokens rather than with the number of metrics. Postings point
+// to the nodes holding a token, as their own token or within their suffix,
+// so grep walks only the subtrees below matched tokens. Splitting a suffix
+// moves postings of its tokens to the new child.
+// It's the table of interned tokens of the tree as well. The index is
+// sharded by token so that inserts of different tokens don't contend.
+type tokenIndex struct {
+	shards [TOKEN_INDEX_SHARDS]tokenShard
+}
+
+type tokenShard struct {
+	lock   sync.RWMutex
+	ngrams map[string][]*tokenNodes
+	tokens map[string]*tokenNodes
+}
+
+// tokenNodes are the nodes a token is held by
+type tokenNodes struct {
+	token    string
+	postings postings
+}
+
+// postings count occurrences of a token in nodes holding it, a slice is
+// used while there are few of them the way node children are kept
+type postings struct {
+	small []posting
+	big   map[*node]int32
+}
+
+type posting struct {
+	holder *node
+	refs   int32
+}
+
+func (p *postings) add(holder *node) {
+	if p.big != nil {
+		p.big[holder]++
+		return
+	}
+	for i := range p.small {
+		if p.small[i].holder == holder {
+			p.small[i].refs++
+			return
+		}
+	}
+	p.small = append(p.small, posting{holder, 1})
+	if len(p.small) > SMALL_POSTINGS_MAX {
+		p.big = make(map[*node]int32, len(p.small))
+		for _, sp := range p.small {
+			p.big[sp.holder] = sp.refs
+		}
+		p.small = nil
+	}
+}
+
+// drop forgets an occurrence of the token in holder, it returns false once
+// the token is held by no node
+func (p *postings) drop(holder *node) bool {
+	if p.big != nil {
+		if refs, ok := p.big[holder]; ok {
+			if refs > 1 {
+				p.big[holder] = refs - 1
+			} else {
+				delete(p.big, holder)
+			}
+		}
+		return len(p.big) > 0
+	}
+	for i := range p.small {
+		if p.small[i].holder == holder {
+			p.small[i].refs--
+			if p.small[i].refs == 0 {
+				last := len(p.small) - 1
+				p.small[i] = p.small[last]
+				p.small[last] = posting{}
+				p.small = p.small[:last]
+			}
+			break
+		}
+	}
+	return len(p.small) > 0
+}
+
+func (p *postings) forEach(fn func(holder *node)) {
+	if p.big != nil {
+		for holder := range p.big {
+			fn(holder)
+		}
+		return
+	}
+	for _, sp := range p.small {
+		fn(sp.holder)
+	}
+}
+
+func newTokenIndex() *tokenIndex {
+	ti := new(tokenIndex)
+	for i := range ti.shards {
+		ti.shards[i].ngrams = make(map[string][]*tokenNodes)
+		ti.shards[i].tokens = make(map[string]*tokenNodes)
+	}
+	return ti
+}
+
+func (ti *tokenIndex) shard(token string) *tokenShard {
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	return &ti.shards[h.Sum32()%TOKEN_INDEX_SHARDS]
+}
+
+func ngrams(s string) []string {
+	if len(s) < NGRAM_SIZE {
+		return nil
+	}
+	seen := make(map[string]bool)
+	results := make([]string, 0, len(s)-NGRAM_SIZE+1)
+	for i := 0; i+NGRAM_SIZE <= len(s); i++ {
+		ng := s[i : i+NGRAM_SIZE]
+		if !seen[ng] {
+			seen[ng] = true
+			results = append(results, ng)
+		}
+	}
+	return results
+}
+
+// entry must be called with ts.lock held
+func (ts *tokenShard) entry(token string) *tokenNodes {
+	tn, ok := ts.tokens[token]
+	if !ok {
+		// a copy, token may be a part of a much longer string
+		tn = &tokenNodes{token: strings.Clone(token)}
+		ts.tokens[tn.token] = tn
+		for _, ng := range ngrams(tn.token) {
+			ts.ngrams[ng] = append(ts.ngrams[ng], tn)
+		}
+	}
+	return tn
+}
+
+// intern returns the shared copy of token
+func (ti *tokenIndex) intern(token string) string {
+	ts := ti.shard(token)
+	ts.lock.RLock()
+	tn, ok := ts.tokens[token]
+	ts.lock.RUnlock()
+	if ok {
+		return tn.token
+	}
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return ts.entry(token).token
+}
+
+// add counts an occurrence of token in holder
+func (ti *tokenIndex) add(token string, holder *node) {
+	ts := ti.shard(token)
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.entry(token).postings.add(holder)
+}
+
+func (ti *tokenIndex) addSuffix(suffix []string, holder *node) {
+	for _, token := range suffix {
+		ti.add(token, holder)
+	}
+}
+
+// remove forgets an occurrence of token in holder
+func (ti *tokenIndex) remove(token string, holder *node) {
+	ts := ti.shard(token)
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	tn, ok := ts.tokens[token]
+	if !ok || tn.postings.drop(holder) {
+		return
+	}
+	delete(ts.tokens, token)
+	for _, ng := range ngrams(token) {
+		entries := ts.ngrams[ng]
+		for i, entry := range entries {
+			if entry == tn {
+				entries = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+		if len(entries) > 0 {
+			ts.ngrams[ng] = entries
+		} else {
+			delete(ts.ngrams, ng)
+		}
+	}
+}
+
+func (ti *tokenIndex) removeSuffix(suffix []string, holder *node) {
+	for _, token := range suffix {
+		ti.remove(token, holder)
+	}
+}
+
+func (ti *tokenIndex) size() int {
+	size := 0
+	for i := range ti.shards {
+		ts := &ti.shards[i]
+		ts.lock.RLock()
+		size += len(ts.tokens)
+		ts.lock.RUnlock()
+	}
+	return size
+}
+
+// lookup must be called with ts.lock held
+func (ts *tokenShard) lookup(fragment string) []*tokenNodes {
+	grams := ngrams(fragment)
+	if len(grams) == 0 {
+		// fragment is too short to use the index, the dictionary of
+		// distinct tokens is still way smaller than the tree though
+		results := make([]*tokenNodes, 0)
+		for token, tn := range ts.tokens {
+			if strings.Contains(token, fragment) {
+				results = append(results, tn)
+			}
+		}
+		return results
+	}
+
+	// start with the rarest n-gram to keep candidate set small
+	rarest := grams[0]
+	for _, ng := range grams[1:] {
+		if len(ts.ngrams[ng]) < len(ts.ngrams[rarest]) {
+			rarest = ng
+		}
+	}
+	results := make([]*tokenNodes, 0)
+	for _, tn := range ts.ngrams[rarest] {
+		if strings.Contains(tn.token, fragment) {
+			results = append(results, tn)
+		}
+	}
+	return results
+}
+
+// grep returns full names of all the leaves which have a token containing
+// fragment somewhere in their path, it returns ctx.Err() once ctx is done
+func (ti *tokenIndex) grep(ctx context.Context, fragment string) ([]string, error) {
+	// every leaf at or below a node holding a matched token matches
+	holders := make(map[*node]bool)
+	for i := range ti.shards {
+		ts := &ti.shards[i]
+		ts.lock.RLock()
+		for _, tn := range ts.lookup(fragment) {
+			tn.postings.forEach(func(holder *node) {
+				holders[holder] = true
+			})
+		}
+		ts.lock.RUnlock()
+	}
+
+	// subtrees of holders below other holders are walked once, ancestors
+	// have shorter paths and are met first
+	paths := make(map[string]*node, len(holders))
+	for holder := range holders {
+		paths[holder.path()] = holder
+	}
+	sorted := make([]string, 0, len(paths))
+	for path := range paths {
+		sorted = append(sorted, path)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) < len(sorted[j])
+	})
+	walked := make(map[string]bool)
+	found := make(map[string]bool)
+	for _, path := range sorted {
+		if hasWalkedAncestor(path, walked) {
+			continue
+		}
+		walked[path] = true
+		if ctx.Err() != nil || !paths[path].grepLeaves(ctx, path, found) {
+			return nil, ctx.Err()
+		}
+	}
+	results := make([]string, 0, len(found))
+	for path := range found {
+		results = append(results, path)
+	}
+	sort.Strings(results)
+	return results, nil
+}
+
+func hasWalkedAncestor(path string, walked map[string]bool) bool {
+	for i := 0; i < len(path); i++ {
+		if path[i] == '.' && walked[path[:i]] {
+			return true
+		}
+	}
+	return false
+}
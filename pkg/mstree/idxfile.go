@@ -0,0 +1,179 @@
+package mstree
+
+import (
+	"bufio"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Text index files start with a "#msidx <version>" header line followed by
+// records "<metric tail>\t<crc32 of the tail, hex>". Files written before
+// the header was introduced have bare metric tails in them, such lines are
+// still accepted in headerless files only.
+
+const (
+	IDX_HEADER         = "#msidx"
+	IDX_VERSION        = 1
+	QUARANTINE_DIRNAME = "quarantine"
+)
+
+type IdxFileError struct {
+	msg string
+}
+
+func (ie *IdxFileError) Error() string {
+	return ie.msg
+}
+
+type CorruptFile struct {
+	File        string
+	Quarantined string
+	Reason      string
+}
+
+func writeIdxHeader(w io.Writer) error {
+	_, err := io.WriteString(w, fmt.Sprintf("%s %d\n", IDX_HEADER, IDX_VERSION))
+	return err
+}
+
+func writeIdxRecord(w io.Writer, line string) error {
+	_, err := io.WriteString(w, fmt.Sprintf("%s\t%08x\n", line, crc32.ChecksumIEEE([]byte(line))))
+	return err
+}
+
+// parseIdxRecord returns the metric tail of a record or false if the record
+// is damaged. Records without checksum are accepted if legacy is set only,
+// otherwise they are torn records.
+func parseIdxRecord(record string, legacy bool) (string, bool) {
+	tabPos := strings.LastIndex(record, "\t")
+	if tabPos == -1 {
+		return record, legacy && record != ""
+	}
+	line := record[:tabPos]
+	sum, err := strconv.ParseUint(record[tabPos+1:], 16, 32)
+	if err != nil || uint32(sum) != crc32.ChecksumIEEE([]byte(line)) {
+		return "", false
+	}
+	return line, true
+}
+
+// readLogRecords calls fn with metrics of a WAL segment or an overflow
+// file. Records are only appended to such files and always checksummed, so
+// reading stops at the first damaged one, the torn tail left by a crash.
+// It returns the number of records left unread.
+func readLogRecords(fName string, fn func(metric string)) (int, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	damaged := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if damaged > 0 {
+			damaged++
+			continue
+		}
+		metric, ok := parseIdxRecord(scanner.Text(), false)
+		if !ok {
+			damaged++
+			continue
+		}
+		fn(metric)
+	}
+	return damaged, scanner.Err()
+}
+
+// loadIdxFile inserts metrics from a text index file into idxNode. It
+// returns the number of damaged records skipped, a non-nil error means the
+// file couldn't be read at all.
+func loadIdxFile(idxFile string, idxNode *node, metricCounter *int64, idx *tokenIndex) (int, error) {
+	f, err := openIndexReader(idxFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	damaged := 0
+	first := true
+	legacy := true
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		record := scanner.Text()
+		if first {
+			first = false
+			if strings.HasPrefix(record, IDX_HEADER+" ") {
+				version, err := strconv.Atoi(record[len(IDX_HEADER)+1:])
+				if err != nil || version != IDX_VERSION {
+					return 0, &IdxFileError{fmt.Sprintf("unsupported index file header '%s'", record)}
+				}
+				legacy = false
+				continue
+			}
+		}
+		line, ok := parseIdxRecord(record, legacy)
+		if !ok {
+			damaged++
+			continue
+		}
+		tokens := strings.Split(line, ".")
+		inserted := false
+		idxNode.insert(tokens, &inserted, idx)
+		if inserted {
+			atomic.AddInt64(metricCounter, 1)
+		}
+	}
+	err = scanner.Err()
+	if err != nil {
+		return damaged, &IdxFileError{err.Error()}
+	}
+	return damaged, nil
+}
+
+func isCorruption(err error) bool {
+	if _, ok := err.(*SnapshotError); ok {
+		return true
+	}
+	if _, ok := err.(*IdxFileError); ok {
+		return true
+	}
+	return err == io.EOF || err == io.ErrUnexpectedEOF
+}
+
+// quarantine moves a corrupt index file aside for later investigation and
+// registers it to be reported in stats
+func (t *MSTree) quarantine(filename string, reason string) {
+	qDir := filepath.Join(t.indexDir, QUARANTINE_DIRNAME)
+	cf := CorruptFile{File: filename, Reason: reason}
+	err := os.MkdirAll(qDir, os.FileMode(0755))
+	if err == nil {
+		qFile := filepath.Join(qDir, fmt.Sprintf("%s.%d", filepath.Base(filename), time.Now().UnixNano()))
+		err = os.Rename(filename, qFile)
+		if err == nil {
+			cf.Quarantined = qFile
+		}
+	}
+	if err != nil {
+		t.log.Error("Error moving corrupt index file %s to quarantine: %s", filename, err.Error())
+	} else {
+		t.log.Error("Corrupt index file %s moved to %s: %s", filename, cf.Quarantined, reason)
+	}
+	t.corruptLock.Lock()
+	t.corrupt = append(t.corrupt, cf)
+	t.corruptLock.Unlock()
+}
+
+// CorruptFiles returns the list of index files found corrupt while loading
+func (t *MSTree) CorruptFiles() []CorruptFile {
+	t.corruptLock.Lock()
+	defer t.corruptLock.Unlock()
+	results := make([]CorruptFile, len(t.corrupt))
+	copy(results, t.corrupt)
+	return results
+}
@@ -0,0 +1,314 @@
+package mstree
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Index is the metric index for embedding into other programs. It hides
+// the tree behind methods safe for concurrent use and reports failures as
+// errors instead of only logging them.
+type Index interface {
+	// Add inserts metric and passes it to index files. With the
+	// write-ahead log synced on every add it returns once the metric is
+	// durable, waiting for room in the writer queue whatever the overflow
+	// policy is. If ctx is done while waiting for that, ctx.Err() is
+	// returned although the metric is added and gets durable with the next
+	// sync. Adding an existing metric is not an error.
+	Add(ctx context.Context, metric string) error
+	// Delete removes metric telling if it was there, it stays in index
+	// files until they're compacted. In the mapped storage mode it returns
+	// ErrNotSupported.
+	Delete(ctx context.Context, metric string) (bool, error)
+	// Search returns paths matching a graphite pattern, branches have a
+	// trailing "."
+	Search(ctx context.Context, pattern string) ([]string, error)
+	// Count returns the number of leaves and branches Search would return
+	Count(ctx context.Context, pattern string) (int64, int64, error)
+	// Walk calls fn for every metric under the exact path prefix, the
+	// whole index if prefix is empty. An error returned by fn stops the
+	// walk and is returned. fn must not add or delete metrics.
+	Walk(ctx context.Context, prefix string, fn func(metric string) error) error
+	// Len returns the number of metrics in the index
+	Len() int64
+	// Close stops background jobs and syncs everything added to disk
+	Close() error
+}
+
+// Option configures an index opened by Open
+type Option func(*indexOptions)
+
+type indexOptions struct {
+	syncBufferSize  int
+	validateTokens  bool
+	compactInterval time.Duration
+	compactRatio    float64
+	mergeInterval   time.Duration
+	walPolicy       string
+	walInterval     time.Duration
+	logger          *packageLogger
+	settings        []func(*MSTree) error
+}
+
+func (o *indexOptions) set(setting func(*MSTree) error) {
+	o.settings = append(o.settings, setting)
+}
+
+// WithSyncBuffer sets the size of the queue of every index writer, 0 keeps
+// the index in memory only. It's 1000 by default.
+func WithSyncBuffer(size int) Option {
+	return func(o *indexOptions) {
+		o.syncBufferSize = size
+	}
+}
+
+// WithTokenValidation makes Add reject tokens with characters other than
+// letters, digits and "_?:/-", it's on by default
+func WithTokenValidation(validate bool) Option {
+	return func(o *indexOptions) {
+		o.validateTokens = validate
+	}
+}
+
+// WithLogger makes the index log to l instead of the package logger, nil
+// discards messages
+func WithLogger(l Logger) Option {
+	return func(o *indexOptions) {
+		o.logger = newPackageLogger(l)
+	}
+}
+
+// WithIndexFormat sets the format of index files, INDEX_FORMAT_BINARY by
+// default
+func WithIndexFormat(format string) Option {
+	return func(o *indexOptions) {
+		o.set(func(t *MSTree) error { return t.SetIndexFormat(format) })
+	}
+}
+
+// WithCompression sets the compression of index files, COMPRESSION_NONE by
+// default
+func WithCompression(compression string) Option {
+	return func(o *indexOptions) {
+		o.set(func(t *MSTree) error { return t.SetIndexCompression(compression) })
+	}
+}
+
+// WithIndexStore sets the kind of store index files are kept in,
+// INDEX_STORE_FILES by default
+func WithIndexStore(kind string) Option {
+	return func(o *indexOptions) {
+		o.set(func(t *MSTree) error { return t.SetIndexStore(kind) })
+	}
+}
+
+// WithStorage sets the storage mode, STORAGE_MEMORY by default. Metrics
+// added in the STORAGE_MAPPED mode are merged into the trie file every
+// mergeInterval, 0 disables merging.
+func WithStorage(mode string, mergeInterval time.Duration) Option {
+	return func(o *indexOptions) {
+		o.mergeInterval = mergeInterval
+		o.set(func(t *MSTree) error { return t.SetStorage(mode) })
+	}
+}
+
+// WithWriterPool sets the number of index writers and the total limit of
+// index files they keep open
+func WithWriterPool(writers int, maxOpenFiles int) Option {
+	return func(o *indexOptions) {
+		o.set(func(t *MSTree) error { return t.SetWriterPool(writers, maxOpenFiles) })
+	}
+}
+
+// WithSyncOverflow sets what happens when the queue of an index writer is
+// full, SYNC_OVERFLOW_BLOCK with no timeout by default
+func WithSyncOverflow(policy string, timeout time.Duration) Option {
+	return func(o *indexOptions) {
+		o.set(func(t *MSTree) error { return t.SetSyncOverflow(policy, timeout) })
+	}
+}
+
+// WithWAL enables the write-ahead log synced according to policy
+func WithWAL(policy string, interval time.Duration) Option {
+	return func(o *indexOptions) {
+		o.walPolicy = policy
+		o.walInterval = interval
+	}
+}
+
+// WithCompaction sets how often index files are checked and how much they
+// have to grow to be compacted, every 10 minutes twice by default. A zero
+// interval disables background compaction.
+func WithCompaction(interval time.Duration, ratio float64) Option {
+	return func(o *indexOptions) {
+		o.compactInterval = interval
+		o.compactRatio = ratio
+	}
+}
+
+type index struct {
+	tree *MSTree
+}
+
+// Open opens the index kept in dir creating it if there's none, loads it
+// and starts background jobs configured by opts
+func Open(dir string, opts ...Option) (Index, error) {
+	o := &indexOptions{
+		syncBufferSize:  1000,
+		validateTokens:  true,
+		compactInterval: 600 * time.Second,
+		compactRatio:    2.0,
+		mergeInterval:   600 * time.Second,
+		logger:          log,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	t, err := newTree(dir, o.syncBufferSize, o.validateTokens, o.logger)
+	if err != nil {
+		return nil, err
+	}
+	for _, setting := range o.settings {
+		err = setting(t)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+	}
+	err = t.LoadIndex()
+	if err == nil && o.walPolicy != "" {
+		err = t.StartWAL(o.walPolicy, o.walInterval)
+	}
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	t.StartCompactor(o.compactInterval, o.compactRatio)
+	t.StartOverflowDrainer(time.Second)
+	t.StartMerger(o.mergeInterval)
+	return &index{t}, nil
+}
+
+func (ix *index) Add(ctx context.Context, metric string) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	_, err = ix.tree.validate(metric)
+	if err != nil {
+		return err
+	}
+	// durable metrics wait for room in the writer queue, see AddDurable
+	wal := ix.tree.wal
+	durable := wal != nil && wal.policy == WAL_FSYNC_ALWAYS
+	seq := ix.tree.add(metric, durable)
+	if !durable {
+		return nil
+	}
+	return wal.WaitDurable(ctx, seq)
+}
+
+func (ix *index) Delete(ctx context.Context, metric string) (bool, error) {
+	err := ctx.Err()
+	if err != nil {
+		return false, err
+	}
+	return ix.tree.Delete(metric)
+}
+
+func (ix *index) Search(ctx context.Context, pattern string) ([]string, error) {
+	return ix.tree.SearchContext(ctx, pattern)
+}
+
+func (ix *index) Count(ctx context.Context, pattern string) (int64, int64, error) {
+	return ix.tree.CountContext(ctx, pattern)
+}
+
+// walkCheckEvery is the number of metrics Walk passes to fn between checks
+// of the context
+const walkCheckEvery = 1000
+
+func (ix *index) Walk(ctx context.Context, prefix string, fn func(metric string) error) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	count := 0
+	visit := func(path string) bool {
+		count++
+		if count%walkCheckEvery == 0 {
+			err = ctx.Err()
+			if err != nil {
+				return false
+			}
+		}
+		err = fn(path)
+		return err == nil
+	}
+	var tokens []string
+	if prefix != "" {
+		tokens = strings.Split(prefix, ".")
+	}
+	t := ix.tree
+	if t.storage != STORAGE_MAPPED {
+		walkDelta(t.Root, tokens, visit)
+		return err
+	}
+	m, deltas := t.mappedSources()
+	if m != nil {
+		defer m.readers.Done()
+		if !walkTrie(m, tokens, visit) {
+			return err
+		}
+	}
+	// metrics added again while merging may be repeated
+	for _, delta := range deltas {
+		if !walkDelta(delta, tokens, visit) {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkDelta walks leaves of root under the path of tokens, it returns false
+// if the walk is stopped
+func walkDelta(root *node, tokens []string, fn func(path string) bool) bool {
+	n := root
+	for _, token := range tokens {
+		n.Lock()
+		child := n.lookup(token)
+		n.Unlock()
+		if child == nil {
+			return true
+		}
+		n = child
+	}
+	if n == root && n.empty() {
+		// an empty tree
+		return true
+	}
+	return n.walkLeaves(strings.Join(tokens, "."), fn)
+}
+
+// walkTrie works like walkDelta for the mapped trie
+func walkTrie(m *mappedTrie, tokens []string, fn func(path string) bool) bool {
+	off := m.root
+	for _, token := range tokens {
+		child, ok := m.find(off, token)
+		if !ok {
+			return true
+		}
+		off = child
+	}
+	return m.walk(off, strings.Join(tokens, "."), fn)
+}
+
+func (ix *index) Len() int64 {
+	return atomic.LoadInt64(&ix.tree.TotalMetrics)
+}
+
+func (ix *index) Close() error {
+	return ix.tree.close()
+}
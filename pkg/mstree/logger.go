@@ -0,0 +1,74 @@
+package mstree
+
+import (
+	logging "github.com/op/go-logging"
+	"sync/atomic"
+)
+
+// Logger receives log messages of the package, *logging.Logger of
+// github.com/op/go-logging satisfies it
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Noticef(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{})  {}
+func (nopLogger) Infof(format string, args ...interface{})   {}
+func (nopLogger) Noticef(format string, args ...interface{}) {}
+func (nopLogger) Errorf(format string, args ...interface{})  {}
+
+// packageLogger forwards messages to the current Logger, it may be
+// replaced while background jobs are logging. Trees log through the
+// package one unless they're opened with a logger of their own.
+type packageLogger struct {
+	current atomic.Value
+}
+
+// loggerHolder keeps the concrete type stored in atomic.Value the same
+type loggerHolder struct {
+	Logger
+}
+
+var log = newPackageLogger(logging.MustGetLogger("metricsearch"))
+
+func newPackageLogger(l Logger) *packageLogger {
+	if l == nil {
+		l = nopLogger{}
+	}
+	pl := new(packageLogger)
+	pl.current.Store(loggerHolder{l})
+	return pl
+}
+
+func (pl *packageLogger) logger() Logger {
+	return pl.current.Load().(loggerHolder).Logger
+}
+
+func (pl *packageLogger) Debug(format string, args ...interface{}) {
+	pl.logger().Debugf(format, args...)
+}
+
+func (pl *packageLogger) Info(format string, args ...interface{}) {
+	pl.logger().Infof(format, args...)
+}
+
+func (pl *packageLogger) Notice(format string, args ...interface{}) {
+	pl.logger().Noticef(format, args...)
+}
+
+func (pl *packageLogger) Error(format string, args ...interface{}) {
+	pl.logger().Errorf(format, args...)
+}
+
+// SetLogger replaces the logger of the package, it's shared by all the
+// trees having no logger of their own. A nil logger discards messages.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	log.current.Store(loggerHolder{l})
+}
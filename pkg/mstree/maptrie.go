@@ -0,0 +1,417 @@
+package mstree
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// Trie file (index.trie) of the mapped storage mode, searched in place
+// through a read-only memory mapping:
+//
+//	magic "MSTR", version byte, 3 zero bytes
+//	root node offset and number of leaves, 8 bytes little endian each
+//	tokens and nodes, every node is written after its children and every
+//	token before the first node referring to it:
+//	  token is uvarint length followed by its bytes
+//	  node is the number of children (4 bytes) and the number of leaves
+//	  below it (8 bytes) followed by (token offset, child offset), 8 bytes
+//	  each, for every child sorted by token
+//
+// All the leaves share a single node with no children. Offsets always point
+// backwards, so a damaged file can't send a reader into a loop; entries
+// pointing anywhere else are skipped.
+
+const (
+	TRIE_FILE    = "index.trie"
+	TRIE_MAGIC   = "MSTR"
+	TRIE_VERSION = 1
+
+	TRIE_HEADER_SIZE = 24
+	TRIE_NODE_SIZE   = 12
+	TRIE_ENTRY_SIZE  = 16
+)
+
+type mappedTrie struct {
+	filename string
+	data     []byte
+	root     uint64
+	leaves   int64
+	unmap    func() error
+	// readers are searches holding the trie mapped, they're only added
+	// while the trie is installed
+	readers sync.WaitGroup
+}
+
+func openMappedTrie(filename string) (*mappedTrie, error) {
+	data, unmap, err := mapFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < TRIE_HEADER_SIZE || string(data[:len(TRIE_MAGIC)]) != TRIE_MAGIC || data[len(TRIE_MAGIC)] != TRIE_VERSION {
+		unmap()
+		return nil, fmt.Errorf("%s is not a trie file", filename)
+	}
+	m := &mappedTrie{filename: filename, data: data, unmap: unmap}
+	m.root = binary.LittleEndian.Uint64(data[8:])
+	m.leaves = int64(binary.LittleEndian.Uint64(data[16:]))
+	if m.root < TRIE_HEADER_SIZE || m.root > uint64(len(data))-TRIE_NODE_SIZE {
+		unmap()
+		return nil, fmt.Errorf("%s is damaged: root node is out of the file", filename)
+	}
+	return m, nil
+}
+
+func (m *mappedTrie) close() error {
+	return m.unmap()
+}
+
+// retire unmaps a trie which is not installed anymore once the searches
+// still reading it are over
+func (m *mappedTrie) retire() {
+	go func() {
+		m.readers.Wait()
+		m.close()
+	}()
+}
+
+// childCount returns the number of children of the node at off, zero if
+// the node doesn't fit into the file
+func (m *mappedTrie) childCount(off uint64) int {
+	size := uint64(len(m.data))
+	if off < TRIE_HEADER_SIZE || off > size-TRIE_NODE_SIZE {
+		return 0
+	}
+	count := uint64(binary.LittleEndian.Uint32(m.data[off:]))
+	if count > (size-off-TRIE_NODE_SIZE)/TRIE_ENTRY_SIZE {
+		return 0
+	}
+	return int(count)
+}
+
+func (m *mappedTrie) nodeLeaves(off uint64) int64 {
+	if off < TRIE_HEADER_SIZE || off > uint64(len(m.data))-TRIE_NODE_SIZE {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(m.data[off+4:]))
+}
+
+// entry returns the token and the node offset of the i-th child of the node
+// at off. The token points into the mapping, it must be copied to outlive
+// the trie.
+func (m *mappedTrie) entry(off uint64, i int) (string, uint64, bool) {
+	e := off + TRIE_NODE_SIZE + uint64(i)*TRIE_ENTRY_SIZE
+	tokenOff := binary.LittleEndian.Uint64(m.data[e:])
+	child := binary.LittleEndian.Uint64(m.data[e+8:])
+	if child < TRIE_HEADER_SIZE || child >= off || tokenOff < TRIE_HEADER_SIZE || tokenOff >= off {
+		return "", 0, false
+	}
+	length, n := binary.Uvarint(m.data[tokenOff:off])
+	if n <= 0 || length == 0 || length > off-tokenOff-uint64(n) {
+		return "", 0, false
+	}
+	start := tokenOff + uint64(n)
+	return unsafe.String(&m.data[start], int(length)), child, true
+}
+
+func (m *mappedTrie) token(off uint64, i int) string {
+	token, _, _ := m.entry(off, i)
+	return token
+}
+
+// find returns the offset of the child of the node at off by its token
+func (m *mappedTrie) find(off uint64, token string) (uint64, bool) {
+	count := m.childCount(off)
+	i := sort.Search(count, func(i int) bool {
+		return m.token(off, i) >= token
+	})
+	if i == count {
+		return 0, false
+	}
+	k, child, ok := m.entry(off, i)
+	if !ok || k != token {
+		return 0, false
+	}
+	return child, true
+}
+
+// hasLeaf tells if the path of tokens is a leaf of the trie
+func (m *mappedTrie) hasLeaf(tokens []string) bool {
+	off := m.root
+	for _, token := range tokens {
+		child, ok := m.find(off, token)
+		if !ok {
+			return false
+		}
+		off = child
+	}
+	return m.childCount(off) == 0
+}
+
+// prefixRange returns the range of children of the node at off having
+// tokens starting with prefix
+func (m *mappedTrie) prefixRange(off uint64, prefix string) (int, int) {
+	count := m.childCount(off)
+	lo := sort.Search(count, func(i int) bool {
+		return m.token(off, i) >= prefix
+	})
+	hi := lo + sort.Search(count-lo, func(i int) bool {
+		return !strings.HasPrefix(m.token(off, lo+i), prefix)
+	})
+	return lo, hi
+}
+
+// matchChildren calls fn for every child of the node at off matching
+// pattern, with the same semantics as node.search. Matching stops early
+// once ctx is done.
+func (m *mappedTrie) matchChildren(ctx context.Context, off uint64, pattern string, fn func(k string, child uint64)) {
+	if !strings.ContainsAny(pattern, "*?[]") {
+		if child, ok := m.find(off, pattern); ok {
+			fn(pattern, child)
+		}
+		return
+	}
+	match := matchAll
+	if pattern != "*" {
+		match = patternMatcher(pattern)
+		if match == nil {
+			return
+		}
+	}
+	match = cancellable(ctx, match)
+	ranges := [][2]int{{0, m.childCount(off)}}
+	if pattern != "*" && narrowable(pattern) {
+		prefixes := literalPrefixes(pattern)
+		ranges = make([][2]int, len(prefixes))
+		for i, prefix := range prefixes {
+			lo, hi := m.prefixRange(off, prefix)
+			ranges[i] = [2]int{lo, hi}
+		}
+	}
+	for _, r := range ranges {
+		for i := r[0]; i < r[1]; i++ {
+			k, child, ok := m.entry(off, i)
+			if ok && match(k) {
+				fn(k, child)
+			}
+		}
+	}
+}
+
+// trieJoin appends token to a dotted prefix, the result never shares
+// memory with the mapping
+func trieJoin(prefix string, token string) string {
+	if prefix == "" {
+		return strings.Clone(token)
+	}
+	return prefix + "." + token
+}
+
+// complete works like MSTree.Complete on the trie, it stops early once ctx
+// is done
+func (m *mappedTrie) complete(ctx context.Context, prefix string, limit int) []Completion {
+	results := make([]Completion, 0)
+	tokens := strings.Split(prefix, ".")
+	head, last := tokens[:len(tokens)-1], tokens[len(tokens)-1]
+	off := m.root
+	for _, token := range head {
+		child, ok := m.find(off, token)
+		if !ok {
+			return results
+		}
+		off = child
+	}
+	pathPrefix := strings.Join(head, ".")
+	lo, hi := m.prefixRange(off, last)
+	for i := lo; i < hi; i++ {
+		if limit > 0 && len(results) == limit || ctx.Err() != nil {
+			break
+		}
+		k, child, ok := m.entry(off, i)
+		if !ok {
+			continue
+		}
+		leaf := m.childCount(child) == 0
+		path := trieJoin(pathPrefix, k)
+		if !leaf {
+			path += "."
+		}
+		results = append(results, Completion{path, leaf, m.nodeLeaves(child)})
+	}
+	return results
+}
+
+// walk calls fn for every leaf below the node at off until fn returns
+// false, it returns false if the walk is stopped
+func (m *mappedTrie) walk(off uint64, prefix string, fn func(path string) bool) bool {
+	count := m.childCount(off)
+	if count == 0 {
+		if prefix != "" {
+			return fn(prefix)
+		}
+		return true
+	}
+	for i := 0; i < count; i++ {
+		k, child, ok := m.entry(off, i)
+		if ok && !m.walk(child, trieJoin(prefix, k), fn) {
+			return false
+		}
+	}
+	return true
+}
+
+type trieWriter struct {
+	w      *bufio.Writer
+	off    uint64
+	tokens map[string]uint64
+	// leaf is the offset of the node shared by all the leaves
+	leaf uint64
+	buf  [binary.MaxVarintLen64]byte
+	err  error
+}
+
+func (tw *trieWriter) write(data []byte) {
+	if tw.err != nil {
+		return
+	}
+	n, err := tw.w.Write(data)
+	tw.off += uint64(n)
+	tw.err = err
+}
+
+func (tw *trieWriter) token(token string) uint64 {
+	if off, ok := tw.tokens[token]; ok {
+		return off
+	}
+	off := tw.off
+	n := binary.PutUvarint(tw.buf[:], uint64(len(token)))
+	tw.write(tw.buf[:n])
+	if tw.err == nil {
+		n, tw.err = tw.w.WriteString(token)
+		tw.off += uint64(n)
+	}
+	tw.tokens[token] = off
+	return off
+}
+
+func (tw *trieWriter) node(tokens []string, children []uint64, leaves uint64) uint64 {
+	tokenOffs := make([]uint64, len(tokens))
+	for i, token := range tokens {
+		tokenOffs[i] = tw.token(token)
+	}
+	off := tw.off
+	binary.LittleEndian.PutUint32(tw.buf[:4], uint32(len(tokens)))
+	tw.write(tw.buf[:4])
+	binary.LittleEndian.PutUint64(tw.buf[:8], leaves)
+	tw.write(tw.buf[:8])
+	for i := range tokens {
+		binary.LittleEndian.PutUint64(tw.buf[:8], tokenOffs[i])
+		tw.write(tw.buf[:8])
+		binary.LittleEndian.PutUint64(tw.buf[:8], children[i])
+		tw.write(tw.buf[:8])
+	}
+	return off
+}
+
+// trieSources are the nodes having the same path in the trie being merged
+// and in the deltas
+type trieSources struct {
+	base   *mappedTrie
+	off    uint64
+	deltas []*node
+}
+
+// merge writes the union of the trie node at off (if base isn't nil) and
+// the delta nodes, it returns the offset of the node written and the number
+// of leaves below it
+func (tw *trieWriter) merge(base *mappedTrie, off uint64, deltas []*node) (uint64, uint64) {
+	children := make(map[string]*trieSources)
+	tokens := make([]string, 0)
+	get := func(k string) *trieSources {
+		src, ok := children[k]
+		if !ok {
+			src = new(trieSources)
+			children[k] = src
+			tokens = append(tokens, k)
+		}
+		return src
+	}
+	if base != nil {
+		for i, count := 0, base.childCount(off); i < count; i++ {
+			k, child, ok := base.entry(off, i)
+			if ok {
+				src := get(k)
+				src.base = base
+				src.off = child
+			}
+		}
+	}
+	for _, delta := range deltas {
+		delta.forEach(func(k string, child *node) {
+			src := get(k)
+			src.deltas = append(src.deltas, child)
+		})
+	}
+	if len(tokens) == 0 {
+		return tw.leaf, 1
+	}
+	sort.Strings(tokens)
+	offs := make([]uint64, len(tokens))
+	var leaves uint64
+	for i, k := range tokens {
+		src := children[k]
+		var l uint64
+		offs[i], l = tw.merge(src.base, src.off, src.deltas)
+		leaves += l
+	}
+	return tw.node(tokens, offs, leaves), leaves
+}
+
+// writeTrie writes the union of base (may be nil) and deltas to filename
+// and returns the number of leaves written
+func writeTrie(filename string, base *mappedTrie, deltas []*node) (int64, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	tw := &trieWriter{w: bufio.NewWriter(f), tokens: make(map[string]uint64)}
+	tw.write(make([]byte, TRIE_HEADER_SIZE))
+	tw.leaf = tw.node(nil, nil, 1)
+	var baseRoot uint64
+	if base != nil {
+		baseRoot = base.root
+	}
+	root, leaves := tw.merge(base, baseRoot, deltas)
+	if root == tw.leaf {
+		// empty tree
+		leaves = 0
+	}
+	if tw.err != nil {
+		return 0, tw.err
+	}
+	err = tw.w.Flush()
+	if err != nil {
+		return 0, err
+	}
+	header := make([]byte, TRIE_HEADER_SIZE)
+	copy(header, TRIE_MAGIC)
+	header[len(TRIE_MAGIC)] = TRIE_VERSION
+	binary.LittleEndian.PutUint64(header[8:], root)
+	binary.LittleEndian.PutUint64(header[16:], leaves)
+	_, err = f.WriteAt(header, 0)
+	if err != nil {
+		return 0, err
+	}
+	err = f.Sync()
+	if err != nil {
+		return 0, err
+	}
+	return int64(leaves), f.Close()
+}
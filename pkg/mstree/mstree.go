@@ -0,0 +1,1070 @@
+package mstree
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"runtime"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	TOKEN_MAX_LENGTH = 500
+)
+
+type MSTree struct {
+	indexDir       string
+	genDir         string
+	Root           *node
+	syncBufferSize int
+	writers        []*indexWriter
+	writerCount    int
+	maxOpenFiles   int
+	writersLock    *sync.Mutex
+	compactLock    *sync.Mutex
+	TotalMetrics   int64
+	enableSync     bool
+	validateTokens bool
+	indexFormat    string
+	compression    string
+	tokens         *tokenIndex
+	corrupt        []CorruptFile
+	corruptLock    *sync.Mutex
+	wal            *writeAheadLog
+	// overflow settings, queue statistics are kept by the index writers
+	overflowPolicy  string
+	overflowTimeout time.Duration
+	overflow        *overflowLog
+	drainLock       *sync.Mutex
+	// walLock is held shared by Add from inserting a metric till passing
+	// it to the index writer and exclusively by WAL checkpoints and
+	// generation switches
+	walLock *sync.RWMutex
+	// freezeLock is held shared by inserts and exclusively by writeArchive
+	// and freezeDelta to see the tree with no insert in flight
+	freezeLock *sync.RWMutex
+	// stop is closed by Close to stop background jobs
+	stop      chan bool
+	closeOnce *sync.Once
+	// watchers are background jobs Close waits for
+	watchers *sync.WaitGroup
+	// storage is STORAGE_MEMORY or STORAGE_MAPPED, in the latter mode
+	// Root only holds the delta merged into the mapped trie periodically.
+	// The trie, frozen deltas being merged and swapping Root are guarded
+	// by mappedLock.
+	storage    string
+	mapped     *mappedTrie
+	frozen     []*node
+	mappedLock *sync.RWMutex
+	// store keeps index files of the current generation
+	store     IndexStore
+	storeKind string
+	// prepared is set while genDir is a generation written by
+	// PrepareGeneration and not made current yet
+	prepared bool
+	// log is the package logger unless the tree is opened with its own
+	log *packageLogger
+}
+type eventChan chan error
+
+// writeRequest is either a metric tail to append to the index file of a
+// first level token or a barrier to be released when everything queued
+// before is synced to disk
+type writeRequest struct {
+	token   string
+	line    string
+	barrier *sync.WaitGroup
+}
+type Completion struct {
+	Path string
+	Leaf bool
+	Size int64
+}
+type TreeCreateError struct {
+	msg string
+}
+
+func (tce *TreeCreateError) Error() string {
+	return tce.msg
+}
+
+type InvalidMetricError struct {
+	msg string
+}
+
+func (ime *InvalidMetricError) Error() string {
+	return ime.msg
+}
+
+var (
+	VALID_TOKEN_RE = regexp.MustCompile("^[a-z0-9A-Z_?:/-]+$")
+)
+
+func NewTree(indexDir string, syncBufferSize int, validateTokens bool) (*MSTree, error) {
+	return newTree(indexDir, syncBufferSize, validateTokens, log)
+}
+
+// newTree works like NewTree logging to log
+func newTree(indexDir string, syncBufferSize int, validateTokens bool, log *packageLogger) (*MSTree, error) {
+	stat, err := os.Stat(indexDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = os.MkdirAll(indexDir, os.FileMode(0755))
+			if err != nil {
+				log.Error("%s", err.Error())
+				return nil, err
+			}
+		} else {
+			log.Error("%s", err.Error())
+			return nil, err
+		}
+	} else {
+		if !stat.IsDir() {
+			log.Error("'%s' exists and is not a directory", indexDir)
+			return nil, &TreeCreateError{fmt.Sprintf("'%s' exists and is not a directory", indexDir)}
+		}
+	}
+	genDir, err := currentGeneration(indexDir)
+	if err != nil {
+		log.Error("Error reading current index generation: %s", err.Error())
+		return nil, err
+	}
+	root := newNode()
+	enableSync := syncBufferSize > 0
+	tree := &MSTree{indexDir, genDir, root, syncBufferSize, nil, DEFAULT_SYNC_WRITERS, DEFAULT_MAX_OPEN_FILES, new(sync.Mutex), new(sync.Mutex), 0, enableSync, validateTokens, INDEX_FORMAT_BINARY, COMPRESSION_NONE, newTokenIndex(), make([]CorruptFile, 0), new(sync.Mutex), nil, SYNC_OVERFLOW_BLOCK, 0, newOverflowLog(), new(sync.Mutex), new(sync.RWMutex), new(sync.RWMutex), make(chan bool), new(sync.Once), new(sync.WaitGroup), STORAGE_MEMORY, nil, nil, new(sync.RWMutex), nil, INDEX_STORE_FILES, false, log}
+	tree.store = &filesStore{tree, genDir}
+	tree.log.Debug("Tree created. indexDir: %s generation: %s syncBufferSize: %d", indexDir, genDir, syncBufferSize)
+	return tree, nil
+}
+
+// SetIndexFormat sets the format DumpIndex and Compact write index files in,
+// both formats are always readable by LoadIndex
+func (t *MSTree) SetIndexFormat(format string) error {
+	if format != INDEX_FORMAT_TEXT && format != INDEX_FORMAT_BINARY {
+		return fmt.Errorf("unknown index format '%s'", format)
+	}
+	t.indexFormat = format
+	return nil
+}
+
+func (t *MSTree) dumpFilename(dir string, indexToken string) string {
+	if t.indexFormat == INDEX_FORMAT_BINARY {
+		return fmt.Sprintf("%s/%s%s", dir, indexToken, SNAPSHOT_SUFFIX)
+	}
+	return fmt.Sprintf("%s/%s.idx", dir, indexToken)
+}
+
+func (t *MSTree) dumpWorker(store IndexStore, indexToken string, idxNode *node, ev eventChan) {
+	t.log.Debug("<%s> dumper started", indexToken)
+	err := store.Dump(indexToken, idxNode)
+	if err != nil {
+		t.log.Error("<%s> dumper finished with error: %s", indexToken, err.Error())
+		ev <- err
+		return
+	}
+	t.log.Debug("<%s> dumper finished", indexToken)
+	ev <- nil
+}
+
+// dumpFile writes idxNode to a temporary file which replaces idxFile only
+// after it's completely written and synced so a crash or a full disk never
+// leaves idxFile truncated
+func dumpFile(idxFile string, idxNode *node, format string, compression string) error {
+	tmpFile := idxFile + TMP_SUFFIX
+	err := dumpTmpFile(tmpFile, idxNode, format, compression)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, idxFile)
+}
+
+func dumpTmpFile(tmpFile string, idxNode *node, format string, compression string) error {
+	f, err := os.Create(tmpFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	var out io.Writer = w
+	var gz *gzip.Writer
+	if compression == COMPRESSION_GZIP {
+		gz = gzip.NewWriter(w)
+		out = gz
+	}
+	if format == INDEX_FORMAT_BINARY {
+		err = writeSnapshot(out, idxNode)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = writeIdxHeader(out)
+		if err != nil {
+			return err
+		}
+		idxNode.dumpRecords("", out)
+	}
+	if gz != nil {
+		err = gz.Close()
+		if err != nil {
+			return err
+		}
+	}
+	// bufio.Writer keeps the first write error and returns it on Flush
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (t *MSTree) loadWorker(store IndexStore, indexToken string, idxNode *node, ev eventChan) {
+	loaded, err := store.Load(indexToken, idxNode, t.tokens)
+	atomic.AddInt64(&t.TotalMetrics, loaded)
+	ev <- err
+}
+
+// validate splits metric into tokens returning an error if it can't be
+// added to the tree
+func (t *MSTree) validate(metric string) ([]string, error) {
+	if metric == "" {
+		return nil, &InvalidMetricError{"empty metric"}
+	}
+	tokens := strings.Split(metric, ".")
+	for _, token := range tokens {
+		if len(token) > TOKEN_MAX_LENGTH {
+			return nil, &InvalidMetricError{fmt.Sprintf("token '%s' is too long", token)}
+		}
+		if len(token) == 0 {
+			return nil, &InvalidMetricError{fmt.Sprintf("empty token in metric '%s'", metric)}
+		}
+		if t.validateTokens && !VALID_TOKEN_RE.MatchString(token) {
+			return nil, &InvalidMetricError{fmt.Sprintf("invalid token '%s' in metric '%s'", token, metric)}
+		}
+	}
+	return tokens, nil
+}
+
+func (t *MSTree) AddNoSync(metric string) bool {
+	tokens, err := t.validate(metric)
+	if err != nil {
+		t.log.Error("Metric ignored: %s", err.Error())
+		return false
+	}
+
+	inserted := false
+	t.freezeLock.RLock()
+	if t.storage == STORAGE_MAPPED && t.inTrie(tokens) {
+		t.freezeLock.RUnlock()
+		return false
+	}
+	t.Root.insert(tokens, &inserted, t.tokens)
+	t.freezeLock.RUnlock()
+	if inserted {
+		atomic.AddInt64(&t.TotalMetrics, 1)
+	}
+	return inserted
+}
+
+// Delete removes a metric from the tree telling if it was there, it stays
+// in index files until they're compacted or dumped. It's not supported in
+// the mapped storage mode.
+func (t *MSTree) Delete(metric string) (bool, error) {
+	if t.storage == STORAGE_MAPPED {
+		return false, ErrNotSupported
+	}
+	removed := false
+	t.freezeLock.RLock()
+	t.Root.remove(strings.Split(metric, "."), &removed, t.tokens)
+	t.freezeLock.RUnlock()
+	if removed {
+		atomic.AddInt64(&t.TotalMetrics, -1)
+	}
+	return removed, nil
+}
+
+func (t *MSTree) Synced() bool {
+	qsize, _ := t.SyncQueueSize()
+	return qsize == 0
+}
+
+func (t *MSTree) Add(metric string) {
+	durable := t.wal != nil && t.wal.policy == WAL_FSYNC_ALWAYS
+	seq := t.add(metric, durable)
+	if durable {
+		err := t.wal.WaitDurable(context.Background(), seq)
+		if err != nil {
+			t.log.Error("Error logging metric '%s' to WAL: %s", metric, err.Error())
+		}
+	}
+}
+
+// AddDurable works like Add but returns only when the metric is synced to
+// the write-ahead log. The metric is never dropped or spilled by the
+// overflow policy as its WAL segment is removed on the next checkpoint,
+// AddDurable waits for room in the writer queue instead.
+func (t *MSTree) AddDurable(metric string) error {
+	if t.wal == nil {
+		return ErrWALDisabled
+	}
+	return t.wal.WaitDurable(context.Background(), t.add(metric, true))
+}
+
+// add inserts metric, logs it to WAL if enabled and passes it to the index
+// writer. It returns the WAL sequence number to wait for to make sure the
+// metric is durable. With wait set the writer queue is waited for regardless
+// of the overflow policy.
+func (t *MSTree) add(metric string, wait bool) uint64 {
+	t.walLock.RLock()
+	defer t.walLock.RUnlock()
+	inserted := t.AddNoSync(metric)
+	if t.enableSync && inserted {
+		var seq uint64
+		if t.wal != nil {
+			seq = t.wal.Append(metric)
+		}
+		if wait {
+			t.enqueueWait(metric)
+		} else {
+			t.enqueue(metric)
+		}
+		return seq
+	}
+	if t.wal != nil {
+		// the metric might be logged but not synced yet
+		return t.wal.LastSeq()
+	}
+	return 0
+}
+
+func (t *MSTree) enqueue(metric string) {
+	delimPos := strings.Index(metric, ".")
+	if delimPos <= 0 || delimPos == len(metric)-1 {
+		return
+	}
+	indexToken := metric[:delimPos]
+	metricTail := metric[delimPos+1:]
+	iw := t.writerFor(indexToken)
+	req := writeRequest{token: indexToken, line: metricTail}
+	atomic.AddInt64(&iw.queueSize, 1)
+	if !t.send(iw, req) {
+		atomic.AddInt64(&iw.queueSize, -1)
+		t.overflowed(metric, iw)
+	}
+}
+
+// enqueueWait passes metric to the index writer waiting for room in its
+// queue regardless of the overflow policy
+func (t *MSTree) enqueueWait(metric string) {
+	delimPos := strings.Index(metric, ".")
+	if delimPos <= 0 || delimPos == len(metric)-1 {
+		return
+	}
+	indexToken := metric[:delimPos]
+	iw := t.writerFor(indexToken)
+	atomic.AddInt64(&iw.queueSize, 1)
+	iw.data <- writeRequest{token: indexToken, line: metric[delimPos+1:]}
+}
+
+// Close stops background jobs of the tree and its index writers once
+// everything queued is synced to disk. The tree must not be modified after
+// that.
+func (t *MSTree) Close() {
+	t.close()
+}
+
+// close works like Close returning the first error met while closing files,
+// errors are logged as well
+func (t *MSTree) close() error {
+	var closeErr error
+	t.closeOnce.Do(func() {
+		close(t.stop)
+		t.watchers.Wait()
+		// wait for a running compaction or drain to complete
+		t.compactLock.Lock()
+		defer t.compactLock.Unlock()
+		t.drainLock.Lock()
+		defer t.drainLock.Unlock()
+
+		t.writerBarrier().Wait()
+		t.writersLock.Lock()
+		for _, iw := range t.writers {
+			close(iw.quit)
+			<-iw.done
+		}
+		t.writersLock.Unlock()
+		if t.wal != nil {
+			t.wal.close()
+		}
+		err := t.overflow.rotate()
+		if err != nil {
+			t.log.Error("Error closing overflow file: %s", err.Error())
+			closeErr = err
+		}
+		err = t.store.Close()
+		if err != nil {
+			t.log.Error("Error closing index store: %s", err.Error())
+			if closeErr == nil {
+				closeErr = err
+			}
+		}
+		t.mappedLock.Lock()
+		if t.mapped != nil {
+			t.mapped.retire()
+			t.mapped = nil
+		}
+		t.mappedLock.Unlock()
+		t.log.Debug("Tree closed. indexDir: %s generation: %s", t.indexDir, t.genDir)
+	})
+	return closeErr
+}
+
+func (t *MSTree) LoadTxt(filename string, limit int) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return t.LoadTxtReader(f, limit)
+}
+
+// LoadTxtReader reads metric names line by line from r and then replaces
+// the whole index on disk with the resulting tree
+func (t *MSTree) LoadTxtReader(r io.Reader, limit int) error {
+	var progress int64
+	return t.LoadTxtProgress(r, limit, &progress)
+}
+
+// LoadTxtProgress works like LoadTxtReader counting lines read in progress
+// so the load can be watched from another goroutine
+func (t *MSTree) LoadTxtProgress(r io.Reader, limit int, progress *int64) error {
+	err := t.cleanup()
+	if err != nil {
+		return err
+	}
+	err = t.AddTxt(r, limit, progress)
+	if err != nil {
+		return err
+	}
+	return t.DumpIndex()
+}
+
+// AddTxt reads metric names line by line from r into the tree without
+// writing them anywhere, lines read are counted in progress
+func (t *MSTree) AddTxt(r io.Reader, limit int, progress *int64) error {
+	scanner := bufio.NewScanner(r)
+	count := 0
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\n")
+		t.AddNoSync(line)
+		count++
+		atomic.StoreInt64(progress, int64(count))
+		if count%1000000 == 0 {
+			t.log.Info("Reindexed %d items", count)
+		}
+		if limit != -1 && count == limit {
+			break
+		}
+	}
+	err := scanner.Err()
+	if err != nil {
+		return err
+	}
+	t.log.Info("Reindexed %d items", count)
+	return nil
+}
+
+// cleanup removes leftovers of generation switches interrupted by a crash,
+// it's done by the tree loading the index as temporary files of a tree
+// running on the same index directory must not be removed
+func (t *MSTree) cleanup() error {
+	err := cleanupGenerations(t.log, t.indexDir, t.genDir)
+	if err != nil {
+		t.log.Error("Error cleaning up index directory: %s", err.Error())
+	}
+	return err
+}
+
+// DropIndex atomically switches to a new empty index generation
+func (t *MSTree) DropIndex() error {
+	t.pauseWriters()
+	defer t.resumeWriters()
+	genDir, err := newGeneration(t.indexDir)
+	if err != nil {
+		t.log.Error("Error creating index generation: %s", err.Error())
+		return err
+	}
+	store, _ := t.openIndexStore(t.storeKind, genDir)
+	err = t.switchTo(genDir, store)
+	if err != nil {
+		t.log.Error("Error switching index generation: %s", err.Error())
+		store.Drop()
+		os.RemoveAll(genDir)
+		return err
+	}
+	return nil
+}
+
+// DumpIndex writes the entire tree into a new index generation and switches
+// to it only when all the files are written and synced, so the previous
+// index stays intact if anything goes wrong. Metrics added with Add wait
+// for the dump to complete, index writers and the write-ahead log continue
+// in the new generation.
+func (t *MSTree) DumpIndex() error {
+	t.log.Info("Syncinc the entire index")
+	t.pauseWriters()
+	defer t.resumeWriters()
+	genDir, store, m, err := t.writeGeneration()
+	if err == nil {
+		err = t.switchTo(genDir, store)
+		if err != nil {
+			if m != nil {
+				m.close()
+			}
+			store.Drop()
+			os.RemoveAll(genDir)
+		}
+	}
+	if err != nil {
+		t.log.Error("Sync failed, keeping the previous index: %s", err.Error())
+		return err
+	}
+	if m != nil {
+		t.installTrie(m)
+		t.log.Info("Sync complete, %d metrics", m.leaves)
+		return nil
+	}
+	t.log.Info("Sync complete")
+	return nil
+}
+
+// writeGeneration writes the entire tree into a new index generation which
+// is not made current. In the mapped storage mode the trie merged with the
+// delta is written and returned mapped, it's to be installed once the tree
+// works on the new generation. It must be called with writers paused.
+func (t *MSTree) writeGeneration() (string, IndexStore, *mappedTrie, error) {
+	err := os.MkdirAll(t.indexDir, os.FileMode(0755))
+	if err != nil {
+		t.log.Error("%s", err.Error())
+		return "", nil, nil, err
+	}
+	genDir, err := newGeneration(t.indexDir)
+	if err != nil {
+		t.log.Error("Error creating index generation: %s", err.Error())
+		return "", nil, nil, err
+	}
+	store, _ := t.openIndexStore(t.storeKind, genDir)
+	if t.storage == STORAGE_MAPPED {
+		m, err := t.writeMerged(t.trieFilename(genDir), t.freezeDelta())
+		if err != nil {
+			store.Drop()
+			os.RemoveAll(genDir)
+			return "", nil, nil, err
+		}
+		return genDir, store, m, nil
+	}
+	procCount := 0
+	ev := make(eventChan, t.Root.childCount())
+	t.Root.forEach(func(first string, node *node) {
+		go t.dumpWorker(store, first, node, ev)
+		procCount++
+	})
+	var globalErr error = nil
+	for procCount > 0 {
+		e := <-ev
+		procCount--
+		if e != nil {
+			globalErr = e
+		}
+	}
+	if globalErr != nil {
+		store.Drop()
+		os.RemoveAll(genDir)
+		return "", nil, nil, globalErr
+	}
+	return genDir, store, nil, nil
+}
+
+// PrepareGeneration writes the entire tree into a new index generation
+// without making it current and makes the tree work on it, so a tree built
+// aside doesn't touch the index of a running tree of the same directory.
+// It must be called before the write-ahead log is started and anything is
+// passed to index writers, those started afterwards write into the new
+// generation. Replace makes it current.
+func (t *MSTree) PrepareGeneration() error {
+	t.pauseWriters()
+	defer t.resumeWriters()
+	t.writersLock.Lock()
+	started := t.writers != nil || t.wal != nil
+	t.writersLock.Unlock()
+	if started {
+		return fmt.Errorf("index writers are already started")
+	}
+	genDir, store, m, err := t.writeGeneration()
+	if err != nil {
+		t.log.Error("Error preparing index generation: %s", err.Error())
+		return err
+	}
+	t.genDir = genDir
+	t.store.Close()
+	t.store = store
+	t.prepared = true
+	if m != nil {
+		t.installTrie(m)
+	}
+	t.log.Info("Index generation %s prepared", genDir)
+	return nil
+}
+
+// Replace makes the generation prepared by PrepareGeneration current in
+// place of the generation of prev, a tree running on the same index
+// directory. Everything passed to index writers of the tree is synced
+// first, so a crash at any moment leaves either index complete. prev is
+// closed and its generation removed afterwards, nothing must be added to it
+// meanwhile.
+func (t *MSTree) Replace(prev *MSTree) error {
+	t.pauseWriters()
+	defer t.resumeWriters()
+	if !t.prepared || prev.indexDir != t.indexDir {
+		return fmt.Errorf("no index generation prepared to replace %s", prev.indexDir)
+	}
+	err := linkGeneration(t.indexDir, t.genDir)
+	if err != nil {
+		t.log.Error("Error switching index generation: %s", err.Error())
+		return err
+	}
+	t.prepared = false
+	prev.Close()
+	removeGeneration(t.log, prev.indexDir, prev.genDir)
+	t.log.Notice("Index generation %s replaced by %s", prev.genDir, t.genDir)
+	return nil
+}
+
+// Discard closes a tree built to replace another one and removes the
+// generation prepared for it if Replace hasn't made it current
+func (t *MSTree) Discard() {
+	t.Close()
+	if t.prepared {
+		removeGeneration(t.log, t.indexDir, t.genDir)
+	}
+}
+
+func (t *MSTree) LoadIndex() error {
+	var globalErr error = nil
+	err := t.cleanup()
+	if err != nil {
+		return err
+	}
+	files, err := ioutil.ReadDir(t.genDir)
+	if err != nil {
+		t.log.Error("Error loading index: %s", err.Error())
+		return err
+	}
+	if t.storage == STORAGE_MAPPED {
+		err = t.mapTrie()
+	} else {
+		err = t.loadTrie()
+	}
+	if err != nil {
+		t.log.Error("Error loading trie: %s", err.Error())
+		return err
+	}
+	if len(files) > 0 {
+
+		// Turn GC off
+		prevGC := debug.SetGCPercent(-1)
+		// Defer to turn GC back on
+		defer debug.SetGCPercent(prevGC)
+
+		store := t.store
+		tokens, err := store.Tokens()
+		if err == nil && len(tokens) == 0 {
+			var foreign IndexStore
+			foreign, tokens, err = t.foreignStore()
+			if foreign != nil {
+				store = foreign
+				defer foreign.Close()
+			}
+		}
+		if err != nil {
+			t.log.Error("Error loading index: %s", err.Error())
+			return err
+		}
+
+		ev := make(eventChan, len(tokens))
+		procCount := 0
+		idxNodes := make([]*node, 0, len(tokens))
+		for _, pref := range tokens {
+			idxNode := &node{token: t.tokens.intern(pref)}
+			t.Root.addChild(idxNode)
+			t.tokens.add(idxNode.token, idxNode)
+			idxNodes = append(idxNodes, idxNode)
+			go t.loadWorker(store, pref, idxNode, ev)
+			procCount++
+		}
+		tm := time.Now()
+
+		for procCount > 0 {
+			e := <-ev
+			procCount--
+			if e != nil {
+				globalErr = e
+			}
+		}
+		for _, idxNode := range idxNodes {
+			if idxNode.isLeaf() {
+				// all the metrics of the token are deleted or merged
+				// into the trie
+				t.Root.removeChild(idxNode)
+				t.tokens.remove(idxNode.token, idxNode)
+			}
+		}
+		t.Root.forEach(func(_ string, idxNode *node) {
+			atomic.AddInt64(&t.Root.count, idxNode.Count())
+		})
+		if store != t.store && globalErr == nil {
+			err = t.convertStore(store, idxNodes)
+			if err != nil {
+				t.log.Error("Error converting index: %s", err.Error())
+				globalErr = err
+			}
+		}
+		if t.enableSync {
+			err = t.replayWAL()
+			if err != nil {
+				t.log.Error("Error replaying WAL: %s", err.Error())
+				globalErr = err
+			}
+			err = t.loadOverflow()
+			if err != nil {
+				t.log.Error("Error loading overflow files: %s", err.Error())
+				globalErr = err
+			}
+		}
+		t.log.Notice("Index load complete in %s", time.Now().Sub(tm).String())
+	} else {
+		t.log.Debug("Index is empty. Hope that's ok")
+	}
+	return globalErr
+}
+
+func searchStep(ctx context.Context, nodesToSearch map[string]*node, token string) map[string]*node {
+	prefRes := make(map[string]*node)
+	for k, n := range nodesToSearch {
+		if ctx.Err() != nil {
+			break
+		}
+		prefix := k
+		n.eachMatch(ctx, token, func(j string, resNode *node) {
+			if prefix == "" {
+				// root node, no prefix
+				prefRes[j] = resNode
+			} else {
+				prefRes[prefix+"."+j] = resNode
+			}
+		})
+	}
+	return prefRes
+}
+
+func searchResults(nodesToSearch map[string]*node) []string {
+	results := make([]string, len(nodesToSearch))
+	i := 0
+	for k, node := range nodesToSearch {
+		if node.isLeaf() {
+			results[i] = k
+		} else {
+			results[i] = k + "."
+		}
+		i++
+	}
+	return results
+}
+
+func (t *MSTree) Search(pattern string) []string {
+	results, _ := t.SearchContext(context.Background(), pattern)
+	return results
+}
+
+// SearchContext works like Search but abandons the search once ctx is done
+// returning ctx.Err()
+func (t *MSTree) SearchContext(ctx context.Context, pattern string) ([]string, error) {
+	results := make([]string, 0)
+	err := t.SearchFunc(ctx, pattern, func(path string, leaf bool) bool {
+		if !leaf {
+			path += "."
+		}
+		results = append(results, path)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// SearchFunc passes paths matching pattern to fn depth-first as they're
+// found, leaf tells a metric from a branch. The search stops as soon as fn
+// returns false. In the mapped storage mode children of every path matched
+// are merged from the trie and the deltas before they're passed on. Once
+// ctx is done the search is abandoned and ctx.Err() is returned, some of
+// the matches may have been passed to fn by then.
+func (t *MSTree) SearchFunc(ctx context.Context, pattern string, fn func(path string, leaf bool) bool) error {
+	if t.storage == STORAGE_MAPPED {
+		return t.mappedSearchFunc(ctx, pattern, fn)
+	}
+	if !searchFunc(ctx, t.Root, "", strings.Split(pattern, "."), fn) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// searchFunc returns false if the search is stopped by fn or ctx
+func searchFunc(ctx context.Context, n *node, prefix string, tokens []string, fn func(path string, leaf bool) bool) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	for i, m := range n.matches(ctx, tokens[0]) {
+		// matches are streamed long after they're found
+		if (i+1)%SEARCH_CHECK_EVERY == 0 && ctx.Err() != nil {
+			return false
+		}
+		path := m.token
+		if prefix != "" {
+			path = prefix + "." + m.token
+		}
+		if len(tokens) == 1 {
+			if !fn(path, m.node.isLeaf()) {
+				return false
+			}
+		} else if !searchFunc(ctx, m.node, path, tokens[1:], fn) {
+			return false
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// SearchBatch runs several searches in parallel. Like Search it locks
+// nodes one by one, so metrics added while the batch runs may be seen by
+// some of its patterns only. Results are returned in the order of
+// patterns; once ctx is done the rest of the batch is abandoned and
+// ctx.Err() is returned.
+func (t *MSTree) SearchBatch(ctx context.Context, patterns []string) ([][]string, error) {
+	search := func(pattern string) []string {
+		found, _ := t.SearchContext(ctx, pattern)
+		return found
+	}
+	if t.storage != STORAGE_MAPPED {
+		memo := newSearchMemo(t.Root)
+		search = func(pattern string) []string {
+			return memo.search(ctx, pattern)
+		}
+	}
+	results := make([][]string, len(patterns))
+	jobs := make(chan int)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < runtime.GOMAXPROCS(0); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = search(patterns[i])
+			}
+		}()
+	}
+feed:
+	for i := range patterns {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Complete treats the last token of prefix as a partially typed one and
+// returns up to limit existing paths continuing it, sorted. Branches are
+// flagged by the trailing "." just like in Search results.
+func (t *MSTree) Complete(prefix string, limit int) []Completion {
+	results, _ := t.CompleteContext(context.Background(), prefix, limit)
+	return results
+}
+
+// CompleteContext works like Complete but abandons the completion once ctx
+// is done returning ctx.Err()
+func (t *MSTree) CompleteContext(ctx context.Context, prefix string, limit int) ([]Completion, error) {
+	var results []Completion
+	if t.storage == STORAGE_MAPPED {
+		results = t.completeMapped(ctx, prefix, limit)
+	} else {
+		results = completeNode(ctx, t.Root, prefix, limit)
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// completeNode stops early once ctx is done
+func completeNode(ctx context.Context, root *node, prefix string, limit int) []Completion {
+	results := make([]Completion, 0)
+	tokens := strings.Split(prefix, ".")
+	head, last := tokens[:len(tokens)-1], tokens[len(tokens)-1]
+	n := root
+	for _, token := range head {
+		n.Lock()
+		child := n.lookup(token)
+		n.Unlock()
+		if child == nil {
+			return results
+		}
+		n = child
+	}
+	pathPrefix := strings.Join(head, ".")
+	if pathPrefix != "" {
+		pathPrefix += "."
+	}
+	for _, m := range n.complete(last, limit) {
+		if ctx.Err() != nil {
+			break
+		}
+		leaf := m.node.empty()
+		path := pathPrefix + m.token
+		if !leaf {
+			path += "."
+		}
+		results = append(results, Completion{path, leaf, m.node.Count()})
+	}
+	return results
+}
+
+// Count returns the number of leaves and branches Search(pattern) would
+// return without building the results themselves
+func (t *MSTree) Count(pattern string) (int64, int64) {
+	leaves, branches, _ := t.CountContext(context.Background(), pattern)
+	return leaves, branches
+}
+
+// CountContext works like Count but abandons counting once ctx is done
+// returning ctx.Err()
+func (t *MSTree) CountContext(ctx context.Context, pattern string) (int64, int64, error) {
+	if t.storage == STORAGE_MAPPED {
+		return t.countMapped(ctx, pattern)
+	}
+	tokens := strings.Split(pattern, ".")
+	nodesToSearch := []*node{t.Root}
+	for _, token := range tokens[:len(tokens)-1] {
+		next := make([]*node, 0)
+		for _, node := range nodesToSearch {
+			for _, m := range node.matches(ctx, token) {
+				next = append(next, m.node)
+			}
+		}
+		nodesToSearch = next
+	}
+
+	var leaves, branches int64
+	last := tokens[len(tokens)-1]
+	for _, node := range nodesToSearch {
+		if ctx.Err() != nil {
+			break
+		}
+		if last == "*" {
+			l, b := node.countChildren()
+			leaves += l
+			branches += b
+			continue
+		}
+		for _, m := range node.matches(ctx, last) {
+			if m.node.isLeaf() {
+				leaves++
+			} else {
+				branches++
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	return leaves, branches, nil
+}
+
+// FuzzySearch ranks leaves under prefix (an exact dotted path, may be empty)
+// by how similar their tokens are to the free-form query tokens and returns
+// up to limit best scored metrics, best first. It's not supported in the
+// mapped storage mode.
+func (t *MSTree) FuzzySearch(query string, prefix string, limit int) ([]ScoredMetric, error) {
+	return t.FuzzySearchContext(context.Background(), query, prefix, limit)
+}
+
+// FuzzySearchContext works like FuzzySearch but abandons the walk once ctx
+// is done returning ctx.Err()
+func (t *MSTree) FuzzySearchContext(ctx context.Context, query string, prefix string, limit int) ([]ScoredMetric, error) {
+	if t.storage == STORAGE_MAPPED {
+		return nil, ErrNotSupported
+	}
+	queryTokens := splitFuzzyQuery(query)
+	if len(queryTokens) == 0 {
+		return make([]ScoredMetric, 0), nil
+	}
+	m := &fuzzyMatcher{queryTokens, make(map[string][]float64), limit, make(scoredHeap, 0)}
+	best := make([]float64, len(queryTokens))
+	n := t.Root
+	if prefix != "" {
+		for _, token := range strings.Split(prefix, ".") {
+			n.Lock()
+			child := n.lookup(token)
+			n.Unlock()
+			if child == nil {
+				return make([]ScoredMetric, 0), nil
+			}
+			m.cover(best, token)
+			n = child
+		}
+	}
+	if !m.walk(ctx, n, prefix, best) {
+		return nil, ctx.Err()
+	}
+	return m.sorted(), nil
+}
+
+// Grep returns all the metrics having fragment as a part of any of their
+// tokens, sorted. It's not supported in the mapped storage mode.
+func (t *MSTree) Grep(fragment string) ([]string, error) {
+	return t.GrepContext(context.Background(), fragment)
+}
+
+// GrepContext works like Grep but abandons the walk once ctx is done
+// returning ctx.Err()
+func (t *MSTree) GrepContext(ctx context.Context, fragment string) ([]string, error) {
+	if t.storage == STORAGE_MAPPED {
+		return nil, ErrNotSupported
+	}
+	if fragment == "" {
+		return make([]string, 0), nil
+	}
+	return t.tokens.grep(ctx, fragment)
+}
+
+func (t *MSTree) DistinctTokens() int {
+	_, tokens := t.delta()
+	return tokens.size()
+}
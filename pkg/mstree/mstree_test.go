@@ -0,0 +1,2581 @@
+package mstree
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	Data1 = "abook.qa-test1e_yandex_net.some.metric.total"
+	Data2 = "abook.qa-test2e_yandex_net.some.metric.total"
+	Data3 = "abook.qa-test1d_yandex_net.some.metric.total"
+	Data4 = "abook.qa-test2d_yandex_net.some.metric.total"
+
+	DataEmptyToken = "mail.mail_xivahub_var..xivahub.total.1xx"
+
+	LongData = "r9eueKkpYgeezGQsVE5ENyYBpL5XOSgpaskNpNoeVCYfUghzKi89jck8RIcZy3jjOTIQJAAxfpmvFG03Ye2rrTM9c5uup41PCikq8idBObXxBxW07qBtfBP5mxy5MkuhKxCsdnyH06xMn0IF2sILrD9cGu0hFCWs28VwCl4vMifwGd25HIOOgSS3nh8PSsCD34FCgRYcqDnvKVc4s6V0STbTwTIAOHTel3NF56rTETpqAW1Y2XZhP1sbV9VLKMjKq4dfb2Cm7ZZy4JmTGNHtMBEW0M89lQXUnqn4KuLiirENoUaLo33c7L2lh3qWbDXoZQDGIfk7k0cJIL77pP5IKbTCGUEpogSwiuRbwfzhR09F7gZ3x3tDGUliUqV3qWJjtUjw0Qi2w2ixUDSI3OSsacJ90AULlzU8zz8Mbca21odiVuIL2I0uiPxKUOhD3HNdsgdvKugODDCp5acQRNRmoUkp8HkruEVzBCixcyQYdaM7LgbHbJL3i7Jyp3jQ0j8ovhNFrbtoSl074HrPPASrPQPStRWvKbd48dPJwQIfXTydjUmcIwWeEFRXoulA65xGliI1ybqOLXesGOPsaMq5R3Fdn2lFnvmBN1RBZGg4UtABWpRzu.some.valid.tokens"
+
+	InvalidMetric = "'()&%<acx><ScRiPt >prompt(915633)<.if(some){.ops"
+
+	TestExact      = "abook.qa-test1e_yandex_net.some.metric.total"
+	TestStarEnd    = "abook.qa-test1e*"
+	TestStarBegin  = "abook.*net.some.metric.total"
+	TestStarMiddle = "abook.qa-test1*_yandex_net"
+	TestStarLonely = "abook.*.some.metric.total"
+
+	TestQuestionEnd     = "abook.qa-test1e_yandex_ne?.some.metric.total"
+	TestQuestionBegin   = "abook.?a-test1e_yandex_net.some.metric.total"
+	TestQuestionMiddle  = "abook.qa-test1?_yandex_net.some.metric.total"
+	TestQuestionFailure = "abook.qa-test?_yandex_net.some.metric.total"
+
+	TestHell    = "abook.q*test?e*.some.*.total"
+	TestBraces  = "abook.qa-test[12][ed]*.some.metric.total"
+	TestBraces2 = "abook.qa-test[12]e*.some.metric.total"
+)
+
+var (
+	tree *MSTree
+	err  error
+)
+
+func prepareTestTree(t testing.TB) {
+	if tree != nil {
+		return
+	}
+	dropTestTree()
+	tree, err = NewTree("/tmp/test_index", 1000, true)
+	if err != nil {
+		t.Error(err)
+	}
+	err = tree.LoadIndex()
+	if err != nil {
+		t.Error(err)
+	}
+	tree.Add(Data1)
+	tree.Add(Data2)
+	tree.Add(Data3)
+	tree.Add(Data4)
+}
+
+func dropTestTree() {
+	os.RemoveAll("/tmp/test_index")
+	tree = nil
+}
+
+func TestExactMatch(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestExact)
+	if len(results) != 1 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+	if results[0] != Data1 {
+		t.Errorf("Incorrect result:\n  Got %s\n  Expected %s", results[0], Data1)
+	}
+}
+
+func TestLongDataDrop(t *testing.T) {
+	prepareTestTree(t)
+	if tree.TotalMetrics != 4 {
+		t.Errorf("Incorrect metrics count on test start:\n  Got %d\n  Expected 4", tree.TotalMetrics)
+	}
+	tree.Add(LongData)
+	if tree.TotalMetrics != 4 {
+		t.Errorf("Incorrect metrics count on test end:\n  Got %d\n  Expected 4", tree.TotalMetrics)
+	}
+}
+
+func TestInvalidDataDrop(t *testing.T) {
+	prepareTestTree(t)
+	if tree.TotalMetrics != 4 {
+		t.Errorf("Incorrect metrics count on test start:\n  Got %d\n  Expected 4", tree.TotalMetrics)
+	}
+	tree.Add(InvalidMetric)
+	if tree.TotalMetrics != 4 {
+		t.Errorf("Incorrect metrics count on test end:\n  Got %d\n  Expected 4", tree.TotalMetrics)
+	}
+}
+
+func TestStarAtTheEnd(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestStarEnd)
+	mustMatch := "abook.qa-test1e_yandex_net."
+	if len(results) != 1 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+	if results[0] != mustMatch {
+		t.Errorf("Incorrect result:\n  Got %s\n  Expected %s", results[0], mustMatch)
+	}
+}
+
+func TestStarAtTheBegin(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestStarBegin)
+	if len(results) != 4 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+}
+
+func TestStarAtTheMiddle(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestStarMiddle)
+	if len(results) != 2 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+	for _, metric := range results {
+		if metric != "abook.qa-test1d_yandex_net." && metric != "abook.qa-test1e_yandex_net." {
+			t.Errorf("Unexpected metric %s", metric)
+		}
+	}
+}
+
+func TestStarLonelyMatch(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestStarLonely)
+	if len(results) != 4 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+}
+
+func TestQuestionAtTheEnd(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestQuestionEnd)
+	if len(results) != 1 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+	if results[0] != Data1 {
+		t.Errorf("Incorrect result:\n  Got %s\n  Expected %s", results[0], Data1)
+	}
+}
+
+func TestQuestionAtTheBegin(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestQuestionBegin)
+	if len(results) != 1 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+	if results[0] != Data1 {
+		t.Errorf("Incorrect result:\n  Got %s\n  Expected %s", results[0], Data1)
+	}
+}
+
+func TestQuestionAtTheMiddle(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestQuestionMiddle)
+	if len(results) != 2 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+	for _, metric := range results {
+		if metric != Data1 && metric != Data3 {
+			t.Errorf("Unexpected metric %s", metric)
+		}
+	}
+}
+
+func TestQuestionNullMatch(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestQuestionFailure)
+	if len(results) != 0 {
+		for _, metric := range results {
+			t.Errorf("Unexpected metric %s", metric)
+		}
+	}
+}
+
+func TestBracesPattern(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestBraces)
+	if len(results) != 4 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+}
+
+func TestBracesPattern2(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestBraces2)
+	if len(results) != 2 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+}
+
+func TestHellPattern(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Search(TestHell)
+	if len(results) != 2 {
+		t.Errorf("Incorrect results length: %d", len(results))
+	}
+	for _, metric := range results {
+		if metric != Data1 && metric != Data2 {
+			t.Errorf("Unexpected metric %s", metric)
+		}
+	}
+}
+
+func TestMetricCount(t *testing.T) {
+	prepareTestTree(t)
+	if tree.TotalMetrics != 4 {
+		t.Errorf("Invalid metrics count after prepare: 4 expected, but %d got", tree.TotalMetrics)
+	}
+	retries := 10
+	for retries > 0 && !tree.Synced() {
+		retries--
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !tree.Synced() {
+		t.Errorf("Error syncing tree, not synced after 10 retries 10ms each")
+	}
+
+	tree, err = NewTree("/tmp/test_index", 1000, true)
+	if err != nil {
+		t.Error(err)
+	}
+	tree.LoadIndex()
+	if tree.TotalMetrics != 4 {
+		t.Errorf("Invalid metrics count after loading index: 4 expected, but %d got", tree.TotalMetrics)
+	}
+}
+
+func TestEmptyToken(t *testing.T) {
+	prepareTestTree(t)
+	if tree.TotalMetrics != 4 {
+		t.Errorf("Invalid metrics count after prepare: 4 expected, but %d got", tree.TotalMetrics)
+	}
+	tree.Add(DataEmptyToken)
+	if tree.TotalMetrics != 4 {
+		t.Errorf("Empty token metric inserted into index!")
+	}
+}
+
+func TestSearchBatch(t *testing.T) {
+	prepareTestTree(t)
+	patterns := []string{TestExact, TestStarBegin, TestStarMiddle, TestHell, TestQuestionFailure, TestStarBegin}
+	results, err := tree.SearchBatch(context.Background(), patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(patterns) {
+		t.Fatalf("Incorrect batch length: %d", len(results))
+	}
+	for i, pattern := range patterns {
+		expected := tree.Search(pattern)
+		if len(results[i]) != len(expected) {
+			t.Errorf("Incorrect results length for %s:\n  Got %d\n  Expected %d", pattern, len(results[i]), len(expected))
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err = tree.SearchBatch(ctx, patterns)
+	if err != context.Canceled || results != nil {
+		t.Errorf("Cancelled batch returned %v, %v", results, err)
+	}
+}
+
+func TestSearchBatchConcurrentAdds(t *testing.T) {
+	prepareTestTree(t)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			tree.Add(fmt.Sprintf("batch.host%d.metric", i))
+		}
+	}()
+	patterns := []string{"batch.*.metric", "batch.*", TestStarBegin}
+	for adding := true; adding; {
+		select {
+		case <-done:
+			adding = false
+		default:
+		}
+		_, err := tree.SearchBatch(context.Background(), patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, _ := tree.SearchBatch(context.Background(), patterns)
+	if len(results[0]) != 2000 {
+		t.Errorf("2000 metrics added while searching expected, got %d", len(results[0]))
+	}
+}
+
+func TestCount(t *testing.T) {
+	prepareTestTree(t)
+	cases := []struct {
+		pattern  string
+		leaves   int64
+		branches int64
+	}{
+		{"abook.*", 0, 4},
+		{"abook.qa-test1*", 0, 2},
+		{TestStarLonely, 4, 0},
+		{"abook.*.some.metric.*", 4, 0},
+		{TestHell, 2, 0},
+		{"abook.nonexistent.*", 0, 0},
+	}
+	for _, c := range cases {
+		leaves, branches := tree.Count(c.pattern)
+		if leaves != c.leaves || branches != c.branches {
+			t.Errorf("Incorrect count for %s:\n  Got %d/%d\n  Expected %d/%d", c.pattern, leaves, branches, c.leaves, c.branches)
+		}
+	}
+}
+
+func TestComplete(t *testing.T) {
+	prepareTestTree(t)
+	results := tree.Complete("abook.qa-test1", 10)
+	if len(results) != 2 {
+		t.Fatalf("Incorrect results length: %d", len(results))
+	}
+	expected := []string{"abook.qa-test1d_yandex_net.", "abook.qa-test1e_yandex_net."}
+	for i, res := range results {
+		if res.Path != expected[i] {
+			t.Errorf("Incorrect result:\n  Got %s\n  Expected %s", res.Path, expected[i])
+		}
+		if res.Leaf || res.Size != 1 {
+			t.Errorf("Incorrect flags for %s: leaf=%v size=%d", res.Path, res.Leaf, res.Size)
+		}
+	}
+
+	results = tree.Complete("ab", 10)
+	if len(results) != 1 || results[0].Path != "abook." || results[0].Size != 4 {
+		t.Errorf("Incorrect first level completion: %v", results)
+	}
+
+	results = tree.Complete("abook.qa-test1e_yandex_net.some.metric.", 10)
+	if len(results) != 1 || results[0].Path != Data1 || !results[0].Leaf {
+		t.Errorf("Incorrect leaf completion: %v", results)
+	}
+
+	results = tree.Complete("abook.", 3)
+	if len(results) != 3 {
+		t.Errorf("Limit not respected: %d results", len(results))
+	}
+}
+
+func TestCompleteConcurrentDeletes(t *testing.T) {
+	prepareTestTree(t)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 5000; i++ {
+			metric := fmt.Sprintf("complete.host%d.cpu", i%10)
+			tree.Add(metric)
+			tree.Delete(metric)
+		}
+	}()
+	for adding := true; adding; {
+		select {
+		case <-done:
+			adding = false
+		default:
+		}
+		for _, c := range tree.Complete("complete.host", 0) {
+			if c.Leaf || c.Size != 1 {
+				t.Errorf("Incorrect completion of a metric being deleted: %+v", c)
+			}
+		}
+	}
+}
+
+func TestCancelledContext(t *testing.T) {
+	prepareTestTree(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := tree.CountContext(ctx, TestStarBegin); err != context.Canceled {
+		t.Errorf("context.Canceled expected from CountContext, got %v", err)
+	}
+	if _, err := tree.CompleteContext(ctx, "abook.qa", 10); err != context.Canceled {
+		t.Errorf("context.Canceled expected from CompleteContext, got %v", err)
+	}
+	if _, err := tree.GrepContext(ctx, "test"); err != context.Canceled {
+		t.Errorf("context.Canceled expected from GrepContext, got %v", err)
+	}
+	if _, err := tree.FuzzySearchContext(ctx, "metric", "", 10); err != context.Canceled {
+		t.Errorf("context.Canceled expected from FuzzySearchContext, got %v", err)
+	}
+	leaves, branches, err := tree.CountContext(context.Background(), "abook.*")
+	if err != nil || leaves != 0 || branches != 4 {
+		t.Errorf("Unexpected count %d/%d: %v", leaves, branches, err)
+	}
+}
+
+func TestFuzzySearch(t *testing.T) {
+	prepareTestTree(t)
+	results, _ := tree.FuzzySearch("qa-tset1e_yandex_net totl", "", 2)
+	if len(results) != 2 {
+		t.Fatalf("Incorrect results length: %d", len(results))
+	}
+	if results[0].Path != Data1 {
+		t.Errorf("Incorrect best result:\n  Got %s\n  Expected %s", results[0].Path, Data1)
+	}
+	if results[0].Score <= results[1].Score {
+		t.Errorf("Results are not ordered by score: %v", results)
+	}
+
+	results, _ = tree.FuzzySearch("metric", "abook.qa-test2d_yandex_net", 10)
+	if len(results) != 1 || results[0].Path != Data4 {
+		t.Errorf("Prefix restriction not respected: %v", results)
+	}
+
+	results, _ = tree.FuzzySearch("metric", "abook.nonexistent", 10)
+	if len(results) != 0 {
+		t.Errorf("Unexpected results for a missing prefix: %v", results)
+	}
+}
+
+func TestFuzzySearchConcurrentAdds(t *testing.T) {
+	prepareTestTree(t)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			tree.Add(fmt.Sprintf("fuzzy.host%d.cpu.user", i/2))
+			tree.Add(fmt.Sprintf("fuzzy.host%d.cpu.system", i/2))
+		}
+	}()
+	for adding := true; adding; {
+		select {
+		case <-done:
+			adding = false
+		default:
+		}
+		_, err := tree.FuzzySearch("host cpu", "fuzzy", 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, _ := tree.FuzzySearch("host cpu", "fuzzy", 0)
+	if len(results) != 2000 {
+		t.Errorf("2000 metrics added while searching expected, got %d", len(results))
+	}
+}
+
+func TestGrep(t *testing.T) {
+	prepareTestTree(t)
+	results, _ := tree.Grep("test1")
+	if len(results) != 2 {
+		t.Fatalf("Incorrect results length: %d", len(results))
+	}
+	if results[0] != Data3 || results[1] != Data1 {
+		t.Errorf("Incorrect results: %v", results)
+	}
+
+	results, _ = tree.Grep("ta")
+	if len(results) != 4 {
+		t.Errorf("Incorrect results length for a short fragment: %d", len(results))
+	}
+
+	results, _ = tree.Grep("nonexistent")
+	if len(results) != 0 {
+		t.Errorf("Unexpected results: %v", results)
+	}
+}
+
+func TestGrepSplitDelete(t *testing.T) {
+	gt, err := NewTree("/tmp/test_index_grep_split", 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll("/tmp/test_index_grep_split")
+	// every metric splits the suffix of the previous ones
+	metrics := []string{"a.b.c.d.e", "a.b.c.x.y", "a.b.z.w", "a.q", "r.b.c"}
+	for _, metric := range metrics {
+		gt.AddNoSync(metric)
+	}
+	found, _ := gt.Grep("c")
+	if strings.Join(found, " ") != "a.b.c.d.e a.b.c.x.y r.b.c" {
+		t.Errorf("Unexpected grep results after splits: %v", found)
+	}
+	for _, metric := range metrics {
+		if removed, _ := gt.Delete(metric); !removed {
+			t.Errorf("%s is not deleted", metric)
+		}
+	}
+	ngrams := 0
+	for i := range gt.tokens.shards {
+		ngrams += len(gt.tokens.shards[i].ngrams)
+	}
+	if gt.DistinctTokens() != 0 || ngrams != 0 {
+		t.Errorf("Token index is not emptied with the tree: %d tokens, %d n-grams left", gt.DistinctTokens(), ngrams)
+	}
+}
+
+func TestGrepConcurrentAdds(t *testing.T) {
+	prepareTestTree(t)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			// every metric splits the suffix of the previous one
+			tree.Add(fmt.Sprintf("grep.host%d.load.shortterm", i/2))
+			tree.Add(fmt.Sprintf("grep.host%d.load.longterm", i/2))
+		}
+	}()
+	for adding := true; adding; {
+		select {
+		case <-done:
+			adding = false
+		default:
+		}
+		_, err := tree.Grep("longt")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	results, _ := tree.Grep("load")
+	if len(results) != 2000 {
+		t.Errorf("2000 metrics added while grepping expected, got %d", len(results))
+	}
+	results, _ = tree.Grep("longt")
+	if len(results) != 1000 || results[0] != "grep.host0.load.longterm" {
+		t.Errorf("Only metrics below the matched token expected, got %d", len(results))
+	}
+}
+
+func TestDumpIndexGeneration(t *testing.T) {
+	dumpDir := "/tmp/test_index_dump"
+	os.RemoveAll(dumpDir)
+	defer os.RemoveAll(dumpDir)
+
+	// legacy flat layout with a stale temporary file left by a crash
+	os.MkdirAll(dumpDir, os.FileMode(0755))
+	ioutil.WriteFile(filepath.Join(dumpDir, "abook.idx"), []byte("legacy.metric\n"), os.FileMode(0644))
+	ioutil.WriteFile(filepath.Join(dumpDir, "abook.idx.tmp"), []byte("trunc"), os.FileMode(0644))
+
+	dt, err := NewTree(dumpDir, -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dumpDir, "abook.idx.tmp")); err != nil {
+		t.Errorf("Temporary file is removed before the index is loaded")
+	}
+	err = dt.LoadTxtReader(strings.NewReader(strings.Join([]string{Data1, Data2, Data3}, "\n")), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dumpDir, "abook.idx.tmp")); !os.IsNotExist(err) {
+		t.Errorf("Stale temporary file was not removed")
+	}
+	if _, err := os.Stat(filepath.Join(dumpDir, "abook.idx")); !os.IsNotExist(err) {
+		t.Errorf("Legacy index file was not removed after switching generation")
+	}
+
+	dt, err = NewTree(dumpDir, -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.LoadIndex()
+	if dt.TotalMetrics != 3 {
+		t.Errorf("Invalid metrics count after loading dumped index: 3 expected, but %d got", dt.TotalMetrics)
+	}
+	files, _ := ioutil.ReadDir(dumpDir)
+	if len(files) != 2 {
+		t.Errorf("Exactly one generation and a link expected, got %d files", len(files))
+	}
+
+	err = dt.DropIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt, err = NewTree(dumpDir, -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.LoadIndex()
+	if dt.TotalMetrics != 0 {
+		t.Errorf("Invalid metrics count after dropping index: 0 expected, but %d got", dt.TotalMetrics)
+	}
+}
+
+func TestDumpIndexLive(t *testing.T) {
+	liveDir := "/tmp/test_index_live"
+	os.RemoveAll(liveDir)
+	defer os.RemoveAll(liveDir)
+
+	lt, err := NewTree(liveDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt.LoadIndex()
+	err = lt.StartWAL(WAL_FSYNC_ALWAYS, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt.Add("live.before")
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			lt.Add(fmt.Sprintf("live.concurrent%d", i))
+		}
+	}()
+	err = lt.DumpIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	lt.Add("live.after")
+	err = lt.AddDurable("live.durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	segments, _ := walSegments(lt.genDir)
+	if len(segments) != 1 {
+		t.Errorf("WAL is not continued in the new generation: %v", segments)
+	}
+	lt.Close()
+
+	lt, err = NewTree(liveDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt.LoadIndex()
+	if found := len(lt.Search("live.*")); found != 203 {
+		t.Errorf("203 metrics expected after restart, got %d", found)
+	}
+	lt.Add("dropped.before")
+	err = lt.DropIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt.Add("dropped.after")
+	lt.Close()
+
+	lt, err = NewTree(liveDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt.LoadIndex()
+	if found := lt.Search("*.*"); len(found) != 1 || found[0] != "dropped.after" {
+		t.Errorf("Only dropped.after expected after dropping the index, got %v", found)
+	}
+	lt.Close()
+}
+
+func TestReplaceGeneration(t *testing.T) {
+	replaceDir := "/tmp/test_index_replace"
+	os.RemoveAll(replaceDir)
+	defer os.RemoveAll(replaceDir)
+
+	live, err := NewTree(replaceDir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.LoadIndex()
+	// a generation directory rather than the legacy flat layout
+	err = live.DropIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = live.StartWAL(WAL_FSYNC_ALWAYS, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	live.Add("live.before")
+	liveGen := live.genDir
+
+	next, err := NewTree(replaceDir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = next.AddTxt(strings.NewReader("next.a\nnext.b"), -1, new(int64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = next.PrepareGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = next.StartWAL(WAL_FSYNC_ALWAYS, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = live.AddDurable("live.during"); err != nil {
+		t.Fatal(err)
+	}
+	next.Add("live.during")
+	current, _ := currentGeneration(replaceDir)
+	if current != liveGen || next.genDir == liveGen {
+		t.Fatalf("Live generation is switched before Replace, current: %s", current)
+	}
+	if len(live.Search("live.*")) != 2 {
+		t.Errorf("Live tree is affected by the prepared one: %v", live.Search("*.*"))
+	}
+
+	err = next.Replace(live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Add("next.after")
+	next.Close()
+	current, _ = currentGeneration(replaceDir)
+	if current != next.genDir {
+		t.Errorf("Prepared generation is not current after Replace: %s", current)
+	}
+	if _, err := os.Stat(liveGen); !os.IsNotExist(err) {
+		t.Error("Replaced generation is not removed")
+	}
+
+	rt, err := NewTree(replaceDir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.LoadIndex()
+	found := rt.Search("*.*")
+	sort.Strings(found)
+	if strings.Join(found, ",") != "live.during,next.a,next.after,next.b" {
+		t.Errorf("Unexpected metrics after restart: %v", found)
+	}
+	rt.Close()
+
+	// a discarded tree leaves the current generation alone
+	next, _ = NewTree(replaceDir, 100, true)
+	next.AddTxt(strings.NewReader("discarded.metric"), -1, new(int64))
+	err = next.PrepareGeneration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Discard()
+	if _, err := os.Stat(next.genDir); !os.IsNotExist(err) {
+		t.Error("Discarded generation is not removed")
+	}
+	if current, _ = currentGeneration(replaceDir); current != rt.genDir {
+		t.Errorf("Current generation is changed by a discarded tree: %s", current)
+	}
+}
+
+func countRecords(data []byte) int {
+	count := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" && !strings.HasPrefix(line, IDX_HEADER) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestCompact(t *testing.T) {
+	compactDir := "/tmp/test_index_compact"
+	os.RemoveAll(compactDir)
+	defer os.RemoveAll(compactDir)
+
+	ct, err := NewTree(compactDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct.SetIndexFormat(INDEX_FORMAT_TEXT)
+	// the same metrics re-added after a restart are duplicated in the file
+	for i := 0; i < 3; i++ {
+		ct.Root = newNode()
+		ct.Add(Data1)
+		ct.Add(Data2)
+	}
+	waitSynced := func() {
+		retries := 10
+		for retries > 0 && !ct.Synced() {
+			retries--
+			time.Sleep(10 * time.Millisecond)
+		}
+		// the queue counter is decremented right before writing
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitSynced()
+	idxFile := filepath.Join(compactDir, "abook.idx")
+	data, _ := ioutil.ReadFile(idxFile)
+	if countRecords(data) != 6 {
+		t.Fatalf("Unexpected index file before compaction:\n%s", data)
+	}
+
+	err = ct.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(idxFile)
+	if countRecords(data) != 2 {
+		t.Errorf("Unexpected index file after compaction:\n%s", data)
+	}
+
+	ct.Add(Data3)
+	waitSynced()
+	data, _ = ioutil.ReadFile(idxFile)
+	if countRecords(data) != 3 {
+		t.Errorf("Metric added after compaction is not in the index file:\n%s", data)
+	}
+
+	// binary compaction moves everything to the snapshot
+	ct.SetIndexFormat(INDEX_FORMAT_BINARY)
+	err = ct.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(idxFile)
+	if countRecords(data) != 0 {
+		t.Errorf("Index file is not empty after binary compaction:\n%s", data)
+	}
+	ct.Add(Data4)
+	waitSynced()
+
+	ct, err = NewTree(compactDir, -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ct.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct.TotalMetrics != 4 {
+		t.Errorf("Invalid metrics count after loading compacted index: 4 expected, but %d got", ct.TotalMetrics)
+	}
+}
+
+func TestCompactDeletedToken(t *testing.T) {
+	compactDir := "/tmp/test_index_compact_deleted"
+	for _, kind := range []string{INDEX_STORE_FILES, INDEX_STORE_BOLT} {
+		os.RemoveAll(compactDir)
+		ct, err := NewTree(compactDir, 1000, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct.SetIndexStore(kind)
+		ct.LoadIndex()
+		ct.Add("gone.metric1")
+		ct.Add("gone.metric2")
+		ct.Add(Data1)
+		ct.writerBarrier().Wait()
+		err = ct.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, metric := range []string{"gone.metric1", "gone.metric2"} {
+			if removed, _ := ct.Delete(metric); !removed {
+				t.Fatalf("%s: %s is not deleted", kind, metric)
+			}
+		}
+		err = ct.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		tokens, _ := ct.store.Tokens()
+		if fmt.Sprint(tokens) != "[abook]" {
+			t.Errorf("%s: data of the deleted token is kept after compaction: %v", kind, tokens)
+		}
+		if kind == INDEX_STORE_FILES {
+			files, _ := filepath.Glob(filepath.Join(compactDir, "gone.*"))
+			if len(files) != 0 {
+				t.Errorf("Files of the deleted token are kept after compaction: %v", files)
+			}
+		}
+		// the token is stored again once it gets metrics back
+		ct.Add("gone.metric3")
+		ct.Close()
+
+		ct, err = NewTree(compactDir, 1000, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct.SetIndexStore(kind)
+		ct.LoadIndex()
+		if found := ct.Search("gone.*"); fmt.Sprint(found) != "[gone.metric3]" {
+			t.Errorf("%s: only the metric added after compaction expected, got %v", kind, found)
+		}
+		if len(ct.Search(Data1)) != 1 {
+			t.Errorf("%s: metric of the other token is lost", kind)
+		}
+		ct.Close()
+	}
+	os.RemoveAll(compactDir)
+}
+
+func TestCompactConcurrentAdds(t *testing.T) {
+	compactDir := "/tmp/test_index_compact_concurrent"
+	defer os.RemoveAll(compactDir)
+	cases := []struct {
+		kind   string
+		format string
+	}{
+		{INDEX_STORE_FILES, INDEX_FORMAT_TEXT},
+		{INDEX_STORE_FILES, INDEX_FORMAT_BINARY},
+		{INDEX_STORE_BOLT, INDEX_FORMAT_TEXT},
+	}
+	for _, c := range cases {
+		os.RemoveAll(compactDir)
+		ct, err := NewTree(compactDir, 1000, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct.SetIndexStore(c.kind)
+		ct.SetIndexFormat(c.format)
+		ct.LoadIndex()
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			for i := 0; i < 2000; i++ {
+				// every metric splits the suffix of the previous one
+				ct.Add(fmt.Sprintf("busy.host%d.cpu.user", i/2))
+				ct.Add(fmt.Sprintf("busy.host%d.cpu.system", i/2))
+			}
+		}()
+		for adding := true; adding; {
+			select {
+			case <-done:
+				adding = false
+			default:
+			}
+			err = ct.Compact()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		ct.writerBarrier().Wait()
+		err = ct.Compact()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct.Close()
+
+		ct, err = NewTree(compactDir, 1000, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ct.SetIndexStore(c.kind)
+		ct.SetIndexFormat(c.format)
+		ct.LoadIndex()
+		if found := ct.Search("busy.*.cpu.*"); len(found) != 2000 {
+			t.Errorf("%s/%s: 2000 metrics compacted while adding expected, got %d", c.kind, c.format, len(found))
+		}
+		ct.Close()
+	}
+}
+
+func TestSnapshotCorruption(t *testing.T) {
+	snapDir := "/tmp/test_index_snapshot"
+	os.RemoveAll(snapDir)
+	defer os.RemoveAll(snapDir)
+
+	st, err := NewTree(snapDir, -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.LoadTxtReader(strings.NewReader(strings.Join([]string{Data1, Data2, "other.metric"}, "\n")), -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genDir, _ := currentGeneration(snapDir)
+	snapshot := filepath.Join(genDir, "abook"+SNAPSHOT_SUFFIX)
+	data, _ := ioutil.ReadFile(snapshot)
+	data[len(data)/2] ^= 0xff
+	ioutil.WriteFile(snapshot, data, os.FileMode(0644))
+
+	st, err = NewTree(snapDir, -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = st.LoadIndex()
+	if err != nil {
+		t.Errorf("Corrupt snapshot is not expected to fail loading: %s", err.Error())
+	}
+	if st.TotalMetrics != 1 {
+		t.Errorf("Invalid metrics count after loading a corrupted index: 1 expected, but %d got", st.TotalMetrics)
+	}
+	corrupt := st.CorruptFiles()
+	if len(corrupt) != 1 || corrupt[0].File != snapshot {
+		t.Fatalf("Snapshot corruption not reported: %v", corrupt)
+	}
+	if _, err := os.Stat(corrupt[0].Quarantined); err != nil {
+		t.Errorf("Corrupt snapshot is not in quarantine: %s", err.Error())
+	}
+	if _, err := os.Stat(snapshot); !os.IsNotExist(err) {
+		t.Errorf("Corrupt snapshot is still in the index")
+	}
+}
+
+func TestIdxFileCorruption(t *testing.T) {
+	idxDir := "/tmp/test_index_records"
+	os.RemoveAll(idxDir)
+	defer os.RemoveAll(idxDir)
+
+	it, err := NewTree(idxDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.SetIndexFormat(INDEX_FORMAT_TEXT)
+	it.Add(Data1)
+	it.Add(Data2)
+	it.Add(Data3)
+	retries := 10
+	for retries > 0 && !it.Synced() {
+		retries--
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	// damage the second record and tear the last one
+	idxFile := filepath.Join(idxDir, "abook.idx")
+	data, _ := ioutil.ReadFile(idxFile)
+	lines := strings.Split(string(data), "\n")
+	lines[2] = strings.Replace(lines[2], "qa", "qb", 1)
+	lines[3] = lines[3][:len(lines[3])-3]
+	ioutil.WriteFile(idxFile, []byte(strings.Join(lines, "\n")), os.FileMode(0644))
+
+	it, err = NewTree(idxDir, -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.SetIndexFormat(INDEX_FORMAT_TEXT)
+	err = it.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.TotalMetrics != 1 {
+		t.Errorf("Damaged records loaded: 1 metric expected, but %d got", it.TotalMetrics)
+	}
+	if len(it.CorruptFiles()) != 1 {
+		t.Errorf("Index file corruption not reported: %v", it.CorruptFiles())
+	}
+
+	// the file is rewritten from memory so the next load is clean
+	it, err = NewTree(idxDir, -1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	it.LoadIndex()
+	if it.TotalMetrics != 1 || len(it.CorruptFiles()) != 0 {
+		t.Errorf("Index is not clean after rewrite: %d metrics, %v", it.TotalMetrics, it.CorruptFiles())
+	}
+
+	// a record torn right before its checksum is damaged in a file with
+	// the header and a legacy record in a file without one
+	for _, header := range []bool{true, false} {
+		data := Data1 + "\n"
+		if header {
+			data = fmt.Sprintf("%s %d\n", IDX_HEADER, IDX_VERSION) + data
+		}
+		ioutil.WriteFile(idxFile, []byte(data), os.FileMode(0644))
+		it, err = NewTree(idxDir, -1, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		it.LoadIndex()
+		if header && (it.TotalMetrics != 0 || len(it.CorruptFiles()) != 1) {
+			t.Errorf("Record without checksum loaded from a file with the header: %d metrics, %v", it.TotalMetrics, it.CorruptFiles())
+		}
+		if !header && (it.TotalMetrics != 1 || len(it.CorruptFiles()) != 0) {
+			t.Errorf("Legacy record is not loaded: %d metrics, %v", it.TotalMetrics, it.CorruptFiles())
+		}
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	walDir := "/tmp/test_index_wal"
+	os.RemoveAll(walDir)
+	defer os.RemoveAll(walDir)
+
+	wt, err := NewTree(walDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wt.AddDurable(Data1)
+	if err != ErrWALDisabled {
+		t.Errorf("ErrWALDisabled expected, got %v", err)
+	}
+	err = wt.StartWAL(WAL_FSYNC_NEVER, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = wt.AddDurable(Data2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.Add(Data3)
+	err = wt.AddDurable(Data3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// pretend index writers have lost everything in a crash
+	wt.Close()
+	os.Remove(filepath.Join(walDir, "abook.idx"))
+	wt, err = NewTree(walDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.LoadIndex()
+	if wt.TotalMetrics != 2 {
+		t.Errorf("Invalid metrics count after WAL replay: 2 expected, but %d got", wt.TotalMetrics)
+	}
+
+	err = wt.StartWAL(WAL_FSYNC_ALWAYS, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.Add(Data4)
+	wt.walCheckpoint()
+	segments, _ := walSegments(walDir)
+	if len(segments) != 1 {
+		t.Errorf("Old WAL segments are not removed on checkpoint: %v", segments)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(walDir, "abook.idx"))
+	if countRecords(data) != 3 {
+		t.Errorf("Replayed metrics are not synced to index on checkpoint:\n%s", data)
+	}
+
+	// waiting for a commit stuck behind another one is cut short by ctx
+	wt.wal.commitLock.Lock()
+	seq := wt.wal.Append("abook.stuck.metric")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err = wt.wal.WaitDurable(ctx, seq)
+	wt.wal.commitLock.Unlock()
+	if err != context.DeadlineExceeded {
+		t.Errorf("context.DeadlineExceeded expected, got %v", err)
+	}
+	err = wt.wal.WaitDurable(context.Background(), seq)
+	if err != nil {
+		t.Errorf("Record is not synced after the wait is cancelled: %v", err)
+	}
+	wt.Close()
+
+	// a torn record has no checksum, the segment is replayed up to it
+	os.RemoveAll(walDir)
+	wt, err = NewTree(walDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.StartWAL(WAL_FSYNC_ALWAYS, time.Hour)
+	err = wt.AddDurable("servers.web01.cpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.Close()
+	os.Remove(filepath.Join(walDir, "servers.idx"))
+	segments, _ = walSegments(walDir)
+	f, _ := os.OpenFile(segments[len(segments)-1], os.O_APPEND|os.O_WRONLY, 0644)
+	io.WriteString(f, "servers.web02.cp\n")
+	writeIdxRecord(f, "servers.web03.cpu")
+	f.Close()
+	wt, err = NewTree(walDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.LoadIndex()
+	if found := wt.Search("servers.*.*"); fmt.Sprint(found) != "[servers.web01.cpu]" {
+		t.Errorf("Records at and after the torn one are replayed: %v", found)
+	}
+	wt.Close()
+}
+
+func TestWriterPool(t *testing.T) {
+	poolDir := "/tmp/test_index_pool"
+	os.RemoveAll(poolDir)
+	defer os.RemoveAll(poolDir)
+
+	pt, err := NewTree(poolDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = pt.SetWriterPool(2, 1)
+	if err == nil {
+		t.Error("Max open files less than the number of writers accepted")
+	}
+	err = pt.SetWriterPool(2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		pt.Add(fmt.Sprintf("token%d.some.metric", i))
+		pt.Add(fmt.Sprintf("token%d.other.metric", i))
+	}
+	pt.writerBarrier().Wait()
+	if len(pt.writers) != 2 {
+		t.Errorf("2 index writers expected, %d started", len(pt.writers))
+	}
+	err = pt.SetWriterPool(4, 4)
+	if err == nil {
+		t.Error("Writer pool changed after writers started")
+	}
+	for _, iw := range pt.writers {
+		if files := iw.appender.(*filesAppender).files; len(files) > 1 {
+			t.Errorf("Index writer keeps %d files open, 1 allowed", len(files))
+		}
+	}
+	for i := 0; i < 10; i++ {
+		data, _ := ioutil.ReadFile(fmt.Sprintf("%s/token%d.idx", poolDir, i))
+		if countRecords(data) != 2 {
+			t.Errorf("2 records expected in token%d.idx:\n%s", i, data)
+		}
+	}
+	qsize, total := pt.SyncQueueSize()
+	if qsize != 0 || total != 2000 {
+		t.Errorf("Invalid sync queue size %d/%d, 0/2000 expected", qsize, total)
+	}
+
+	pt.Close()
+	for _, iw := range pt.writers {
+		if files := iw.appender.(*filesAppender).files; len(files) != 0 {
+			t.Errorf("Index writer keeps %d files open after Close", len(files))
+		}
+	}
+	// closing twice is harmless
+	pt.Close()
+}
+
+func TestSyncOverflow(t *testing.T) {
+	overflowDir := "/tmp/test_index_overflow"
+	os.RemoveAll(overflowDir)
+	defer os.RemoveAll(overflowDir)
+
+	ot, err := NewTree(overflowDir, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a writer which isn't running yet, its queue gets full immediately
+	iw := newIndexWriter(ot.store.Appender(1), 1, ot.log)
+	ot.writers = []*indexWriter{iw}
+
+	ot.SetSyncOverflow(SYNC_OVERFLOW_DROP, 0)
+	ot.Add(Data1)
+	ot.Add(Data2)
+	ot.SetSyncOverflow(SYNC_OVERFLOW_BLOCK, 10*time.Millisecond)
+	ot.Add(Data3)
+	ot.SetSyncOverflow(SYNC_OVERFLOW_SPILL, 0)
+	ot.Add(Data4)
+
+	stats := ot.QueueStats()
+	if len(stats) != 1 {
+		t.Fatalf("Queue stats of 1 writer expected, got %v", stats)
+	}
+	qs := stats[0]
+	if qs.Writer != 0 || qs.Queued != 1 || qs.Saturation != 1 || qs.Dropped != 2 || qs.Timeouts != 1 || qs.Spilled != 1 {
+		t.Errorf("Invalid queue stats %+v", qs)
+	}
+
+	go iw.run()
+	ot.drainOverflow()
+	files, _ := overflowFiles(overflowDir)
+	if len(files) != 0 {
+		t.Errorf("Overflow files are not removed after draining: %v", files)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(overflowDir, "abook.idx"))
+	if countRecords(data) != 2 {
+		t.Errorf("Queued and spilled metrics expected in index file:\n%s", data)
+	}
+
+	// metrics spilled before a restart are loaded with the index
+	ot.overflow.spill(overflowDir, "spilled.metric")
+	ot.overflow.rotate()
+	ot, err = NewTree(overflowDir, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot.LoadIndex()
+	if len(ot.Search("spilled.metric")) != 1 {
+		t.Error("Spilled metric is not loaded")
+	}
+
+	// records of overflow files must be checksummed as well
+	files, _ = overflowFiles(overflowDir)
+	f, _ := os.OpenFile(files[0], os.O_APPEND|os.O_WRONLY, 0644)
+	io.WriteString(f, "spilled.torn\n")
+	f.Close()
+	ot, err = NewTree(overflowDir, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot.LoadIndex()
+	if found := ot.Search("spilled.*"); fmt.Sprint(found) != "[spilled.metric]" {
+		t.Errorf("Torn overflow record is loaded: %v", found)
+	}
+}
+
+func TestDurableAddOverflow(t *testing.T) {
+	durableDir := "/tmp/test_index_durable"
+	os.RemoveAll(durableDir)
+	defer os.RemoveAll(durableDir)
+
+	dt, err := NewTree(durableDir, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dt.StartWAL(WAL_FSYNC_NEVER, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a writer which isn't running yet, its queue gets full immediately
+	iw := newIndexWriter(dt.store.Appender(1), 1, dt.log)
+	dt.writers = []*indexWriter{iw}
+	dt.SetSyncOverflow(SYNC_OVERFLOW_DROP, 0)
+	dt.Add(Data1)
+
+	added := make(chan error)
+	go func() {
+		added <- dt.AddDurable(Data2)
+	}()
+	select {
+	case err = <-added:
+		t.Fatalf("Durable add returned with the writer queue full: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	go iw.run()
+	err = <-added
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, qs := range dt.QueueStats() {
+		if qs.Dropped != 0 {
+			t.Errorf("Durable add is dropped: %+v", qs)
+		}
+	}
+
+	// the WAL segment is gone after the checkpoint, the index must have it
+	dt.walCheckpoint()
+	dt.Close()
+	dt, err = NewTree(durableDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dt.LoadIndex()
+	defer dt.Close()
+	if len(dt.Search(Data2)) != 1 {
+		t.Error("Durable metric is lost after the WAL checkpoint")
+	}
+}
+
+func TestCompression(t *testing.T) {
+	gzDir := "/tmp/test_index_gzip"
+	os.RemoveAll(gzDir)
+	defer os.RemoveAll(gzDir)
+
+	load := func() *MSTree {
+		lt, err := NewTree(gzDir, 1000, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lt.SetIndexCompression(COMPRESSION_GZIP)
+		err = lt.LoadIndex()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return lt
+	}
+
+	// a plain file keeps being appended uncompressed
+	os.MkdirAll(gzDir, os.FileMode(0755))
+	ioutil.WriteFile(filepath.Join(gzDir, "plain.idx"), []byte("#msidx 1\n"), 0644)
+	gt := load()
+	if gt.SetIndexCompression("zstd") == nil {
+		t.Error("Unsupported compression accepted")
+	}
+	gt.SetIndexFormat(INDEX_FORMAT_TEXT)
+	gt.Add(Data1)
+	gt.Add(Data2)
+	gt.Add("plain.metric")
+	gt.writerBarrier().Wait()
+	gt.Add(Data3)
+	gt.writerBarrier().Wait()
+	compressed, _ := isCompressed(filepath.Join(gzDir, "abook.idx"))
+	if !compressed {
+		t.Error("New index file is not compressed")
+	}
+	compressed, _ = isCompressed(filepath.Join(gzDir, "plain.idx"))
+	if compressed {
+		t.Error("Existing plain index file is appended compressed")
+	}
+
+	gt = load()
+	if gt.TotalMetrics != 4 {
+		t.Errorf("4 metrics expected loading compressed index files, got %d", gt.TotalMetrics)
+	}
+	gt.SetIndexFormat(INDEX_FORMAT_TEXT)
+	err := gt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, _ = isCompressed(gt.dumpFilename(gt.genDir, "plain"))
+	if !compressed {
+		t.Error("Index file is not compressed by compaction")
+	}
+
+	gt.SetIndexFormat(INDEX_FORMAT_BINARY)
+	err = gt.DumpIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, _ = isCompressed(gt.dumpFilename(gt.genDir, "abook"))
+	if !compressed {
+		t.Error("Snapshot is not compressed")
+	}
+	gt = load()
+	if gt.TotalMetrics != 4 || len(gt.CorruptFiles()) != 0 {
+		t.Errorf("4 metrics expected loading compressed snapshots, got %d, corrupt files: %v", gt.TotalMetrics, gt.CorruptFiles())
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	srcDir := "/tmp/test_index_backup_src"
+	dstDir := "/tmp/test_index_backup_dst"
+	os.RemoveAll(srcDir)
+	os.RemoveAll(dstDir)
+	defer os.RemoveAll(srcDir)
+	defer os.RemoveAll(dstDir)
+
+	src, err := NewTree(srcDir, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src.SetIndexCompression(COMPRESSION_GZIP)
+	for _, metric := range []string{Data1, Data2, Data3, "other.metric"} {
+		src.Add(metric)
+	}
+	buf := new(bytes.Buffer)
+	err = src.Snapshot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(srcDir)
+	if len(files) != 0 {
+		t.Errorf("Temporary snapshot file is left behind: %v", files)
+	}
+
+	dst, err := NewTree(dstDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dst.Restore(bytes.NewReader(buf.Bytes()[:buf.Len()/2]))
+	if err == nil {
+		t.Error("Truncated snapshot restored")
+	}
+	// archives cut at an entry boundary, even before the first entry, are
+	// well-formed tar files missing the end marker
+	for _, entries := range []int{0, 1} {
+		cut := new(bytes.Buffer)
+		tw := tar.NewWriter(cut)
+		tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+		for i := 0; i < entries; i++ {
+			hdr, _ := tr.Next()
+			tw.WriteHeader(hdr)
+			io.Copy(tw, tr)
+		}
+		tw.Close()
+		err = dst.Restore(cut)
+		if err == nil {
+			t.Errorf("Snapshot of %d entries without the end marker restored", entries)
+		}
+	}
+	err = dst.Restore(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dst.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dst.TotalMetrics != 4 || len(dst.Search("abook.*.some.metric.total")) != 3 {
+		t.Errorf("4 metrics expected after restore, got %d", dst.TotalMetrics)
+	}
+	err = dst.Restore(bytes.NewReader(buf.Bytes()))
+	if err == nil {
+		t.Error("Snapshot restored into a non-empty tree")
+	}
+}
+
+func TestImportWhisper(t *testing.T) {
+	whisperDir := "/tmp/test_whisper"
+	wspIndexDir := "/tmp/test_index_whisper"
+	os.RemoveAll(whisperDir)
+	os.RemoveAll(wspIndexDir)
+	defer os.RemoveAll(whisperDir)
+	defer os.RemoveAll(wspIndexDir)
+
+	files := []string{"a/b/c.wsp", "a/b/d.wsp", "a/e.wsp", "f/g.wsp", "a/b/notes.txt", "old/metric.wsp"}
+	for _, file := range files {
+		path := filepath.Join(whisperDir, file)
+		os.MkdirAll(filepath.Dir(path), os.FileMode(0755))
+		ioutil.WriteFile(path, []byte{}, os.FileMode(0644))
+	}
+	old := time.Now().Add(-48 * time.Hour)
+	os.Chtimes(filepath.Join(whisperDir, "old/metric.wsp"), old, old)
+
+	wt, err := NewTree(wspIndexDir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, err := wt.ImportWhisper(whisperDir, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("4 whisper files expected to be imported, got %d", count)
+	}
+	for _, metric := range []string{"a.b.c", "a.b.d", "a.e", "f.g"} {
+		if len(wt.Search(metric)) != 1 {
+			t.Errorf("Metric %s is not imported", metric)
+		}
+	}
+	if len(wt.Search("old.metric")) != 0 {
+		t.Error("Whisper file older than max age is imported")
+	}
+
+	wt.Close()
+
+	wt, _ = NewTree(wspIndexDir, 100, true)
+	wt.LoadIndex()
+	if wt.TotalMetrics != 4 {
+		t.Errorf("Imported metrics are not synced, %d loaded", wt.TotalMetrics)
+	}
+	wt.Close()
+}
+
+func TestImportWhisperLive(t *testing.T) {
+	whisperDir := "/tmp/test_whisper_live"
+	wspIndexDir := "/tmp/test_index_whisper_live"
+	os.RemoveAll(whisperDir)
+	os.RemoveAll(wspIndexDir)
+	defer os.RemoveAll(whisperDir)
+	defer os.RemoveAll(wspIndexDir)
+
+	for _, file := range []string{"x/imported1.wsp", "x/imported2.wsp", "y/imported.wsp"} {
+		path := filepath.Join(whisperDir, file)
+		os.MkdirAll(filepath.Dir(path), os.FileMode(0755))
+		ioutil.WriteFile(path, []byte{}, os.FileMode(0644))
+	}
+
+	wt, err := NewTree(wspIndexDir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.LoadIndex()
+	err = wt.StartWAL(WAL_FSYNC_ALWAYS, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	genDir := wt.genDir
+	wt.Add("x.before")
+	_, err = wt.ImportWhisper(whisperDir, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if wt.genDir != genDir {
+		t.Error("Index generation is switched by whisper import")
+	}
+	wt.Add("x.after")
+	err = wt.AddDurable("x.durable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.Close()
+
+	wt, err = NewTree(wspIndexDir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wt.LoadIndex()
+	if found := len(wt.Search("x.*")); found != 5 {
+		t.Errorf("5 metrics expected under x after restart, got %v", wt.Search("x.*"))
+	}
+	if len(wt.Search("y.imported")) != 1 {
+		t.Error("Imported metric y.imported is lost after restart")
+	}
+	wt.Close()
+}
+
+func TestDelete(t *testing.T) {
+	delIndexDir := "/tmp/test_index_delete"
+	os.RemoveAll(delIndexDir)
+	defer os.RemoveAll(delIndexDir)
+
+	dt, err := NewTree(delIndexDir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, metric := range []string{"a.b.c", "a.b.d", "a.e", "f.g"} {
+		dt.Add(metric)
+	}
+	deleted := func(metric string) bool {
+		removed, err := dt.Delete(metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return removed
+	}
+	if deleted("a.b") {
+		t.Error("Branch a.b must not be deleted as a metric")
+	}
+	if deleted("a.x") {
+		t.Error("Missing metric a.x reported deleted")
+	}
+	if !deleted("a.b.c") || !deleted("a.b.d") {
+		t.Fatal("Metrics a.b.c and a.b.d are not deleted")
+	}
+	if dt.TotalMetrics != 2 {
+		t.Errorf("2 metrics expected after delete, got %d", dt.TotalMetrics)
+	}
+	if len(dt.Search("a.*")) != 1 {
+		t.Errorf("Empty branch a.b is not pruned: %v", dt.Search("a.*"))
+	}
+	leaves, branches := dt.Count("a.*")
+	if leaves != 1 || branches != 0 {
+		t.Errorf("1 leaf and no branches expected under a, got %d and %d", leaves, branches)
+	}
+	if dt.Root.child("a").Count() != 1 {
+		t.Errorf("Count of a is not updated, got %d", dt.Root.child("a").Count())
+	}
+	if grepped, _ := dt.Grep("b"); len(grepped) != 0 {
+		t.Errorf("Deleted tokens are found by grep: %v", grepped)
+	}
+	if !deleted("f.g") || len(dt.Search("*")) != 1 {
+		t.Errorf("Empty first level token f is not pruned: %v", dt.Search("*"))
+	}
+
+	// what's queued before deletion must not get to compacted files
+	dt.writerBarrier().Wait()
+	for _, token := range []string{"a", "f"} {
+		err = dt.compactToken(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	dt.Close()
+	dt, _ = NewTree(delIndexDir, 100, true)
+	dt.LoadIndex()
+	if dt.TotalMetrics != 1 || len(dt.Search("a.e")) != 1 {
+		t.Errorf("Only a.e expected after compaction, %d metrics loaded", dt.TotalMetrics)
+	}
+	dt.Close()
+}
+
+func TestWatchWhisper(t *testing.T) {
+	whisperDir := "/tmp/test_whisper_watch"
+	watchIndexDir := "/tmp/test_index_whisper_watch"
+	os.RemoveAll(whisperDir)
+	os.RemoveAll(watchIndexDir)
+	defer os.RemoveAll(whisperDir)
+	defer os.RemoveAll(watchIndexDir)
+
+	var wt *MSTree
+	create := func(file string) {
+		path := filepath.Join(whisperDir, file)
+		os.MkdirAll(filepath.Dir(path), os.FileMode(0755))
+		ioutil.WriteFile(path, []byte{}, os.FileMode(0644))
+	}
+	waitFor := func(metric string, present bool) bool {
+		for i := 0; i < 100; i++ {
+			// the watcher inserts concurrently
+			wt.freezeLock.Lock()
+			found := len(wt.Search(metric)) == 1
+			wt.freezeLock.Unlock()
+			if found == present {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+	create("a/b.wsp")
+
+	var err error
+	wt, err = NewTree(watchIndexDir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wt.Close()
+	wt.Add("manual.metric")
+	err = wt.WatchWhisper(whisperDir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wt.Search("a.b")) != 1 {
+		t.Error("Metric a.b is not added by the initial scan")
+	}
+
+	if runtime.GOOS == "linux" {
+		create("a/c.wsp")
+		if !waitFor("a.c", true) {
+			t.Error("Created whisper file a/c.wsp is not added")
+		}
+		create("d/e/f.wsp")
+		if !waitFor("d.e.f", true) {
+			t.Error("Whisper file in a new directory is not added")
+		}
+		os.Remove(filepath.Join(whisperDir, "a/c.wsp"))
+		if !waitFor("a.c", false) {
+			t.Error("Metric of removed whisper file a/c.wsp is not deleted")
+		}
+		os.RemoveAll(filepath.Join(whisperDir, "d"))
+		if !waitFor("d.e.f", false) {
+			t.Error("Metrics of removed directory d are not deleted")
+		}
+	}
+
+	// rescans catch whatever is missed
+	w := &whisperWatcher{wt, whisperDir, pollNotifier{}, make(map[string]bool), make(map[string]bool)}
+	create("g/h.wsp")
+	err = w.rescan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(wt.Search("g.h")) != 1 {
+		t.Error("Metric g.h is not added by rescan")
+	}
+	os.Remove(filepath.Join(whisperDir, "g/h.wsp"))
+	w.rescan()
+	if len(wt.Search("g.h")) != 0 {
+		t.Error("Metric g.h is not deleted by rescan")
+	}
+	if len(wt.Search("manual.metric")) != 1 {
+		t.Error("Metric not seen as a whisper file is deleted")
+	}
+}
+
+// checkTreeShape compares the tree with the set of its leaves
+func checkTreeShape(t *testing.T, nt *MSTree, leaves map[string]bool) {
+	buf := new(bytes.Buffer)
+	nt.Root.TraverseDump("", buf)
+	dumped := strings.Fields(buf.String())
+	if len(dumped) != len(leaves) {
+		t.Errorf("%d leaves expected, %d dumped", len(leaves), len(dumped))
+	}
+	for _, metric := range dumped {
+		if !leaves[metric] {
+			t.Errorf("Unexpected leaf %s", metric)
+		}
+	}
+
+	// children of every branch as they must be found by Search
+	children := make(map[string]map[string]bool)
+	for metric := range leaves {
+		tokens := strings.Split(metric, ".")
+		for i := range tokens {
+			prefix := strings.Join(tokens[:i], ".")
+			child := strings.Join(tokens[:i+1], ".")
+			if i < len(tokens)-1 {
+				child += "."
+			}
+			if children[prefix] == nil {
+				children[prefix] = make(map[string]bool)
+			}
+			children[prefix][child] = true
+		}
+	}
+	for prefix, expected := range children {
+		pattern := "*"
+		if prefix != "" {
+			pattern = prefix + ".*"
+		}
+		found := nt.Search(pattern)
+		var leafCount, branchCount int64
+		for path := range expected {
+			if strings.HasSuffix(path, ".") {
+				branchCount++
+			} else {
+				leafCount++
+			}
+		}
+		if len(found) != len(expected) {
+			t.Errorf("%s: %d results expected, got %v", pattern, len(expected), found)
+		}
+		for _, path := range found {
+			if !expected[path] {
+				t.Errorf("%s: unexpected result %s", pattern, path)
+			}
+		}
+		l, b := nt.Count(pattern)
+		if l != leafCount || b != branchCount {
+			t.Errorf("%s: %d leaves and %d branches expected, counted %d and %d", pattern, leafCount, branchCount, l, b)
+		}
+		for path := range expected {
+			token := strings.TrimSuffix(path[len(prefix):], ".")
+			token = strings.TrimPrefix(token, ".")
+			if len(nt.Search(strings.TrimSuffix(path, "."))) != 1 {
+				t.Errorf("%s is not found", path)
+			}
+			grepped := make(map[string]bool)
+			matches, _ := nt.Grep(token)
+			for _, metric := range matches {
+				grepped[metric] = true
+			}
+			for metric := range leaves {
+				if strings.HasPrefix(metric, path) || metric == path {
+					if !grepped[metric] {
+						t.Errorf("%s is not found by grep %s", metric, token)
+					}
+				}
+			}
+		}
+	}
+}
+
+// countNodes returns the number of nodes actually allocated
+func countNodes(n *node) int {
+	count := 1
+	if n.suffix == nil {
+		n.forEach(func(_ string, child *node) {
+			count += countNodes(child)
+		})
+	}
+	return count
+}
+
+func TestCompressedNodes(t *testing.T) {
+	nodesIndexDir := "/tmp/test_index_nodes"
+	os.RemoveAll(nodesIndexDir)
+	defer os.RemoveAll(nodesIndexDir)
+	defer os.RemoveAll(nodesIndexDir + "_fresh")
+
+	nt, err := NewTree(nodesIndexDir, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rnd := rand.New(rand.NewSource(1))
+	tokens := []string{"a", "b", "c", "cpu", "total", "x1", "x2"}
+	leaves := make(map[string]bool)
+	for i := 0; i < 3000; i++ {
+		if rnd.Intn(4) == 0 && len(leaves) > 0 {
+			for metric := range leaves {
+				if removed, _ := nt.Delete(metric); !removed {
+					t.Errorf("Metric %s is not deleted", metric)
+				}
+				delete(leaves, metric)
+				break
+			}
+			continue
+		}
+		parts := make([]string, 2+rnd.Intn(5))
+		for j := range parts {
+			parts[j] = tokens[rnd.Intn(len(tokens))]
+		}
+		metric := strings.Join(parts, ".")
+		nt.AddNoSync(metric)
+		// a branch stays a branch, a leaf extended becomes a branch
+		branch := false
+		for leaf := range leaves {
+			if strings.HasPrefix(leaf, metric+".") {
+				branch = true
+			}
+			if strings.HasPrefix(metric, leaf+".") {
+				delete(leaves, leaf)
+			}
+		}
+		if !branch {
+			leaves[metric] = true
+		}
+	}
+	checkTreeShape(t, nt, leaves)
+
+	// snapshots are loaded into the same compressed shape
+	err = nt.DumpIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	lt, _ := NewTree(nodesIndexDir, 0, true)
+	err = lt.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkTreeShape(t, lt, leaves)
+	ft, _ := NewTree(nodesIndexDir+"_fresh", 0, true)
+	for metric := range leaves {
+		ft.AddNoSync(metric)
+	}
+	if countNodes(lt.Root) != countNodes(ft.Root) {
+		t.Errorf("Loaded tree has %d nodes, %d expected", countNodes(lt.Root), countNodes(ft.Root))
+	}
+	for _, metric := range []string{"a.b.c.new.metric", "a.b.c.new.other"} {
+		lt.AddNoSync(metric)
+		for leaf := range leaves {
+			if strings.HasPrefix(metric, leaf+".") {
+				delete(leaves, leaf)
+			}
+		}
+		leaves[metric] = true
+	}
+	checkTreeShape(t, lt, leaves)
+}
+
+func TestSearchFunc(t *testing.T) {
+	prepareTestTree(t)
+	patterns := []string{"*", "abook.*", TestBraces, TestBraces2, "abook.qa-test1?_yandex_net.*.metric.total", "abook.*.*.*.*", "nothing.*"}
+	for _, pattern := range patterns {
+		// the level by level search SearchFunc replaces
+		nodesToSearch := map[string]*node{"": tree.Root}
+		for _, token := range strings.Split(pattern, ".") {
+			nodesToSearch = searchStep(context.Background(), nodesToSearch, token)
+		}
+		expected := searchResults(nodesToSearch)
+		sort.Strings(expected)
+		found := make([]string, 0)
+		tree.SearchFunc(context.Background(), pattern, func(path string, leaf bool) bool {
+			if leaf != nodesToSearch[path].isLeaf() {
+				t.Errorf("%s: invalid leaf flag of %s", pattern, path)
+			}
+			if !leaf {
+				path += "."
+			}
+			found = append(found, path)
+			return true
+		})
+		sort.Strings(found)
+		if strings.Join(found, " ") != strings.Join(expected, " ") {
+			t.Errorf("%s: %v expected, got %v", pattern, expected, found)
+		}
+	}
+
+	calls := 0
+	tree.SearchFunc(context.Background(), "abook.*.some.metric.total", func(path string, leaf bool) bool {
+		calls++
+		return false
+	})
+	if calls != 1 {
+		t.Errorf("Search is not stopped by fn, %d calls", calls)
+	}
+}
+
+func TestSearchCancel(t *testing.T) {
+	prepareTestTree(t)
+	pattern := "abook.*.*.*.*"
+	total := len(tree.Search(pattern))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := tree.SearchFunc(ctx, pattern, func(path string, leaf bool) bool {
+		calls++
+		cancel()
+		return true
+	})
+	if err != context.Canceled {
+		t.Errorf("context.Canceled expected, got %v", err)
+	}
+	if calls >= total {
+		t.Errorf("Search is not abandoned after cancel, %d of %d calls", calls, total)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	results, err := tree.SearchContext(ctx, pattern)
+	if err != context.DeadlineExceeded || results != nil {
+		t.Errorf("context.DeadlineExceeded expected, got %v and %d results", err, len(results))
+	}
+
+	big := newNode()
+	idx := newTokenIndex()
+	for i := 0; i < 5000; i++ {
+		inserted := false
+		big.insert([]string{fmt.Sprintf("host%d", i)}, &inserted, idx)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	for _, pattern := range []string{"*", "host*", "*1?"} {
+		if found := len(big.matches(ctx, pattern)); found >= SEARCH_CHECK_EVERY {
+			t.Errorf("%s: matching is not stopped after cancel, %d matches", pattern, found)
+		}
+	}
+}
+
+func TestHighFanOutSearch(t *testing.T) {
+	idx := newTokenIndex()
+	big := newNode()
+	rnd := rand.New(rand.NewSource(1))
+	hex := "0123456789abcdef"
+	for i := 0; i < 5000; i++ {
+		id := make([]byte, 2+rnd.Intn(6))
+		for j := range id {
+			id[j] = hex[rnd.Intn(len(hex))]
+		}
+		inserted := false
+		big.insert([]string{string(id), "total"}, &inserted, idx)
+	}
+	if big.big == nil {
+		t.Fatal("Node with 5000 children has no child map")
+	}
+	// the same children scanned one by one
+	plain := newNode()
+	big.forEach(func(_ string, child *node) {
+		plain.small = append(plain.small, child)
+	})
+	sort.Slice(plain.small, func(i, j int) bool { return plain.small[i].token < plain.small[j].token })
+
+	patterns := []string{"ab*", "*ff", "a*f", "ab?", "?bc", "a?c?", "[a-c]1*", "a[0-9][a-f]*", "*[ef]0", "[^a]b*", "[0-2][3-5]?", "*1*", "ab*?", "a[]b*", "f[0f]*e"}
+	for _, pattern := range patterns {
+		expected := plain.search(pattern)
+		found := big.search(pattern)
+		if len(found) != len(expected) {
+			t.Errorf("%s: %d matches expected, got %d", pattern, len(expected), len(found))
+			continue
+		}
+		for k := range expected {
+			if found[k] == nil {
+				t.Errorf("%s: %s is not found", pattern, k)
+			}
+		}
+	}
+
+	// tokens added after the reversed index is built are found as well
+	inserted := false
+	big.insert([]string{"zzzff", "total"}, &inserted, idx)
+	if big.search("*zff")["zzzff"] == nil {
+		t.Error("Token added after the first suffix lookup is not found")
+	}
+	removed := false
+	big.remove([]string{"zzzff", "total"}, &removed, idx)
+	if !removed || len(big.search("*zff")) != 0 || len(big.search("zzz*")) != 0 {
+		t.Error("Removed token is still found")
+	}
+}
+
+func sortedSearch(nt *MSTree, pattern string) []string {
+	results := nt.Search(pattern)
+	sort.Strings(results)
+	return results
+}
+
+func TestMappedStorage(t *testing.T) {
+	mapDir := "/tmp/test_index_mapped"
+	os.RemoveAll(mapDir)
+	defer os.RemoveAll(mapDir)
+
+	rnd := rand.New(rand.NewSource(1))
+	metrics := make([]string, 0)
+	for i := 0; i < 3000; i++ {
+		metrics = append(metrics, fmt.Sprintf("app%d.host%02d.cpu%d.%s", rnd.Intn(5), rnd.Intn(40), rnd.Intn(8), []string{"user", "system", "idle"}[rnd.Intn(3)]))
+	}
+	// leaves of the trie becoming branches in the delta and vice versa
+	metrics = append(metrics, "app0.host00", "app1.host01.cpu1", "single")
+	ref, _ := NewTree(mapDir+"_ref", 0, true)
+	defer os.RemoveAll(mapDir + "_ref")
+
+	mt, err := NewTree(mapDir, 100, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mt.SetStorage(STORAGE_MAPPED)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt.LoadIndex()
+	half := len(metrics) / 2
+	for _, metric := range metrics[:half] {
+		mt.Add(metric)
+		ref.Add(metric)
+	}
+	err = mt.Merge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt.mapped == nil || !mt.Root.isLeaf() {
+		t.Fatal("Delta is not merged into the trie")
+	}
+	for _, metric := range append(metrics[half:], "app1.host01", "app0.host00.cpu0.user", metrics[0]) {
+		mt.Add(metric)
+		ref.Add(metric)
+	}
+
+	patterns := []string{"*", "app0", "app0.*", "app1.host01.*", "app1.host01.cpu1.*", "app?.host0[0-3].cpu*.idle", "app*.*.cpu[2-4].sys*", "*.host1?.*.u*", "app2.host[^0]*", "app3.host17.cpu5.user", "nope.*", "app0.host00"}
+	check := func(stage string) {
+		for _, pattern := range patterns {
+			expected := sortedSearch(ref, pattern)
+			found := sortedSearch(mt, pattern)
+			if strings.Join(found, " ") != strings.Join(expected, " ") {
+				t.Errorf("%s: %s\n  Got %v\n  Expected %v", stage, pattern, found, expected)
+			}
+			rl, rb := ref.Count(pattern)
+			l, b := mt.Count(pattern)
+			if l != rl || b != rb {
+				t.Errorf("%s: count of %s is %d/%d, expected %d/%d", stage, pattern, l, b, rl, rb)
+			}
+		}
+		for _, prefix := range []string{"app", "app1.host0", "app1.host01.cpu", "app0.host00.cpu0.", "x"} {
+			expected := ref.Complete(prefix, 5)
+			found := mt.Complete(prefix, 5)
+			if fmt.Sprint(found) != fmt.Sprint(expected) {
+				t.Errorf("%s: completion of %s\n  Got %v\n  Expected %v", stage, prefix, found, expected)
+			}
+		}
+		batch, err := mt.SearchBatch(context.Background(), patterns)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, pattern := range patterns {
+			if len(batch[i]) != len(ref.Search(pattern)) {
+				t.Errorf("%s: batch search of %s returned %d results", stage, pattern, len(batch[i]))
+			}
+		}
+		if mt.TotalMetrics != ref.TotalMetrics {
+			t.Errorf("%s: %d metrics expected, got %d", stage, ref.TotalMetrics, mt.TotalMetrics)
+		}
+	}
+	// the trie is a leaf where the delta has a branch: TotalMetrics counts
+	// both until they're merged
+	check("trie and delta")
+	mt.Merge()
+	check("merged")
+
+	// a search streaming results keeps its trie mapped through a merge
+	mt.Add("streamed.metric")
+	ref.Add("streamed.metric")
+	streamed := 0
+	err = mt.SearchFunc(context.Background(), "*.*.*.*", func(path string, leaf bool) bool {
+		if streamed == 0 {
+			mt.Merge()
+		}
+		streamed++
+		return true
+	})
+	if err != nil || streamed != len(ref.Search("*.*.*.*")) {
+		t.Errorf("%d results expected from a search merged meanwhile, got %d: %v", len(ref.Search("*.*.*.*")), streamed, err)
+	}
+	streamed = 0
+	mt.SearchFunc(context.Background(), "*", func(path string, leaf bool) bool {
+		streamed++
+		return false
+	})
+	if streamed != 1 {
+		t.Errorf("Search is not stopped by fn, %d results passed", streamed)
+	}
+	check("merged while searching")
+	if _, err := mt.Grep("host"); err != ErrNotSupported {
+		t.Errorf("Grep is not rejected in the mapped mode: %v", err)
+	}
+	if _, err := mt.FuzzySearch("host", "", 10); err != ErrNotSupported {
+		t.Errorf("Fuzzy search is not rejected in the mapped mode: %v", err)
+	}
+	if _, err := mt.Delete(metrics[0]); err != ErrNotSupported {
+		t.Errorf("Delete is not rejected in the mapped mode: %v", err)
+	}
+	dump := new(bytes.Buffer)
+	mt.Dump(dump)
+	if strings.Count(dump.String(), "\n") != int(ref.TotalMetrics) {
+		t.Errorf("%d metrics expected in dump, got %d", ref.TotalMetrics, strings.Count(dump.String(), "\n"))
+	}
+
+	// the trie is mapped on startup, index files only hold the delta
+	mt.Add("late.metric")
+	ref.Add("late.metric")
+	mt.Close()
+	mt, _ = NewTree(mapDir, 100, true)
+	mt.SetStorage(STORAGE_MAPPED)
+	err = mt.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mt.mapped == nil || mt.Root.Count() != 1 {
+		t.Errorf("Only late.metric expected in the delta, got %d", mt.Root.Count())
+	}
+	check("reloaded")
+
+	buf := new(bytes.Buffer)
+	err = mt.Snapshot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt.Close()
+
+	// the memory mode loads a trie written by the mapped one
+	os.RemoveAll(mapDir)
+	mt, _ = NewTree(mapDir, 100, true)
+	err = mt.Restore(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt.LoadIndex()
+	check("restored in memory")
+	mt.Close()
+}
+
+func TestMappedTrieDamage(t *testing.T) {
+	trieFile := "/tmp/test_damaged.trie"
+	defer os.Remove(trieFile)
+	delta := newNode()
+	idx := newTokenIndex()
+	for i := 0; i < 200; i++ {
+		inserted := false
+		delta.insert(strings.Split(fmt.Sprintf("a%d.b%d.c%d", i%7, i%13, i), "."), &inserted, idx)
+	}
+	leaves, err := writeTrie(trieFile, nil, []*node{delta})
+	if err != nil || leaves != 200 {
+		t.Fatalf("200 leaves expected, got %d: %v", leaves, err)
+	}
+	data, _ := ioutil.ReadFile(trieFile)
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		damaged := append([]byte(nil), data...)
+		for j := 0; j < 1+rnd.Intn(8); j++ {
+			damaged[TRIE_HEADER_SIZE+rnd.Intn(len(damaged)-TRIE_HEADER_SIZE)] = byte(rnd.Intn(256))
+		}
+		if i%10 == 0 {
+			damaged = damaged[:rnd.Intn(len(damaged))]
+		}
+		ioutil.WriteFile(trieFile, damaged, 0644)
+		m, err := openMappedTrie(trieFile)
+		if err != nil {
+			continue
+		}
+		// must not panic or loop
+		mergedSearch(context.Background(), &mergedNode{m: m, off: m.root, inTrie: true}, "", strings.Split("a*.*.c1*", "."), func(string, bool) bool { return true })
+		m.complete(context.Background(), "a1.b", 10)
+		m.walk(m.root, "", func(string) bool { return true })
+		m.close()
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	boltDir := "/tmp/test_index_bolt"
+	os.RemoveAll(boltDir)
+	defer os.RemoveAll(boltDir)
+
+	ft, err := NewTree(boltDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft.Add(Data1)
+	ft.Add(Data2)
+	ft.Close()
+
+	// an index kept in files is converted on load
+	bt, err := NewTree(boltDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.SetIndexStore("bogus") == nil {
+		t.Error("Unknown index store accepted")
+	}
+	err = bt.SetIndexStore(INDEX_STORE_BOLT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bt.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bt.TotalMetrics != 2 {
+		t.Errorf("2 metrics expected after conversion, got %d", bt.TotalMetrics)
+	}
+	if _, err := os.Stat(filepath.Join(bt.genDir, "abook.idx")); !os.IsNotExist(err) {
+		t.Error("Index files are not removed after conversion")
+	}
+	if _, err := os.Stat(filepath.Join(bt.genDir, BOLT_FILE)); err != nil {
+		t.Errorf("Bolt database is not written: %v", err)
+	}
+
+	bt.Add(Data3)
+	bt.Add("other.metric")
+	bt.Delete(Data1)
+	err = bt.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt.Close()
+
+	check := func(nt *MSTree) {
+		expected := []string{Data2, Data3}
+		sort.Strings(expected)
+		results := sortedSearch(nt, "abook.*.some.metric.total")
+		if strings.Join(results, " ") != strings.Join(expected, " ") {
+			t.Errorf("%v expected, got %v", expected, results)
+		}
+		results = sortedSearch(nt, "other.*")
+		if strings.Join(results, " ") != "other.metric" {
+			t.Errorf("other.metric expected, got %v", results)
+		}
+	}
+	bt, err = NewTree(boltDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt.SetIndexStore(INDEX_STORE_BOLT)
+	err = bt.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(bt)
+	err = bt.DumpIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bt.Close()
+
+	// and back to files
+	ft, err = NewTree(boltDir, 1000, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ft.LoadIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ft.Close()
+	if ft.TotalMetrics != 3 {
+		t.Errorf("3 metrics expected after conversion, got %d", ft.TotalMetrics)
+	}
+	check(ft)
+	if _, err := os.Stat(filepath.Join(ft.genDir, BOLT_FILE)); !os.IsNotExist(err) {
+		t.Error("Bolt database is not removed after conversion")
+	}
+	if _, err := os.Stat(filepath.Join(ft.genDir, "abook"+SNAPSHOT_SUFFIX)); err != nil {
+		t.Errorf("Index files are not written: %v", err)
+	}
+}
+
+type recordingLogger struct {
+	lock     sync.Mutex
+	messages []string
+}
+
+func (rl *recordingLogger) record(format string, args ...interface{}) {
+	rl.lock.Lock()
+	rl.messages = append(rl.messages, fmt.Sprintf(format, args...))
+	rl.lock.Unlock()
+}
+
+func (rl *recordingLogger) Debugf(format string, args ...interface{})  { rl.record(format, args...) }
+func (rl *recordingLogger) Infof(format string, args ...interface{})   { rl.record(format, args...) }
+func (rl *recordingLogger) Noticef(format string, args ...interface{}) { rl.record(format, args...) }
+func (rl *recordingLogger) Errorf(format string, args ...interface{})  { rl.record(format, args...) }
+
+func TestIndexAPI(t *testing.T) {
+	apiDir := "/tmp/test_index_api"
+	os.RemoveAll(apiDir)
+	defer os.RemoveAll(apiDir)
+	rl := new(recordingLogger)
+	pl := new(recordingLogger)
+	defer SetLogger(logging.MustGetLogger("metricsearch"))
+	ctx := context.Background()
+
+	_, err := Open(apiDir, WithIndexStore("bogus"))
+	if err == nil {
+		t.Error("Unknown index store accepted")
+	}
+	SetLogger(pl)
+	ix, err := Open(apiDir, WithSyncBuffer(10), WithLogger(rl), WithCompaction(0, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ix.Add(ctx, "abook..metric")
+	if _, ok := err.(*InvalidMetricError); !ok {
+		t.Errorf("InvalidMetricError expected, got %v", err)
+	}
+	for _, metric := range []string{Data1, Data2, Data3, Data4, "other.metric"} {
+		err = ix.Add(ctx, metric)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ix.Len() != 5 {
+		t.Errorf("5 metrics expected, got %d", ix.Len())
+	}
+	results, err := ix.Search(ctx, "*")
+	sort.Strings(results)
+	if err != nil || strings.Join(results, " ") != "abook. other." {
+		t.Errorf("Unexpected search results %v: %v", results, err)
+	}
+	leaves, branches, err := ix.Count(ctx, "abook.*")
+	if err != nil || leaves != 0 || branches != 4 {
+		t.Errorf("Unexpected count %d/%d: %v", leaves, branches, err)
+	}
+
+	walked := make([]string, 0)
+	err = ix.Walk(ctx, "abook.qa-test1e_yandex_net", func(metric string) error {
+		walked = append(walked, metric)
+		return nil
+	})
+	if err != nil || strings.Join(walked, " ") != Data1 {
+		t.Errorf("Unexpected walk %v: %v", walked, err)
+	}
+	errStop := fmt.Errorf("stop")
+	walked = walked[:0]
+	err = ix.Walk(ctx, "", func(metric string) error {
+		walked = append(walked, metric)
+		return errStop
+	})
+	if err != errStop || len(walked) != 1 {
+		t.Errorf("Walk is not stopped by fn: %v %v", walked, err)
+	}
+
+	removed, err := ix.Delete(ctx, Data4)
+	if err != nil || !removed {
+		t.Errorf("Metric is not deleted: %v", err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = ix.Search(canceled, "*")
+	if err != context.Canceled {
+		t.Errorf("context.Canceled expected from Search, got %v", err)
+	}
+	err = ix.Add(canceled, "new.metric")
+	if err != context.Canceled {
+		t.Errorf("context.Canceled expected from Add, got %v", err)
+	}
+
+	err = ix.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rl.messages) == 0 {
+		t.Error("Nothing is logged to the injected logger")
+	}
+	pl.lock.Lock()
+	if len(pl.messages) != 0 {
+		t.Errorf("Index with its own logger logs to the package one: %v", pl.messages)
+	}
+	pl.lock.Unlock()
+
+	// deleted metrics are in index files until they're compacted
+	ix, err = Open(apiDir, WithLogger(rl))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	if ix.Len() != 5 {
+		t.Errorf("5 metrics expected after reopening, got %d", ix.Len())
+	}
+}
+
+func TestIndexWalkConcurrentAdds(t *testing.T) {
+	walkDir := "/tmp/test_index_walk"
+	os.RemoveAll(walkDir)
+	defer os.RemoveAll(walkDir)
+	ctx := context.Background()
+
+	ix, err := Open(walkDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.Close()
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			ix.Add(ctx, fmt.Sprintf("busy.host%d.cpu.user", i/2))
+			ix.Add(ctx, fmt.Sprintf("busy.host%d.cpu.system", i/2))
+		}
+	}()
+	walked := 0
+	for adding := true; adding; {
+		select {
+		case <-done:
+			adding = false
+		default:
+		}
+		walked = 0
+		err = ix.Walk(ctx, "busy", func(metric string) error {
+			walked++
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if walked != 2000 {
+		t.Errorf("2000 metrics added while walking expected, got %d", walked)
+	}
+}
+
+func BenchmarkTreeAdd(b *testing.B) {
+	dropTestTree()
+	prepareTestTree(b)
+	logging.SetLevel(logging.ERROR, "metricsearch")
+	f, err := os.Open("payload.txt")
+	if err != nil {
+		b.Error("Please provide metric list in payload.txt file in the current directory")
+		return
+	}
+	defer f.Close()
+
+	payload := make([]string, 0, 10000000)
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		payload = append(payload, sc.Text())
+	}
+
+	c := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tree.Add(payload[c])
+		c++
+		if c == len(payload) {
+			fmt.Println("Warning: Payload is too short")
+			c = 0
+		}
+	}
+}
+
+// benchmarkTreeMemory reports the heap taken by the tree per metric
+func benchmarkTreeMemory(b *testing.B, metrics []string) {
+	logging.SetLevel(logging.ERROR, "metricsearch")
+	memIndexDir := "/tmp/test_index_memory"
+	os.RemoveAll(memIndexDir)
+	defer os.RemoveAll(memIndexDir)
+
+	var inUse uint64
+	for i := 0; i < b.N; i++ {
+		var before, after runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&before)
+		mt, err := NewTree(memIndexDir, 0, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, metric := range metrics {
+			// a fresh string per metric, just like lines read from a file
+			mt.AddNoSync(string([]byte(metric)))
+		}
+		runtime.GC()
+		runtime.ReadMemStats(&after)
+		inUse += after.HeapAlloc - before.HeapAlloc
+		runtime.KeepAlive(mt)
+	}
+	b.ReportMetric(float64(inUse)/float64(b.N)/float64(len(metrics)), "bytes/metric")
+}
+
+// BenchmarkTreeMemoryHosts is a typical per host tree with shared metric
+// names
+func BenchmarkTreeMemoryHosts(b *testing.B) {
+	metrics := make([]string, 0, 200000)
+	for host := 0; host < 2000; host++ {
+		for cpu := 0; cpu < 10; cpu++ {
+			for _, kind := range []string{"user", "system", "iowait", "idle", "nice", "irq", "softirq", "steal", "guest", "total"} {
+				metrics = append(metrics, fmt.Sprintf("servers.host%04d_example_com.cpu.cpu%d.%s", host, cpu, kind))
+			}
+		}
+	}
+	benchmarkTreeMemory(b, metrics)
+}
+
+// BenchmarkTreeMemoryUnique has a lot of metrics with paths of their own
+func BenchmarkTreeMemoryUnique(b *testing.B) {
+	metrics := make([]string, 0, 200000)
+	for i := 0; i < 200000; i++ {
+		metrics = append(metrics, fmt.Sprintf("requests.handler%d.status.%d.count", i%100, i))
+	}
+	benchmarkTreeMemory(b, metrics)
+}
+
+// BenchmarkHighFanOutSearch looks up a prefix and a suffix among a lot of
+// children of one node
+func BenchmarkHighFanOutSearch(b *testing.B) {
+	idx := newTokenIndex()
+	n := newNode()
+	for i := 0; i < 200000; i++ {
+		inserted := false
+		n.insert([]string{fmt.Sprintf("container_%08x", i*7919), "cpu"}, &inserted, idx)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.search("container_0001*")
+		n.search("*1f3")
+	}
+}
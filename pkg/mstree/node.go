@@ -0,0 +1,671 @@
+package mstree
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Nodes are kept small as there's one per distinct path prefix. Tokens are
+// interned in the tree's tokenIndex, children of low fan-out nodes are
+// kept in a sorted slice instead of a map and the nodes of a single metric
+// path below a node are not created at all: the remaining tokens are kept
+// as the node's suffix until another metric branches off it. Readers get
+// suffix positions as detached read-only views, so the tree looks the same
+// as if every token had its own node.
+
+const (
+	// nodes with more children than that keep them in a map
+	SMALL_CHILDREN_MAX = 16
+	// search context is checked once per that many matched tokens
+	SEARCH_CHECK_EVERY = 256
+)
+
+type node struct {
+	sync.Mutex
+	token string
+	// children are kept sorted by token in small while there are few of
+	// them, high fan-out nodes keep them in big instead
+	small []*node
+	big   *childMap
+	// suffix is the rest of the path of the only metric below the node,
+	// a node with a suffix has no children
+	suffix []string
+	// count is the number of metrics inserted through this node
+	count int64
+	// leafChildren is the number of children having no children
+	leafChildren int64
+	// parent keeps leafChildren of the parent up to date, it's nil for
+	// the root
+	parent *node
+}
+
+func newNode() *node {
+	return new(node)
+}
+
+// childCount returns the number of children, a suffix counts as one
+func (n *node) childCount() int {
+	if n.suffix != nil {
+		return 1
+	}
+	if n.big != nil {
+		return len(n.big.children)
+	}
+	return len(n.small)
+}
+
+func (n *node) isLeaf() bool {
+	return n.childCount() == 0
+}
+
+// empty works like isLeaf for nodes metrics are inserted into concurrently
+func (n *node) empty() bool {
+	n.Lock()
+	defer n.Unlock()
+	return n.isLeaf()
+}
+
+// smallIndex returns the position of token in n.small or where it's to be
+// inserted
+func (n *node) smallIndex(token string) int {
+	lo, hi := 0, len(n.small)
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if n.small[mid].token < token {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// child returns the child node with token, suffix tokens have no nodes
+func (n *node) child(token string) *node {
+	if n.big != nil {
+		return n.big.children[token]
+	}
+	i := n.smallIndex(token)
+	if i < len(n.small) && n.small[i].token == token {
+		return n.small[i]
+	}
+	return nil
+}
+
+// suffixChild returns a view of the first suffix token as a node, it's
+// not a part of the tree and must not be modified
+func (n *node) suffixChild() *node {
+	child := &node{token: n.suffix[0], count: 1, parent: n}
+	if len(n.suffix) > 1 {
+		child.suffix = n.suffix[1:]
+	}
+	return child
+}
+
+// lookup works like child but returns a view of a suffix token as well
+func (n *node) lookup(token string) *node {
+	if n.suffix != nil {
+		if n.suffix[0] == token {
+			return n.suffixChild()
+		}
+		return nil
+	}
+	return n.child(token)
+}
+
+// forEach calls fn for every child, a suffix is passed as a view
+func (n *node) forEach(fn func(token string, child *node)) {
+	if n.suffix != nil {
+		fn(n.suffix[0], n.suffixChild())
+		return
+	}
+	if n.big != nil {
+		for k, child := range n.big.children {
+			fn(k, child)
+		}
+		return
+	}
+	for _, child := range n.small {
+		fn(child.token, child)
+	}
+}
+
+// addChild must be called with n locked, child.token must be set
+func (n *node) addChild(child *node) {
+	if n.isLeaf() && n.parent != nil {
+		// n is not a leaf anymore
+		atomic.AddInt64(&n.parent.leafChildren, -1)
+	}
+	if child.isLeaf() {
+		atomic.AddInt64(&n.leafChildren, 1)
+	}
+	child.parent = n
+	if n.big != nil {
+		n.big.add(child)
+		return
+	}
+	i := n.smallIndex(child.token)
+	n.small = append(n.small, nil)
+	copy(n.small[i+1:], n.small[i:])
+	n.small[i] = child
+	if len(n.small) > SMALL_CHILDREN_MAX {
+		n.big = newChildMap(n.small)
+		n.small = nil
+	}
+}
+
+// removeChild must be called with n locked
+func (n *node) removeChild(child *node) {
+	if n.big != nil {
+		n.big.remove(child.token)
+	} else {
+		i := n.smallIndex(child.token)
+		if i < len(n.small) && n.small[i] == child {
+			copy(n.small[i:], n.small[i+1:])
+			n.small[len(n.small)-1] = nil
+			n.small = n.small[:len(n.small)-1]
+		}
+	}
+	if child.isLeaf() {
+		atomic.AddInt64(&n.leafChildren, -1)
+	}
+	if n.isLeaf() && n.parent != nil {
+		// n is a leaf now, it's pruned by its parent right away unless
+		// it's the root
+		atomic.AddInt64(&n.parent.leafChildren, 1)
+	}
+}
+
+// sortedKeys must be called with n locked
+func (n *node) sortedKeys() []string {
+	if n.suffix != nil {
+		return n.suffix[:1]
+	}
+	if n.big == nil {
+		keys := make([]string, len(n.small))
+		for i, child := range n.small {
+			keys[i] = child.token
+		}
+		return keys
+	}
+	return n.big.sortedKeys()
+}
+
+func (n *node) Count() int64 {
+	return atomic.LoadInt64(&n.count)
+}
+
+// countChildren returns the number of leaf and branch children without
+// looking at the children themselves
+func (n *node) countChildren() (int64, int64) {
+	if n.suffix != nil {
+		if len(n.suffix) == 1 {
+			return 1, 0
+		}
+		return 0, 1
+	}
+	leaves := atomic.LoadInt64(&n.leafChildren)
+	return leaves, int64(n.childCount()) - leaves
+}
+
+// hasPrefix tells if tokens is a prefix of path
+func hasPrefix(path []string, tokens []string) bool {
+	if len(tokens) > len(path) {
+		return false
+	}
+	for i, token := range tokens {
+		if path[i] != token {
+			return false
+		}
+	}
+	return true
+}
+
+// setSuffix must be called with n locked
+func (n *node) setSuffix(tokens []string, idx *tokenIndex) {
+	suffix := make([]string, len(tokens))
+	for i, token := range tokens {
+		suffix[i] = idx.intern(token)
+	}
+	n.suffix = suffix
+}
+
+// split turns the first suffix token into a real child, it must be called
+// with n locked. Postings of the suffix tokens move to the child.
+func (n *node) split(idx *tokenIndex) {
+	child := &node{token: n.suffix[0], count: 1}
+	if len(n.suffix) > 1 {
+		child.suffix = n.suffix[1:]
+	}
+	n.addChild(child)
+	idx.add(child.token, child)
+	idx.addSuffix(child.suffix, child)
+	idx.removeSuffix(n.suffix, n)
+	n.suffix = nil
+}
+
+// fold turns n into a suffix owner if there's a single metric below it,
+// it's used for nodes not in the tree yet
+func (n *node) fold() {
+	if len(n.small) != 1 {
+		return
+	}
+	child := n.small[0]
+	if !child.isLeaf() && child.suffix == nil {
+		return
+	}
+	suffix := make([]string, len(child.suffix)+1)
+	suffix[0] = child.token
+	copy(suffix[1:], child.suffix)
+	n.small = nil
+	n.leafChildren = 0
+	n.suffix = suffix
+}
+
+// register adds tokens of nodes below n to the token index
+func (n *node) register(idx *tokenIndex) {
+	if n.suffix != nil {
+		idx.addSuffix(n.suffix, n)
+		return
+	}
+	n.forEach(func(token string, child *node) {
+		idx.add(token, child)
+		child.register(idx)
+	})
+}
+
+// path returns the full name of n, the tokens of a node and its parents
+// never change
+func (n *node) path() string {
+	tokens := make([]string, 0)
+	for ; n.parent != nil; n = n.parent {
+		tokens = append(tokens, n.token)
+	}
+	for i, j := 0, len(tokens)-1; i < j; i, j = i+1, j-1 {
+		tokens[i], tokens[j] = tokens[j], tokens[i]
+	}
+	return strings.Join(tokens, ".")
+}
+
+// insert adds the metric of tokens below n
+func (n *node) insert(tokens []string, inserted *bool, idx *tokenIndex) {
+	if len(tokens) == 0 {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+
+	if n.suffix != nil {
+		if hasPrefix(n.suffix, tokens) {
+			// the metric or a branch of it exists
+			return
+		}
+		n.split(idx)
+	} else if n.parent != nil && n.isLeaf() {
+		// a leaf becomes a branch of a single metric
+		atomic.AddInt64(&n.parent.leafChildren, -1)
+		n.setSuffix(tokens, idx)
+		idx.addSuffix(n.suffix, n)
+		*inserted = true
+		atomic.AddInt64(&n.count, 1)
+		return
+	}
+
+	first, tail := tokens[0], tokens[1:]
+
+	child := n.child(first)
+	if child == nil {
+		*inserted = true
+		child = &node{token: idx.intern(first), count: 1}
+		if len(tail) > 0 {
+			child.setSuffix(tail, idx)
+		}
+		n.addChild(child)
+		idx.add(child.token, child)
+		idx.addSuffix(child.suffix, child)
+		atomic.AddInt64(&n.count, 1)
+		return
+	}
+	child.insert(tail, inserted, idx)
+	if *inserted {
+		atomic.AddInt64(&n.count, 1)
+	}
+}
+
+// remove deletes the leaf at tokens pruning the branches left without
+// children, removed is set if the leaf existed
+func (n *node) remove(tokens []string, removed *bool, idx *tokenIndex) {
+	if len(tokens) == 0 {
+		return
+	}
+	n.Lock()
+	defer n.Unlock()
+
+	first, tail := tokens[0], tokens[1:]
+
+	child := n.child(first)
+	if child == nil {
+		return
+	}
+	// inserts into child hold n's lock, child can't change here unless
+	// it's locked by remove itself
+	whole := false
+	if child.suffix != nil {
+		// the only metric below child is either removed or not there
+		whole = len(tail) == len(child.suffix) && hasPrefix(child.suffix, tail)
+		*removed = whole
+	} else if len(tail) == 0 {
+		// a branch is not a metric
+		whole = child.isLeaf()
+		*removed = whole
+	} else {
+		child.remove(tail, removed, idx)
+		whole = child.isLeaf()
+	}
+	if !*removed {
+		return
+	}
+	atomic.AddInt64(&n.count, -1)
+	if whole {
+		n.removeChild(child)
+		idx.remove(child.token, child)
+		idx.removeSuffix(child.suffix, child)
+	}
+}
+
+// complete returns up to limit children with tokens starting with prefix
+// in lexicographical order. limit <= 0 means no limit. The children are
+// collected under the lock, they may be removed from n right after that.
+func (n *node) complete(prefix string, limit int) []nodeMatch {
+	n.Lock()
+	defer n.Unlock()
+	keys := n.sortedKeys()
+	results := make([]nodeMatch, 0)
+	for i := sort.SearchStrings(keys, prefix); i < len(keys); i++ {
+		if !strings.HasPrefix(keys[i], prefix) {
+			break
+		}
+		if limit > 0 && len(results) == limit {
+			break
+		}
+		results = append(results, nodeMatch{keys[i], n.lookup(keys[i])})
+	}
+	return results
+}
+
+// joinPath appends tokens to a dotted prefix which may be empty
+func joinPath(prefix string, tokens ...string) string {
+	if prefix == "" {
+		return strings.Join(tokens, ".")
+	}
+	return prefix + "." + strings.Join(tokens, ".")
+}
+
+// grepLeaves collects leaves at or below n, the node at path. It returns
+// false once ctx is done.
+func (n *node) grepLeaves(ctx context.Context, path string, results map[string]bool) bool {
+	suffix, children := n.contents()
+	if suffix != nil {
+		results[joinPath(path, suffix...)] = true
+		return true
+	}
+	if len(children) == 0 {
+		results[path] = true
+		return true
+	}
+	// leaves are cheap, ctx is checked by branches only
+	if ctx.Err() != nil {
+		return false
+	}
+	for _, child := range children {
+		if !child.node.grepLeaves(ctx, joinPath(path, child.token), results) {
+			return false
+		}
+	}
+	return true
+}
+
+// contents returns the suffix of n or a copy of its children. Both are
+// taken under the lock, so the subtree can be walked without it while
+// metrics are inserted, the way matches does.
+func (n *node) contents() ([]string, []nodeMatch) {
+	n.Lock()
+	defer n.Unlock()
+	if n.suffix != nil {
+		return n.suffix, nil
+	}
+	children := make([]nodeMatch, 0, n.childCount())
+	n.forEach(func(k string, child *node) {
+		children = append(children, nodeMatch{k, child})
+	})
+	return nil, children
+}
+
+// dumpRecords works like TraverseDump but writes checksummed index records
+func (n *node) dumpRecords(prefix string, writer io.Writer) {
+	suffix, children := n.contents()
+	if suffix != nil {
+		writeIdxRecord(writer, joinPath(prefix, suffix...))
+	} else if len(children) == 0 {
+		writeIdxRecord(writer, prefix)
+	}
+	for _, child := range children {
+		child.node.dumpRecords(joinPath(prefix, child.token), writer)
+	}
+}
+
+func (n *node) TraverseDump(prefix string, writer io.Writer) {
+	suffix, children := n.contents()
+	if suffix != nil {
+		io.WriteString(writer, joinPath(prefix, suffix...)+"\n")
+	} else if len(children) == 0 {
+		io.WriteString(writer, prefix+"\n")
+	}
+	for _, child := range children {
+		child.node.TraverseDump(joinPath(prefix, child.token), writer)
+	}
+}
+
+// walkLeaves calls fn with the path of every leaf below n until fn returns
+// false, it returns false if the walk is stopped
+func (n *node) walkLeaves(prefix string, fn func(path string) bool) bool {
+	suffix, children := n.contents()
+	if suffix != nil {
+		return fn(joinPath(prefix, suffix...))
+	}
+	if len(children) == 0 {
+		return fn(prefix)
+	}
+	for _, child := range children {
+		if !child.node.walkLeaves(joinPath(prefix, child.token), fn) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n *node) search(pattern string) map[string]*node {
+	results := make(map[string]*node)
+	n.eachMatch(context.Background(), pattern, func(k string, node *node) {
+		results[k] = node
+	})
+	return results
+}
+
+type nodeMatch struct {
+	token string
+	node  *node
+}
+
+// matches works like search but returns a slice, so matches can be walked
+// without holding any lock. Matching stops early once ctx is done.
+func (n *node) matches(ctx context.Context, pattern string) []nodeMatch {
+	results := make([]nodeMatch, 0)
+	n.eachMatch(ctx, pattern, func(k string, node *node) {
+		results = append(results, nodeMatch{k, node})
+	})
+	return results
+}
+
+// eachMatch calls fn for every child matching pattern, fn is called with
+// n locked so the children can't change under the match
+func (n *node) eachMatch(ctx context.Context, pattern string, fn func(k string, child *node)) {
+	n.Lock()
+	defer n.Unlock()
+	if pattern == "*" {
+		if ctx.Done() == nil {
+			n.forEach(fn)
+			return
+		}
+		match := cancellable(ctx, matchAll)
+		n.forEach(func(k string, node *node) {
+			if match(k) {
+				fn(k, node)
+			}
+		})
+		return
+	}
+
+	if !strings.ContainsAny(pattern, "*?[]") {
+		if node := n.lookup(pattern); node != nil {
+			fn(pattern, node)
+		}
+		return
+	}
+
+	match := patternMatcher(pattern)
+	if match == nil {
+		return
+	}
+
+	n.filter(pattern, cancellable(ctx, match), fn)
+}
+
+func matchAll(k string) bool {
+	return true
+}
+
+// cancellable wraps match so it matches nothing once ctx is done. ctx is
+// checked every SEARCH_CHECK_EVERY tokens only, it's way more expensive
+// than most of the matches.
+func cancellable(ctx context.Context, match func(k string) bool) func(k string) bool {
+	if ctx.Done() == nil {
+		return match
+	}
+	checked := 0
+	done := false
+	return func(k string) bool {
+		if done {
+			return false
+		}
+		checked++
+		if checked%SEARCH_CHECK_EVERY == 0 && ctx.Err() != nil {
+			done = true
+			return false
+		}
+		return match(k)
+	}
+}
+
+// patternMatcher returns the function matching tokens against a pattern
+// having wildcards or brackets, nil if the pattern is invalid
+func patternMatcher(pattern string) func(k string) bool {
+	wcIndex := strings.Index(pattern, "*")
+	qIndex := strings.Index(pattern, "?")
+	obIndex := strings.Index(pattern, "[")
+	cbIndex := strings.Index(pattern, "]")
+
+	var match func(k string) bool
+	if cbIndex == -1 && obIndex == -1 {
+		if qIndex == -1 {
+			// Only *
+			lwcIndex := strings.LastIndex(pattern, "*")
+
+			if wcIndex != lwcIndex || (wcIndex != 0 && wcIndex != len(pattern)-1) {
+				// more than one wildcard or one wildcard in the middle
+				rePattern := "^" + strings.Replace(pattern, "*", ".*", -1) + "$"
+				re, err := regexp.Compile(rePattern)
+				if err != nil {
+					return nil
+				}
+				match = re.MatchString
+			} else if wcIndex == len(pattern)-1 {
+				// wildcard at the end
+				partial := pattern[:len(pattern)-1]
+				match = func(k string) bool {
+					return strings.HasPrefix(k, partial)
+				}
+			} else {
+				// wildcard at the begining
+				partial := pattern[1:]
+				match = func(k string) bool {
+					return strings.HasSuffix(k, partial)
+				}
+			}
+		} else if wcIndex == -1 {
+			// Only ?
+			lqIndex := strings.LastIndex(pattern, "?")
+			if qIndex != lqIndex || (qIndex != 0 && qIndex != len(pattern)-1) {
+				// more than one ? or one ? in the middle
+				rePattern := "^" + strings.Replace(pattern, "?", ".", -1) + "$"
+				re, err := regexp.Compile(rePattern)
+				if err != nil {
+					return nil
+				}
+				match = re.MatchString
+			} else if qIndex == len(pattern)-1 {
+				// ? at the end
+				partial := pattern[:len(pattern)-1]
+				match = func(k string) bool {
+					return k[:len(k)-1] == partial
+				}
+			} else {
+				// ? at the begining
+				partial := pattern[1:]
+				match = func(k string) bool {
+					return k[1:] == partial
+				}
+			}
+		} else {
+			// * and ? presents
+			rePattern := "^" + strings.Replace(strings.Replace(pattern, "*", ".*", -1), "?", ".?", -1) + "$"
+			re, err := regexp.Compile(rePattern)
+			if err != nil {
+				return nil
+			}
+			match = re.MatchString
+		}
+	} else {
+		rePattern := "^" + strings.Replace(strings.Replace(pattern, "*", ".*", -1), "?", ".?", -1) + "$"
+		re, err := regexp.Compile(rePattern)
+		if err != nil {
+			return nil
+		}
+		match = re.MatchString
+	}
+	return match
+}
+
+// filter calls fn for children matching pattern, it must be called with n
+// locked. High fan-out nodes check only the children having the literal
+// prefix or suffix of pattern.
+func (n *node) filter(pattern string, match func(k string) bool, fn func(k string, child *node)) {
+	if n.big == nil {
+		n.forEach(func(k string, node *node) {
+			if match(k) {
+				fn(k, node)
+			}
+		})
+		return
+	}
+	n.big.candidates(pattern, func(k string) {
+		if match(k) {
+			fn(k, n.big.children[k])
+		}
+	})
+}
@@ -0,0 +1,286 @@
+package mstree
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When the queue of an index writer is full Add either waits for it
+// (forever or up to a timeout, then the metric is dropped), drops the
+// metric right away or spills it to an overflow file in the current
+// generation. Dropped metrics stay in memory and get to disk with the next
+// dump or compaction. Overflow files are fed back to the writers in
+// background and loaded with the index if that hasn't happened before a
+// restart.
+
+const (
+	SYNC_OVERFLOW_BLOCK = "block"
+	SYNC_OVERFLOW_DROP  = "drop"
+	SYNC_OVERFLOW_SPILL = "spill"
+
+	OVERFLOW_PREFIX = "overflow-"
+	OVERFLOW_SUFFIX = ".log"
+)
+
+type WriterQueueStats struct {
+	Writer   int
+	Queued   int64
+	Dropped  int64
+	Spilled  int64
+	Timeouts int64
+	// Saturation is the occupied part of the writer queue
+	Saturation float64
+}
+
+type overflowLog struct {
+	lock    *sync.Mutex
+	f       *os.File
+	records int64
+}
+
+func newOverflowLog() *overflowLog {
+	return &overflowLog{lock: new(sync.Mutex)}
+}
+
+func isOverflowFile(fName string) bool {
+	return strings.HasPrefix(fName, OVERFLOW_PREFIX) && strings.HasSuffix(fName, OVERFLOW_SUFFIX)
+}
+
+// overflowFiles returns full names of overflow files in dir, oldest first
+func overflowFiles(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]string, 0)
+	for _, file := range files {
+		if isOverflowFile(file.Name()) {
+			results = append(results, filepath.Join(dir, file.Name()))
+		}
+	}
+	sort.Strings(results)
+	return results, nil
+}
+
+func (o *overflowLog) spill(dir string, metric string) error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.f == nil {
+		fName := filepath.Join(dir, fmt.Sprintf("%s%020d%s", OVERFLOW_PREFIX, time.Now().UnixNano(), OVERFLOW_SUFFIX))
+		f, err := os.OpenFile(fName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0644))
+		if err != nil {
+			return err
+		}
+		o.f = f
+	}
+	err := writeIdxRecord(o.f, metric)
+	if err == nil {
+		o.records++
+	}
+	return err
+}
+
+// current returns the name of the file being spilled to, if any
+func (o *overflowLog) current() string {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.f == nil {
+		return ""
+	}
+	return o.f.Name()
+}
+
+func (o *overflowLog) sync() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.f == nil {
+		return nil
+	}
+	return o.f.Sync()
+}
+
+// rotate closes the file being spilled to, the next spill starts a new one
+func (o *overflowLog) rotate() error {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.f == nil {
+		return nil
+	}
+	err := o.f.Sync()
+	o.f.Close()
+	o.f = nil
+	return err
+}
+
+// SetSyncOverflow sets what Add does when the queue of an index writer is
+// full. A zero timeout makes the block policy wait forever.
+func (t *MSTree) SetSyncOverflow(policy string, timeout time.Duration) error {
+	if policy != SYNC_OVERFLOW_BLOCK && policy != SYNC_OVERFLOW_DROP && policy != SYNC_OVERFLOW_SPILL {
+		return fmt.Errorf("unknown sync overflow policy '%s'", policy)
+	}
+	if timeout < 0 {
+		return fmt.Errorf("invalid sync overflow timeout %s", timeout.String())
+	}
+	t.overflowPolicy = policy
+	t.overflowTimeout = timeout
+	return nil
+}
+
+// send passes req to the writer applying the overflow policy, it returns
+// false if the writer hasn't accepted req
+func (t *MSTree) send(iw *indexWriter, req writeRequest) bool {
+	select {
+	case iw.data <- req:
+		return true
+	default:
+	}
+	if t.overflowPolicy != SYNC_OVERFLOW_BLOCK {
+		return false
+	}
+	if t.overflowTimeout == 0 {
+		iw.data <- req
+		return true
+	}
+	timer := time.NewTimer(t.overflowTimeout)
+	defer timer.Stop()
+	select {
+	case iw.data <- req:
+		return true
+	case <-timer.C:
+		atomic.AddInt64(&iw.timeouts, 1)
+		return false
+	}
+}
+
+// overflowed handles a metric the writer hasn't accepted
+func (t *MSTree) overflowed(metric string, iw *indexWriter) {
+	if t.overflowPolicy == SYNC_OVERFLOW_SPILL {
+		err := t.overflow.spill(t.genDir, metric)
+		if err == nil {
+			atomic.AddInt64(&iw.spilled, 1)
+			return
+		}
+		t.log.Error("Error spilling metric '%s' to overflow file: %s", metric, err.Error())
+	}
+	atomic.AddInt64(&iw.dropped, 1)
+	t.log.Debug("Sync queue is full, metric '%s' is not synced to disk", metric)
+}
+
+// loadOverflow inserts metrics spilled before a restart, they're passed to
+// the writers by the overflow drainer
+func (t *MSTree) loadOverflow() error {
+	files, err := overflowFiles(t.genDir)
+	if err != nil {
+		return err
+	}
+	for _, fName := range files {
+		loaded := 0
+		damaged, err := readLogRecords(fName, func(metric string) {
+			if t.AddNoSync(metric) {
+				loaded++
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if damaged > 0 {
+			t.log.Error("%d records from the first damaged one skipped loading %s", damaged, fName)
+		}
+		t.log.Notice("%d metrics loaded from %s", loaded, fName)
+	}
+	return nil
+}
+
+// drainOverflow passes metrics from overflow files to the writers waiting
+// for room in their queues and removes the files once they're synced
+func (t *MSTree) drainOverflow() {
+	t.drainLock.Lock()
+	defer t.drainLock.Unlock()
+
+	err := t.overflow.rotate()
+	if err != nil {
+		t.log.Error("Error closing overflow file: %s", err.Error())
+	}
+	files, err := overflowFiles(t.genDir)
+	if err != nil {
+		t.log.Error("Error listing overflow files: %s", err.Error())
+		return
+	}
+	current := t.overflow.current()
+	for _, fName := range files {
+		if fName == current {
+			continue
+		}
+		tm := time.Now()
+		drained := 0
+		_, err := readLogRecords(fName, func(metric string) {
+			t.enqueueWait(metric)
+			drained++
+		})
+		if err != nil {
+			t.log.Error("Error draining overflow file %s: %s", fName, err.Error())
+			continue
+		}
+		t.writerBarrier().Wait()
+		err = os.Remove(fName)
+		if err != nil {
+			t.log.Error("Error removing overflow file %s: %s", fName, err.Error())
+		}
+		t.log.Notice("%d metrics drained from %s in %s", drained, fName, time.Now().Sub(tm).String())
+	}
+}
+
+// StartOverflowDrainer checks for overflow files every interval and passes
+// metrics from them to the writers
+func (t *MSTree) StartOverflowDrainer(interval time.Duration) {
+	if !t.enableSync || interval <= 0 {
+		return
+	}
+	t.watchers.Add(1)
+	go func() {
+		defer t.watchers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.drainOverflow()
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// QueueStats returns queue statistics of index writers which have anything
+// queued or have ever overflowed. Writers are shared by first level tokens
+// so the statistics stay bounded however many tokens there are.
+func (t *MSTree) QueueStats() []WriterQueueStats {
+	t.writersLock.Lock()
+	defer t.writersLock.Unlock()
+	results := make([]WriterQueueStats, 0)
+	for i, iw := range t.writers {
+		s := WriterQueueStats{
+			Writer:   i,
+			Queued:   atomic.LoadInt64(&iw.queueSize),
+			Dropped:  atomic.LoadInt64(&iw.dropped),
+			Spilled:  atomic.LoadInt64(&iw.spilled),
+			Timeouts: atomic.LoadInt64(&iw.timeouts),
+		}
+		if s.Queued == 0 && s.Dropped == 0 && s.Spilled == 0 && s.Timeouts == 0 {
+			continue
+		}
+		if t.syncBufferSize > 0 {
+			s.Saturation = float64(s.Queued) / float64(t.syncBufferSize)
+		}
+		results = append(results, s)
+	}
+	return results
+}
@@ -0,0 +1,275 @@
+package mstree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync/atomic"
+)
+
+// Binary snapshot of a first level subtree (<token>.bidx):
+//
+//	magic "MSIX", version byte
+//	uvarint number of distinct tokens, then every token as uvarint
+//	length followed by its bytes
+//	nodes depth-first starting with the subtree root, every node is
+//	uvarint number of children followed by (uvarint token id, child node)
+//	for every child
+//	CRC32 (IEEE) of everything above, 4 bytes little endian
+//
+// Text .idx files are still used for metrics appended after the snapshot.
+
+const (
+	INDEX_FORMAT_TEXT   = "text"
+	INDEX_FORMAT_BINARY = "binary"
+
+	SNAPSHOT_MAGIC   = "MSIX"
+	SNAPSHOT_VERSION = 1
+	SNAPSHOT_SUFFIX  = ".bidx"
+)
+
+type SnapshotError struct {
+	msg string
+}
+
+func (se *SnapshotError) Error() string {
+	return se.msg
+}
+
+type snapshotWriter struct {
+	w   io.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (sw *snapshotWriter) write(data []byte) {
+	if sw.err != nil {
+		return
+	}
+	_, sw.err = sw.w.Write(data)
+}
+
+func (sw *snapshotWriter) uvarint(x uint64) {
+	n := binary.PutUvarint(sw.buf[:], x)
+	sw.write(sw.buf[:n])
+}
+
+// snapshotCollector copies a subtree into the encoded node stream and the
+// token dictionary in a single pass, so both describe the same tree while
+// metrics are inserted concurrently
+type snapshotCollector struct {
+	dict   map[string]uint64
+	tokens []string
+	nodes  []byte
+}
+
+func (sc *snapshotCollector) id(token string) uint64 {
+	id, ok := sc.dict[token]
+	if !ok {
+		id = uint64(len(sc.tokens))
+		sc.dict[token] = id
+		sc.tokens = append(sc.tokens, token)
+	}
+	return id
+}
+
+func (sc *snapshotCollector) node(n *node) {
+	suffix, children := n.contents()
+	if suffix != nil {
+		for _, token := range suffix {
+			sc.nodes = binary.AppendUvarint(sc.nodes, 1)
+			sc.nodes = binary.AppendUvarint(sc.nodes, sc.id(token))
+		}
+		sc.nodes = binary.AppendUvarint(sc.nodes, 0)
+		return
+	}
+	sc.nodes = binary.AppendUvarint(sc.nodes, uint64(len(children)))
+	for _, child := range children {
+		sc.nodes = binary.AppendUvarint(sc.nodes, sc.id(child.token))
+		sc.node(child.node)
+	}
+}
+
+// collectSnapshot copies idxNode to be written as a snapshot later on
+func collectSnapshot(idxNode *node) *snapshotCollector {
+	sc := &snapshotCollector{dict: make(map[string]uint64)}
+	sc.node(idxNode)
+	return sc
+}
+
+func (sc *snapshotCollector) write(w io.Writer) error {
+	h := crc32.NewIEEE()
+	sw := &snapshotWriter{w: io.MultiWriter(w, h)}
+	sw.write([]byte(SNAPSHOT_MAGIC))
+	sw.write([]byte{SNAPSHOT_VERSION})
+	sw.uvarint(uint64(len(sc.tokens)))
+	for _, token := range sc.tokens {
+		sw.uvarint(uint64(len(token)))
+		sw.write([]byte(token))
+	}
+	sw.write(sc.nodes)
+	if sw.err != nil {
+		return sw.err
+	}
+	var sum [4]byte
+	binary.LittleEndian.PutUint32(sum[:], h.Sum32())
+	_, err := w.Write(sum[:])
+	return err
+}
+
+func writeSnapshot(w io.Writer, idxNode *node) error {
+	return collectSnapshot(idxNode).write(w)
+}
+
+type snapshotReader struct {
+	r      *bufio.Reader
+	size   int64
+	tokens []string
+}
+
+func (sr *snapshotReader) uvarint(limit uint64) (uint64, error) {
+	x, err := binary.ReadUvarint(sr.r)
+	if err != nil {
+		return 0, err
+	}
+	if x > limit {
+		return 0, &SnapshotError{fmt.Sprintf("value %d out of range", x)}
+	}
+	return x, nil
+}
+
+// children reads children of n and returns the number of leaves loaded.
+// The nodes are not registered in the token index, nodes of a single
+// metric are folded into suffixes as they're read.
+func (sr *snapshotReader) children(n *node) (int64, error) {
+	count, err := sr.uvarint(uint64(sr.size))
+	if err != nil {
+		return 0, err
+	}
+	var leaves int64
+	for i := uint64(0); i < count; i++ {
+		id, err := sr.uvarint(uint64(sr.size))
+		if err != nil {
+			return leaves, err
+		}
+		if id >= uint64(len(sr.tokens)) {
+			return leaves, &SnapshotError{fmt.Sprintf("token id %d out of range", id)}
+		}
+		token := sr.tokens[id]
+		if n.child(token) != nil {
+			return leaves, &SnapshotError{fmt.Sprintf("duplicate token %s", token)}
+		}
+		child := &node{token: token}
+		childLeaves, err := sr.children(child)
+		if childLeaves == 0 {
+			childLeaves = 1
+		}
+		child.count = childLeaves
+		child.fold()
+		n.addChild(child)
+		leaves += childLeaves
+		if err != nil {
+			return leaves, err
+		}
+	}
+	return leaves, nil
+}
+
+// verifySnapshot checks the trailing checksum of a snapshot and returns
+// its size, decompressed if the file is compressed
+func verifySnapshot(filename string) (int64, error) {
+	r, err := openIndexReader(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	h := crc32.NewIEEE()
+	// the last 4 bytes read so far are held back as they may be the
+	// checksum itself
+	var size int64
+	held := make([]byte, 0, 4)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			data := append(held, buf[:n]...)
+			if len(data) > 4 {
+				h.Write(data[:len(data)-4])
+				size += int64(len(data) - 4)
+				data = data[len(data)-4:]
+			}
+			held = append(make([]byte, 0, 4), data...)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if _, ok := err.(*os.PathError); ok {
+				return 0, err
+			}
+			// gzip stream errors
+			return 0, &SnapshotError{err.Error()}
+		}
+	}
+	size += int64(len(held))
+	if size < int64(len(SNAPSHOT_MAGIC)+1+4) {
+		return 0, &SnapshotError{"file is too short"}
+	}
+	if binary.LittleEndian.Uint32(held) != h.Sum32() {
+		return 0, &SnapshotError{"checksum mismatch"}
+	}
+	return size, nil
+}
+
+// readSnapshot loads a binary snapshot into the empty idxNode returning
+// the number of metrics loaded
+func readSnapshot(filename string, idxNode *node, idx *tokenIndex) (int64, error) {
+	size, err := verifySnapshot(filename)
+	if err != nil {
+		return 0, err
+	}
+	f, err := openIndexReader(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	sr := &snapshotReader{r: bufio.NewReader(f), size: size}
+	header := make([]byte, len(SNAPSHOT_MAGIC)+1)
+	_, err = io.ReadFull(sr.r, header)
+	if err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(header[:len(SNAPSHOT_MAGIC)], []byte(SNAPSHOT_MAGIC)) {
+		return 0, &SnapshotError{"invalid magic"}
+	}
+	if header[len(SNAPSHOT_MAGIC)] != SNAPSHOT_VERSION {
+		return 0, &SnapshotError{fmt.Sprintf("unsupported version %d", header[len(SNAPSHOT_MAGIC)])}
+	}
+	tokenCount, err := sr.uvarint(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	sr.tokens = make([]string, tokenCount)
+	for i := range sr.tokens {
+		l, err := sr.uvarint(uint64(size))
+		if err != nil {
+			return 0, err
+		}
+		buf := make([]byte, l)
+		_, err = io.ReadFull(sr.r, buf)
+		if err != nil {
+			return 0, err
+		}
+		sr.tokens[i] = idx.intern(string(buf))
+	}
+	leaves, err := sr.children(idxNode)
+	idxNode.fold()
+	idxNode.register(idx)
+	atomic.AddInt64(&idxNode.count, leaves)
+	return leaves, err
+}
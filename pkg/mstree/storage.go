@@ -0,0 +1,429 @@
+package mstree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// In the mapped storage mode the bulk of the index is an immutable trie
+// file searched in place through a read-only memory mapping, so startup
+// time doesn't depend on the index size and the index may be larger than
+// RAM. Root only holds the metrics added since the trie was written (the
+// delta), they're synced to index files as usual. Merging freezes the
+// delta, writes the trie merged with it into a new file and maps it
+// instead of the previous one, then index files of the merged tokens are
+// compacted down to the metrics added since the freeze. Frozen deltas stay
+// searchable until the new trie replaces them, a failed merge is retried
+// with them the next time. Searches hold the trie they've started with
+// mapped till they're over, so results can be streamed to slow readers
+// without blocking merges. Grep, fuzzy search and Delete aren't supported
+// in this mode, they return ErrNotSupported.
+
+const (
+	STORAGE_MEMORY = "memory"
+	STORAGE_MAPPED = "mapped"
+)
+
+var (
+	ErrNotSupported = errors.New("not supported in the mapped storage mode")
+)
+
+// SetStorage sets the storage mode, it must be called before LoadIndex
+func (t *MSTree) SetStorage(mode string) error {
+	if mode != STORAGE_MEMORY && mode != STORAGE_MAPPED {
+		return fmt.Errorf("unknown storage mode '%s'", mode)
+	}
+	t.storage = mode
+	return nil
+}
+
+func (t *MSTree) trieFilename(dir string) string {
+	return fmt.Sprintf("%s/%s", dir, TRIE_FILE)
+}
+
+// delta returns the tree of metrics added since the last merge and its
+// token index, that's the whole tree in the memory mode
+func (t *MSTree) delta() (*node, *tokenIndex) {
+	if t.storage != STORAGE_MAPPED {
+		return t.Root, t.tokens
+	}
+	t.mappedLock.RLock()
+	defer t.mappedLock.RUnlock()
+	return t.Root, t.tokens
+}
+
+// inTrie tells if the metric of tokens is already in the mapped trie
+func (t *MSTree) inTrie(tokens []string) bool {
+	t.mappedLock.RLock()
+	defer t.mappedLock.RUnlock()
+	return t.mapped != nil && t.mapped.hasLeaf(tokens)
+}
+
+// mapTrie maps the trie file of the current generation if there's one
+func (t *MSTree) mapTrie() error {
+	filename := t.trieFilename(t.genDir)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	m, err := openMappedTrie(filename)
+	if err != nil {
+		return err
+	}
+	t.mappedLock.Lock()
+	t.mapped = m
+	t.mappedLock.Unlock()
+	atomic.AddInt64(&t.TotalMetrics, m.leaves)
+	t.log.Notice("%s mapped, %d metrics", filename, m.leaves)
+	return nil
+}
+
+// loadTrie inserts metrics of the trie file of the current generation into
+// the tree, that's how the memory mode reads an index written in the
+// mapped one
+func (t *MSTree) loadTrie() error {
+	filename := t.trieFilename(t.genDir)
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		return nil
+	}
+	m, err := openMappedTrie(filename)
+	if err != nil {
+		return err
+	}
+	defer m.close()
+	m.walk(m.root, "", func(path string) bool {
+		t.AddNoSync(path)
+		return true
+	})
+	t.log.Notice("%s loaded, %d metrics", filename, m.leaves)
+	return nil
+}
+
+// freezeDelta replaces Root with an empty tree and returns all the frozen
+// deltas to be merged, nil if there's nothing to merge
+func (t *MSTree) freezeDelta() []*node {
+	t.freezeLock.Lock()
+	defer t.freezeLock.Unlock()
+	t.mappedLock.Lock()
+	defer t.mappedLock.Unlock()
+	if !t.Root.isLeaf() {
+		t.frozen = append(t.frozen, t.Root)
+		t.Root = newNode()
+		t.tokens = newTokenIndex()
+	}
+	if len(t.frozen) == 0 {
+		return nil
+	}
+	return append([]*node(nil), t.frozen...)
+}
+
+// writeMerged writes the current trie merged with deltas into filename and
+// maps the new file. It must be called with compactLock held as the
+// current trie only changes with compactLock held.
+func (t *MSTree) writeMerged(filename string, deltas []*node) (*mappedTrie, error) {
+	t.mappedLock.RLock()
+	base := t.mapped
+	t.mappedLock.RUnlock()
+	tmpFile := filename + TMP_SUFFIX
+	_, err := writeTrie(tmpFile, base, deltas)
+	if err == nil {
+		// the previous file stays mapped until it's replaced
+		err = os.Rename(tmpFile, filename)
+	}
+	if err != nil {
+		os.Remove(tmpFile)
+		return nil, err
+	}
+	return openMappedTrie(filename)
+}
+
+// installTrie replaces the mapped trie with m having all the frozen deltas
+// merged into it
+func (t *MSTree) installTrie(m *mappedTrie) {
+	t.mappedLock.Lock()
+	prev := t.mapped
+	t.mapped = m
+	t.frozen = nil
+	atomic.StoreInt64(&t.TotalMetrics, m.leaves+t.Root.Count())
+	t.mappedLock.Unlock()
+	if prev != nil {
+		prev.retire()
+	}
+}
+
+// Merge writes the metrics added since the last merge into a new trie file
+// along with the current trie and maps it instead, it does nothing in the
+// memory storage mode
+func (t *MSTree) Merge() error {
+	if t.storage != STORAGE_MAPPED {
+		return nil
+	}
+	t.compactLock.Lock()
+	defer t.compactLock.Unlock()
+	return t.merge()
+}
+
+// merge must be called with compactLock held
+func (t *MSTree) merge() error {
+	deltas := t.freezeDelta()
+	if deltas == nil {
+		return nil
+	}
+	tm := time.Now()
+	filename := t.trieFilename(t.genDir)
+	m, err := t.writeMerged(filename, deltas)
+	if err != nil {
+		t.log.Error("Error merging into %s, keeping frozen metrics in memory: %s", filename, err.Error())
+		return err
+	}
+	t.installTrie(m)
+	t.log.Notice("%s merged in %s, %d metrics", filename, time.Now().Sub(tm).String(), m.leaves)
+	if !t.enableSync {
+		return nil
+	}
+	// metrics queued before the freeze must be written before the index
+	// files are cut down to the new delta
+	t.writerBarrier().Wait()
+	var globalErr error = nil
+	for _, token := range deltaTokens(deltas) {
+		err = t.compactToken(token)
+		if err != nil {
+			t.log.Error("Error compacting %s.idx: %s", token, err.Error())
+			globalErr = err
+		}
+	}
+	return globalErr
+}
+
+// deltaTokens returns first level tokens of deltas
+func deltaTokens(deltas []*node) []string {
+	seen := make(map[string]bool)
+	tokens := make([]string, 0)
+	for _, delta := range deltas {
+		delta.forEach(func(token string, _ *node) {
+			if !seen[token] {
+				seen[token] = true
+				tokens = append(tokens, token)
+			}
+		})
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// StartMerger merges the delta into the trie file every interval in the
+// mapped storage mode
+func (t *MSTree) StartMerger(interval time.Duration) {
+	if t.storage != STORAGE_MAPPED {
+		return
+	}
+	if interval <= 0 {
+		t.log.Notice("Background trie merging disabled")
+		return
+	}
+	t.log.Notice("Starting background trie merger, interval %s", interval.String())
+	t.watchers.Add(1)
+	go func() {
+		defer t.watchers.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				t.Merge()
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+}
+
+// mappedSources returns the trie (nil if there's none) and the deltas to
+// search, the trie stays mapped until it's released
+func (t *MSTree) mappedSources() (*mappedTrie, []*node) {
+	t.mappedLock.RLock()
+	defer t.mappedLock.RUnlock()
+	if t.mapped != nil {
+		t.mapped.readers.Add(1)
+	}
+	return t.mapped, append([]*node{t.Root}, t.frozen...)
+}
+
+// mergedNode is a path found in the trie (if inTrie) and in the delta
+// nodes
+type mergedNode struct {
+	m      *mappedTrie
+	off    uint64
+	inTrie bool
+	nodes  []*node
+}
+
+// isLeaf tells if the path is a leaf everywhere it's found
+func (mn *mergedNode) isLeaf() bool {
+	if mn.inTrie && mn.m.childCount(mn.off) != 0 {
+		return false
+	}
+	for _, n := range mn.nodes {
+		if !n.isLeaf() {
+			return false
+		}
+	}
+	return true
+}
+
+// mappedSearchFunc works like searchFunc over the trie and all the deltas
+// at once, a path found in several of them is passed to fn once
+func (t *MSTree) mappedSearchFunc(ctx context.Context, pattern string, fn func(path string, leaf bool) bool) error {
+	m, deltas := t.mappedSources()
+	root := &mergedNode{m: m, nodes: deltas}
+	if m != nil {
+		defer m.readers.Done()
+		root.off = m.root
+		root.inTrie = true
+	}
+	if !mergedSearch(ctx, root, "", strings.Split(pattern, "."), fn) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// mergedSearch returns false if the search is stopped by fn or ctx, only
+// children of a single path are merged at a time
+func mergedSearch(ctx context.Context, mn *mergedNode, prefix string, tokens []string, fn func(path string, leaf bool) bool) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	children := make(map[string]*mergedNode)
+	keys := make([]string, 0)
+	get := func(k string) *mergedNode {
+		child, ok := children[k]
+		if !ok {
+			child = &mergedNode{m: mn.m}
+			children[k] = child
+			keys = append(keys, k)
+		}
+		return child
+	}
+	if mn.inTrie {
+		mn.m.matchChildren(ctx, mn.off, tokens[0], func(k string, off uint64) {
+			child := get(k)
+			child.off = off
+			child.inTrie = true
+		})
+	}
+	for _, n := range mn.nodes {
+		for _, match := range n.matches(ctx, tokens[0]) {
+			child := get(match.token)
+			child.nodes = append(child.nodes, match.node)
+		}
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if (i+1)%SEARCH_CHECK_EVERY == 0 && ctx.Err() != nil {
+			return false
+		}
+		child := children[k]
+		path := trieJoin(prefix, k)
+		if len(tokens) == 1 {
+			if !fn(path, child.isLeaf()) {
+				return false
+			}
+		} else if !mergedSearch(ctx, child, path, tokens[1:], fn) {
+			return false
+		}
+	}
+	return ctx.Err() == nil
+}
+
+func (t *MSTree) countMapped(ctx context.Context, pattern string) (int64, int64, error) {
+	var leaves, branches int64
+	err := t.mappedSearchFunc(ctx, pattern, func(path string, leaf bool) bool {
+		if leaf {
+			leaves++
+		} else {
+			branches++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	return leaves, branches, nil
+}
+
+// completeMapped merges completions of the trie and all the deltas, it
+// stops early once ctx is done
+func (t *MSTree) completeMapped(ctx context.Context, prefix string, limit int) []Completion {
+	t.mappedLock.RLock()
+	sources := make([][]Completion, 0)
+	if t.mapped != nil {
+		sources = append(sources, t.mapped.complete(ctx, prefix, limit))
+	}
+	for _, delta := range t.frozen {
+		sources = append(sources, completeNode(ctx, delta, prefix, limit))
+	}
+	sources = append(sources, completeNode(ctx, t.Root, prefix, limit))
+	t.mappedLock.RUnlock()
+
+	merged := make(map[string]*Completion)
+	for _, source := range sources {
+		for _, c := range source {
+			path := strings.TrimSuffix(c.Path, ".")
+			prev, ok := merged[path]
+			if !ok {
+				c := c
+				merged[path] = &c
+				continue
+			}
+			prev.Leaf = prev.Leaf && c.Leaf
+			prev.Size += c.Size
+		}
+	}
+	paths := make([]string, 0, len(merged))
+	for path := range merged {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	if limit > 0 && len(paths) > limit {
+		paths = paths[:limit]
+	}
+	results := make([]Completion, len(paths))
+	for i, path := range paths {
+		c := merged[path]
+		c.Path = path
+		if !c.Leaf {
+			c.Path += "."
+		}
+		results[i] = *c
+	}
+	return results
+}
+
+// Dump writes all the metrics of the tree line by line. In the mapped
+// storage mode metrics of the trie come first, the ones added again since
+// the last merge are repeated.
+func (t *MSTree) Dump(w io.Writer) {
+	if t.storage != STORAGE_MAPPED {
+		t.Root.TraverseDump("", w)
+		return
+	}
+	m, deltas := t.mappedSources()
+	if m != nil {
+		defer m.readers.Done()
+		m.walk(m.root, "", func(path string) bool {
+			io.WriteString(w, path+"\n")
+			return true
+		})
+	}
+	for _, delta := range deltas {
+		if !delta.isLeaf() {
+			delta.TraverseDump("", w)
+		}
+	}
+}
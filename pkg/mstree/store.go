@@ -0,0 +1,198 @@
+package mstree
+
+import (
+	"fmt"
+	"time"
+)
+
+// Index stores persist the tree as subtrees of first level tokens, a store
+// works on a single index generation directory. The tree keeps generations,
+// write queues and compaction scheduling to itself: index writers append
+// through appenders of the store and a compaction takes a snapshot of the
+// subtree which the appender responsible for the token commits along with
+// whatever was appended meanwhile.
+//
+// The flat file store is the default, it keeps <token>.bidx snapshots and
+// <token>.idx files of metrics appended after them. The bolt store keeps a
+// bucket of metric tails per token in a single bbolt database, it never
+// needs compaction and has no files per token but writes are slower.
+
+const (
+	INDEX_STORE_FILES = "files"
+	INDEX_STORE_BOLT  = "bolt"
+)
+
+// IndexStore persists metrics of first level tokens
+type IndexStore interface {
+	// Tokens returns first level tokens having metrics stored
+	Tokens() ([]string, error)
+	// Load streams metrics of token into idxNode and returns the number
+	// of metrics inserted
+	Load(token string, idxNode *node, idx *tokenIndex) (int64, error)
+	// Appender returns an appender for a single index writer, it keeps no
+	// more than maxOpen tokens open
+	Appender(maxOpen int) IndexAppender
+	// Snapshot stores idxNode aside as the new contents of token, the
+	// appender responsible for the token commits it
+	Snapshot(token string, idxNode *node) (StoreSnapshot, error)
+	// Dump replaces the contents of token with idxNode right away, it's
+	// used while nothing is appended to the store
+	Dump(token string, idxNode *node) error
+	// Size returns the amount of data stored for token, compaction is
+	// scheduled by its growth
+	Size(token string) int64
+	// Drop closes the store and removes everything stored
+	Drop() error
+	Close() error
+}
+
+// IndexAppender appends metrics on behalf of a single index writer
+type IndexAppender interface {
+	// Append stores the tail of a metric of token
+	Append(token string, tail string) error
+	// Flush is called whenever the queue of the writer is empty
+	Flush()
+	// Sync makes everything appended so far durable
+	Sync()
+	// Commit replaces the contents of the snapshot's token with the
+	// snapshot followed by tails appended while it was being taken
+	Commit(s StoreSnapshot, recorded []string) error
+	Close()
+}
+
+// StoreSnapshot is the contents of a token stored aside until committed
+type StoreSnapshot interface {
+	Token() string
+}
+
+func (t *MSTree) openIndexStore(kind string, dir string) (IndexStore, error) {
+	switch kind {
+	case INDEX_STORE_FILES:
+		return &filesStore{t, dir}, nil
+	case INDEX_STORE_BOLT:
+		return newBoltStore(dir, t.log), nil
+	}
+	return nil, fmt.Errorf("unknown index store '%s'", kind)
+}
+
+// SetIndexStore sets the kind of store index files are kept in, it must be
+// called before LoadIndex. An index kept in another kind of store is
+// converted by LoadIndex.
+func (t *MSTree) SetIndexStore(kind string) error {
+	store, err := t.openIndexStore(kind, t.genDir)
+	if err != nil {
+		return err
+	}
+	t.writersLock.Lock()
+	defer t.writersLock.Unlock()
+	if t.writers != nil {
+		return fmt.Errorf("index writers are already started")
+	}
+	t.store.Close()
+	t.store = store
+	t.storeKind = kind
+	return nil
+}
+
+// foreignStore returns a store of another kind having metrics in the
+// current generation along with its tokens, nil if there's none
+func (t *MSTree) foreignStore() (IndexStore, []string, error) {
+	for _, kind := range []string{INDEX_STORE_FILES, INDEX_STORE_BOLT} {
+		if kind == t.storeKind {
+			continue
+		}
+		store, _ := t.openIndexStore(kind, t.genDir)
+		tokens, err := store.Tokens()
+		if err != nil {
+			store.Close()
+			return nil, nil, err
+		}
+		if len(tokens) > 0 {
+			t.log.Notice("Index is kept in %s store, converting to %s", kind, t.storeKind)
+			return store, tokens, nil
+		}
+		store.Close()
+	}
+	return nil, nil, nil
+}
+
+// convertStore dumps loaded tokens into the store of the tree and drops
+// the foreign store they've been loaded from
+func (t *MSTree) convertStore(foreign IndexStore, idxNodes []*node) error {
+	tm := time.Now()
+	for _, idxNode := range idxNodes {
+		if idxNode.isLeaf() {
+			continue
+		}
+		err := t.store.Dump(idxNode.token, idxNode)
+		if err != nil {
+			return err
+		}
+	}
+	err := foreign.Drop()
+	if err != nil {
+		return err
+	}
+	t.log.Notice("Index converted to %s store in %s", t.storeKind, time.Now().Sub(tm).String())
+	return nil
+}
+
+// pauseWriters blocks everything passing metrics to index writers and the
+// write-ahead log and waits for the writers to sync whatever is queued, so
+// the tree can be switched to another generation. Metrics are still
+// searchable as soon as they're added. resumeWriters undoes it.
+func (t *MSTree) pauseWriters() {
+	t.compactLock.Lock()
+	t.drainLock.Lock()
+	t.walLock.Lock()
+	t.writerBarrier().Wait()
+}
+
+func (t *MSTree) resumeWriters() {
+	t.walLock.Unlock()
+	t.drainLock.Unlock()
+	t.compactLock.Unlock()
+}
+
+// switchTo makes genDir the current generation and store the store of the
+// tree and then removes the previous generation. It must be called with
+// writers paused and genDir completely written. Index writers are stopped
+// and started again on store by the next metric, the write-ahead log and
+// overflow files continue in genDir.
+func (t *MSTree) switchTo(genDir string, store IndexStore) error {
+	t.writersLock.Lock()
+	defer t.writersLock.Unlock()
+	for _, iw := range t.writers {
+		close(iw.quit)
+		<-iw.done
+	}
+	t.writers = nil
+	if t.wal != nil {
+		err := t.wal.moveTo(genDir)
+		if err != nil {
+			return err
+		}
+	}
+	err := linkGeneration(t.indexDir, genDir)
+	if err != nil {
+		if t.wal != nil {
+			moveErr := t.wal.moveTo(t.genDir)
+			if moveErr != nil {
+				t.log.Error("Error moving WAL back to %s: %s", t.genDir, moveErr.Error())
+			}
+		}
+		return err
+	}
+	// metrics spilled to the previous generation are dumped into the new
+	// one along with the whole tree
+	err = t.overflow.rotate()
+	if err != nil {
+		t.log.Error("Error closing overflow file: %s", err.Error())
+	}
+	prevGenDir := t.genDir
+	t.genDir = genDir
+	t.store.Close()
+	t.store = store
+	removeGeneration(t.log, t.indexDir, prevGenDir)
+	return nil
+}
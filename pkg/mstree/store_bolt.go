@@ -0,0 +1,246 @@
+package mstree
+
+import (
+	"fmt"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// boltStore keeps the whole index generation in a single bbolt database,
+// every first level token is a bucket with metric tails as keys. The
+// database is opened on first use so a tree which never touches its index
+// doesn't hold the file lock.
+
+const (
+	BOLT_FILE = "index.db"
+	// appended tails are committed in transactions of at most that many
+	// or once the queue of the writer is empty
+	BOLT_BATCH_SIZE   = 10000
+	BOLT_OPEN_TIMEOUT = 10 * time.Second
+)
+
+type boltStore struct {
+	filename string
+	lock     *sync.Mutex
+	db       *bolt.DB
+	log      *packageLogger
+}
+
+type boltSnapshot struct {
+	token string
+}
+
+func (s *boltSnapshot) Token() string {
+	return s.token
+}
+
+func newBoltStore(dir string, log *packageLogger) *boltStore {
+	return &boltStore{fmt.Sprintf("%s/%s", dir, BOLT_FILE), new(sync.Mutex), nil, log}
+}
+
+// open returns the database opening it if necessary, it returns nil
+// without creating the file if there's none and create is false
+func (bs *boltStore) open(create bool) (*bolt.DB, error) {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	if bs.db != nil {
+		return bs.db, nil
+	}
+	if !create {
+		if _, err := os.Stat(bs.filename); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+	db, err := bolt.Open(bs.filename, os.FileMode(0644), &bolt.Options{Timeout: BOLT_OPEN_TIMEOUT})
+	if err != nil {
+		return nil, err
+	}
+	bs.db = db
+	return db, nil
+}
+
+func (bs *boltStore) Tokens() ([]string, error) {
+	db, err := bs.open(false)
+	if err != nil || db == nil {
+		return nil, err
+	}
+	tokens := make([]string, 0)
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			tokens = append(tokens, string(name))
+			return nil
+		})
+	})
+	return tokens, err
+}
+
+func (bs *boltStore) Load(indexToken string, idxNode *node, idx *tokenIndex) (int64, error) {
+	var count int64
+	db, err := bs.open(false)
+	if err != nil || db == nil {
+		return count, err
+	}
+	bs.log.Debug("<%s:%s> loader started", bs.filename, indexToken)
+	err = db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(indexToken))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			inserted := false
+			idxNode.insert(strings.Split(string(k), "."), &inserted, idx)
+			if inserted {
+				count++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		bs.log.Error("<%s:%s> loader finished with error: %s", bs.filename, indexToken, err.Error())
+		return count, err
+	}
+	bs.log.Debug("<%s:%s> loader finished", bs.filename, indexToken)
+	return count, nil
+}
+
+// Snapshot replaces the bucket of the token right away, tails appended
+// meanwhile are put again by Commit
+func (bs *boltStore) Snapshot(indexToken string, idxNode *node) (StoreSnapshot, error) {
+	err := bs.Dump(indexToken, idxNode)
+	if err != nil {
+		return nil, err
+	}
+	return &boltSnapshot{indexToken}, nil
+}
+
+func (bs *boltStore) Dump(indexToken string, idxNode *node) error {
+	db, err := bs.open(true)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		name := []byte(indexToken)
+		err := tx.DeleteBucket(name)
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		if idxNode.empty() {
+			// all the metrics of the token are deleted
+			return nil
+		}
+		b, err := tx.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		idxNode.walkLeaves("", func(tail string) bool {
+			if tail != "" {
+				err = b.Put([]byte(tail), []byte{})
+			}
+			return err == nil
+		})
+		return err
+	})
+}
+
+// Size is always 0 as the database never needs compaction
+func (bs *boltStore) Size(indexToken string) int64 {
+	return 0
+}
+
+func (bs *boltStore) Drop() error {
+	bs.Close()
+	err := os.Remove(bs.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (bs *boltStore) Close() error {
+	bs.lock.Lock()
+	defer bs.lock.Unlock()
+	if bs.db == nil {
+		return nil
+	}
+	err := bs.db.Close()
+	bs.db = nil
+	return err
+}
+
+func (bs *boltStore) Appender(maxOpen int) IndexAppender {
+	return &boltAppender{bs, make(map[string][]string), 0}
+}
+
+// boltAppender collects appended tails and puts them in a single
+// transaction, every commit is synced to disk by bbolt
+type boltAppender struct {
+	store   *boltStore
+	pending map[string][]string
+	count   int
+}
+
+func (ba *boltAppender) Append(indexToken string, tail string) error {
+	ba.pending[indexToken] = append(ba.pending[indexToken], tail)
+	ba.count++
+	if ba.count >= BOLT_BATCH_SIZE {
+		return ba.commit()
+	}
+	return nil
+}
+
+func (ba *boltAppender) commit() error {
+	if ba.count == 0 {
+		return nil
+	}
+	pending := ba.pending
+	ba.pending = make(map[string][]string)
+	ba.count = 0
+	db, err := ba.store.open(true)
+	if err != nil {
+		return err
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		for token, tails := range pending {
+			b, err := tx.CreateBucketIfNotExists([]byte(token))
+			if err != nil {
+				return err
+			}
+			for _, tail := range tails {
+				err = b.Put([]byte(tail), []byte{})
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (ba *boltAppender) Flush() {
+	err := ba.commit()
+	if err != nil {
+		ba.store.log.Error("Error writing %s: %s", ba.store.filename, err.Error())
+	}
+}
+
+func (ba *boltAppender) Sync() {
+	ba.Flush()
+}
+
+func (ba *boltAppender) Commit(s StoreSnapshot, recorded []string) error {
+	ba.Flush()
+	if len(recorded) == 0 {
+		return nil
+	}
+	ba.pending[s.Token()] = recorded
+	ba.count = len(recorded)
+	return ba.commit()
+}
+
+func (ba *boltAppender) Close() {
+	ba.Flush()
+}
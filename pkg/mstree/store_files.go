@@ -0,0 +1,415 @@
+package mstree
+
+import (
+	"compress/gzip"
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// filesStore keeps every first level token in a <token>.bidx (or text
+// <token>.idx) dump and a text <token>.idx file of metrics appended since
+// the dump. Format and compression of new files are those of the tree.
+type filesStore struct {
+	tree *MSTree
+	dir  string
+}
+
+type fileSnapshot struct {
+	token        string
+	tmpFile      string
+	snapshotFile string
+	compression  string
+	// empty snapshots of deleted tokens remove their files unless
+	// something is appended meanwhile
+	empty bool
+}
+
+func (s *fileSnapshot) Token() string {
+	return s.token
+}
+
+func (fs *filesStore) idxFilename(indexToken string) string {
+	return fmt.Sprintf("%s/%s.idx", fs.dir, indexToken)
+}
+
+func (fs *filesStore) Tokens() ([]string, error) {
+	files, err := ioutil.ReadDir(fs.dir)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	tokens := make([]string, 0)
+	for _, file := range files {
+		fName := file.Name()
+		var token string
+		if strings.HasSuffix(fName, ".idx") {
+			token = fName[:len(fName)-4]
+		} else if strings.HasSuffix(fName, SNAPSHOT_SUFFIX) {
+			token = fName[:len(fName)-len(SNAPSHOT_SUFFIX)]
+		} else {
+			continue
+		}
+		if !seen[token] {
+			seen[token] = true
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Strings(tokens)
+	return tokens, nil
+}
+
+// Load loads the binary snapshot of the token if any and then the text
+// index file with the metrics appended after it. Corrupt files are moved to
+// quarantine, a text file is then rewritten from whatever could be loaded.
+func (fs *filesStore) Load(indexToken string, idxNode *node, idx *tokenIndex) (int64, error) {
+	var count int64
+	snapshotFile := fmt.Sprintf("%s/%s%s", fs.dir, indexToken, SNAPSHOT_SUFFIX)
+	if _, err := os.Stat(snapshotFile); err == nil {
+		fs.tree.log.Debug("<%s> loader started", snapshotFile)
+		loaded, err := readSnapshot(snapshotFile, idxNode, idx)
+		count += loaded
+		if err != nil {
+			fs.tree.log.Error("<%s> loader finished with error: %s", snapshotFile, err.Error())
+			if !isCorruption(err) {
+				return count, err
+			}
+			fs.tree.quarantine(snapshotFile, err.Error())
+		} else {
+			fs.tree.log.Debug("<%s> loader finished", snapshotFile)
+		}
+	}
+	idxFile := fs.idxFilename(indexToken)
+	if _, err := os.Stat(idxFile); err != nil {
+		return count, nil
+	}
+	fs.tree.log.Debug("<%s> loader started", idxFile)
+	damaged, err := loadIdxFile(idxFile, idxNode, &count, idx)
+	if err != nil && !isCorruption(err) {
+		fs.tree.log.Error("<%s> loader finished with error: %s", idxFile, err.Error())
+		return count, err
+	}
+	if err != nil || damaged > 0 {
+		reason := fmt.Sprintf("%d damaged records skipped", damaged)
+		if err != nil {
+			reason = err.Error()
+		}
+		fs.tree.log.Error("<%s> loader finished with error: %s", idxFile, reason)
+		fs.tree.quarantine(idxFile, reason)
+		err = fs.rewrite(indexToken, idxNode)
+		if err != nil {
+			fs.tree.log.Error("Error rewriting index for %s: %s", indexToken, err.Error())
+		}
+		return count, nil
+	}
+	fs.tree.log.Debug("<%s> loader finished", idxFile)
+	return count, nil
+}
+
+// rewrite replaces index files of a first level token with a dump of
+// whatever was loaded into memory, used after the text index file has been
+// quarantined
+func (fs *filesStore) rewrite(indexToken string, idxNode *node) error {
+	t := fs.tree
+	err := dumpFile(t.dumpFilename(fs.dir, indexToken), idxNode, t.indexFormat, t.compression)
+	if err != nil {
+		return err
+	}
+	if t.indexFormat == INDEX_FORMAT_BINARY {
+		// start the text file over so it has a proper header
+		idxFile := fs.idxFilename(indexToken)
+		f, err := os.Create(idxFile + TMP_SUFFIX)
+		if err != nil {
+			return err
+		}
+		err = appendIdxRecords(f, t.compression == COMPRESSION_GZIP, true, nil)
+		if err == nil {
+			err = f.Sync()
+		}
+		f.Close()
+		if err != nil {
+			return err
+		}
+		return os.Rename(idxFile+TMP_SUFFIX, idxFile)
+	}
+	return nil
+}
+
+// Snapshot dumps idxNode into a temporary file. When it's committed in the
+// binary format it replaces the .bidx file and the index file starts over
+// with the appended metrics only, otherwise it's completed with them and
+// replaces the index file.
+func (fs *filesStore) Snapshot(indexToken string, idxNode *node) (StoreSnapshot, error) {
+	t := fs.tree
+	dumpName := t.dumpFilename(fs.dir, indexToken)
+	s := &fileSnapshot{indexToken, dumpName + TMP_SUFFIX, "", t.compression, idxNode.empty()}
+	if t.indexFormat == INDEX_FORMAT_BINARY {
+		s.snapshotFile = dumpName
+	}
+	err := dumpTmpFile(s.tmpFile, idxNode, t.indexFormat, t.compression)
+	if err != nil {
+		os.Remove(s.tmpFile)
+		return nil, err
+	}
+	return s, nil
+}
+
+func (fs *filesStore) Dump(indexToken string, idxNode *node) error {
+	idxFile := fs.tree.dumpFilename(fs.dir, indexToken)
+	err := dumpFile(idxFile, idxNode, fs.tree.indexFormat, fs.tree.compression)
+	if err != nil {
+		os.Remove(idxFile + TMP_SUFFIX)
+	}
+	return err
+}
+
+func (fs *filesStore) Size(indexToken string) int64 {
+	stat, err := os.Stat(fs.idxFilename(indexToken))
+	if err != nil {
+		return -1
+	}
+	return stat.Size()
+}
+
+// remove gets rid of the files of the token of an empty snapshot
+func (fs *filesStore) remove(s *fileSnapshot) error {
+	for _, filename := range []string{s.tmpFile, fs.idxFilename(s.token), fmt.Sprintf("%s/%s%s", fs.dir, s.token, SNAPSHOT_SUFFIX)} {
+		err := os.Remove(filename)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *filesStore) Drop() error {
+	tokens, err := fs.Tokens()
+	if err != nil {
+		return err
+	}
+	for _, token := range tokens {
+		for _, filename := range []string{fs.idxFilename(token), fmt.Sprintf("%s/%s%s", fs.dir, token, SNAPSHOT_SUFFIX)} {
+			err = os.Remove(filename)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (fs *filesStore) Close() error {
+	return nil
+}
+
+func (fs *filesStore) Appender(maxOpen int) IndexAppender {
+	return &filesAppender{
+		store:       fs,
+		compression: fs.tree.compression,
+		maxOpen:     maxOpen,
+		files:       make(map[string]*list.Element),
+		lru:         list.New(),
+		pending:     make([]*openIdxFile, 0),
+	}
+}
+
+type openIdxFile struct {
+	token      string
+	f          *os.File
+	dirty      bool
+	compressed bool
+	// gz writes the current gzip member of a compressed file, member is
+	// true while it has records not flushed to the file yet
+	gz     *gzip.Writer
+	member bool
+}
+
+// filesAppender keeps at most maxOpen index files open closing the least
+// recently used one when it needs another, so a flood of distinct first
+// level tokens costs no file descriptors
+type filesAppender struct {
+	store       *filesStore
+	compression string
+	maxOpen     int
+	files       map[string]*list.Element
+	lru         *list.List
+	// files with unfinished gzip members
+	pending []*openIdxFile
+}
+
+// closeFile syncs and closes the index file of indexToken if it's open
+func (fa *filesAppender) closeFile(indexToken string) {
+	e, ok := fa.files[indexToken]
+	if !ok {
+		return
+	}
+	of := e.Value.(*openIdxFile)
+	fa.flushMember(of)
+	if of.dirty {
+		err := of.f.Sync()
+		if err != nil {
+			fa.store.tree.log.Error("Error syncing %s: %s", of.f.Name(), err.Error())
+		}
+	}
+	of.f.Close()
+	fa.lru.Remove(e)
+	delete(fa.files, indexToken)
+}
+
+func (fa *filesAppender) addFile(indexToken string, f *os.File, compressed bool) *openIdxFile {
+	for fa.lru.Len() >= fa.maxOpen {
+		fa.closeFile(fa.lru.Back().Value.(*openIdxFile).token)
+	}
+	of := &openIdxFile{indexToken, f, false, compressed, nil, false}
+	fa.files[indexToken] = fa.lru.PushFront(of)
+	return of
+}
+
+// file returns the open index file of indexToken opening it if necessary
+func (fa *filesAppender) file(indexToken string) (*openIdxFile, error) {
+	if e, ok := fa.files[indexToken]; ok {
+		fa.lru.MoveToFront(e)
+		return e.Value.(*openIdxFile), nil
+	}
+	idxFilename := fa.store.idxFilename(indexToken)
+	compressed, err := isCompressed(idxFilename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(idxFilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0644))
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err == nil && stat.Size() == 0 {
+		compressed = fa.compression == COMPRESSION_GZIP
+		err = appendIdxRecords(f, compressed, true, nil)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return fa.addFile(indexToken, f, compressed), nil
+}
+
+func (fa *filesAppender) write(of *openIdxFile, line string) error {
+	if !of.compressed {
+		return writeIdxRecord(of.f, line)
+	}
+	if !of.member {
+		if of.gz == nil {
+			of.gz = gzip.NewWriter(of.f)
+		} else {
+			of.gz.Reset(of.f)
+		}
+		of.member = true
+		fa.pending = append(fa.pending, of)
+	}
+	return writeIdxRecord(of.gz, line)
+}
+
+func (fa *filesAppender) flushMember(of *openIdxFile) {
+	if !of.member {
+		return
+	}
+	err := of.gz.Close()
+	if err != nil {
+		fa.store.tree.log.Error("Error writing %s: %s", of.f.Name(), err.Error())
+	}
+	of.member = false
+}
+
+func (fa *filesAppender) Append(indexToken string, line string) error {
+	of, err := fa.file(indexToken)
+	if err != nil {
+		return fmt.Errorf("error opening %s for writing: %s", fa.store.idxFilename(indexToken), err.Error())
+	}
+	err = fa.write(of, line)
+	if err != nil {
+		return err
+	}
+	of.dirty = true
+	return nil
+}
+
+// Flush finishes all the gzip members being written so compressed records
+// get to files in batches
+func (fa *filesAppender) Flush() {
+	for _, of := range fa.pending {
+		fa.flushMember(of)
+	}
+	fa.pending = fa.pending[:0]
+}
+
+func (fa *filesAppender) Sync() {
+	fa.Flush()
+	for _, e := range fa.files {
+		of := e.Value.(*openIdxFile)
+		if !of.dirty {
+			continue
+		}
+		err := of.f.Sync()
+		if err != nil {
+			fa.store.tree.log.Error("Error syncing %s: %s", of.f.Name(), err.Error())
+		}
+		of.dirty = false
+	}
+}
+
+func (fa *filesAppender) Commit(ss StoreSnapshot, recorded []string) error {
+	s := ss.(*fileSnapshot)
+	// the old file is replaced, nothing in it matters anymore
+	fa.closeFile(s.token)
+	if s.empty && len(recorded) == 0 {
+		return fa.store.remove(s)
+	}
+	nf, err := finishSnapshot(fa.store.idxFilename(s.token), s, recorded)
+	if err != nil {
+		os.Remove(s.tmpFile)
+		return err
+	}
+	fa.addFile(s.token, nf, s.compression == COMPRESSION_GZIP)
+	return nil
+}
+
+func (fa *filesAppender) Close() {
+	for token := range fa.files {
+		fa.closeFile(token)
+	}
+}
+
+func finishSnapshot(idxFilename string, s *fileSnapshot, recorded []string) (*os.File, error) {
+	var f *os.File
+	var err error
+	if s.snapshotFile != "" {
+		f, err = os.OpenFile(idxFilename+TMP_SUFFIX, os.O_APPEND|os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(0644))
+	} else {
+		f, err = os.OpenFile(s.tmpFile, os.O_APPEND|os.O_WRONLY, os.FileMode(0644))
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = appendIdxRecords(f, s.compression == COMPRESSION_GZIP, s.snapshotFile != "", recorded)
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil && s.snapshotFile != "" {
+		// a crash between renames leaves the new snapshot with the old
+		// index file which is only redundant
+		err = os.Rename(s.tmpFile, s.snapshotFile)
+		if err == nil {
+			err = os.Rename(idxFilename+TMP_SUFFIX, idxFilename)
+		}
+	} else if err == nil {
+		err = os.Rename(s.tmpFile, idxFilename)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(idxFilename + TMP_SUFFIX)
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,381 @@
+package mstree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The write-ahead log keeps every metric added with Add before it's passed
+// to the index writers which don't fsync their files. Records are written
+// in batches by a single committer goroutine so concurrent adds waiting for
+// durability share one fsync. The log is split into segments, all but the
+// current one are removed on checkpoint when index writers have synced
+// everything logged in them.
+
+const (
+	WAL_FSYNC_ALWAYS   = "always"
+	WAL_FSYNC_INTERVAL = "interval"
+	WAL_FSYNC_NEVER    = "never"
+
+	WAL_PREFIX          = "wal-"
+	WAL_SUFFIX          = ".log"
+	WAL_CHECKPOINT_SIZE = 64 * 1024 * 1024
+)
+
+var (
+	ErrWALDisabled = errors.New("write-ahead log is disabled")
+)
+
+type writeAheadLog struct {
+	dir      string
+	policy   string
+	interval time.Duration
+	lock     *sync.Mutex
+	cond     *sync.Cond
+	// commitLock serializes commits and segment rotation
+	commitLock *sync.Mutex
+	f          *os.File
+	segment    string
+	size       int64
+	buf        *bytes.Buffer
+	appended   uint64
+	synced     uint64
+	syncWanted uint64
+	failedUpTo uint64
+	lastErr    error
+	kick       chan bool
+	quit       chan bool
+	onFull     func()
+	full       int32
+	log        *packageLogger
+}
+
+func isWALSegment(fName string) bool {
+	return strings.HasPrefix(fName, WAL_PREFIX) && strings.HasSuffix(fName, WAL_SUFFIX)
+}
+
+// walSegments returns full names of WAL segments in dir, oldest first
+func walSegments(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]string, 0)
+	for _, file := range files {
+		if isWALSegment(file.Name()) {
+			segments = append(segments, filepath.Join(dir, file.Name()))
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+func openWALSegment(dir string) (*os.File, string, error) {
+	segment := filepath.Join(dir, fmt.Sprintf("%s%020d%s", WAL_PREFIX, time.Now().UnixNano(), WAL_SUFFIX))
+	f, err := os.OpenFile(segment, os.O_APPEND|os.O_CREATE|os.O_WRONLY, os.FileMode(0644))
+	if err != nil {
+		return nil, "", err
+	}
+	err = syncDir(dir)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	return f, segment, nil
+}
+
+func newWAL(dir string, policy string, interval time.Duration, onFull func(), log *packageLogger) (*writeAheadLog, error) {
+	if policy != WAL_FSYNC_ALWAYS && policy != WAL_FSYNC_INTERVAL && policy != WAL_FSYNC_NEVER {
+		return nil, fmt.Errorf("unknown WAL fsync policy '%s'", policy)
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid WAL fsync interval %s", interval.String())
+	}
+	f, segment, err := openWALSegment(dir)
+	if err != nil {
+		return nil, err
+	}
+	lock := new(sync.Mutex)
+	w := &writeAheadLog{
+		dir:        dir,
+		policy:     policy,
+		interval:   interval,
+		lock:       lock,
+		cond:       sync.NewCond(lock),
+		commitLock: new(sync.Mutex),
+		f:          f,
+		segment:    segment,
+		buf:        new(bytes.Buffer),
+		kick:       make(chan bool, 1),
+		quit:       make(chan bool),
+		onFull:     onFull,
+		log:        log,
+	}
+	go w.committer()
+	return w, nil
+}
+
+func (w *writeAheadLog) wake() {
+	select {
+	case w.kick <- true:
+	default:
+	}
+}
+
+// Append adds a record to the log and returns its sequence number
+func (w *writeAheadLog) Append(metric string) uint64 {
+	w.lock.Lock()
+	writeIdxRecord(w.buf, metric)
+	w.appended++
+	seq := w.appended
+	w.lock.Unlock()
+	if w.policy == WAL_FSYNC_ALWAYS {
+		w.wake()
+	}
+	return seq
+}
+
+func (w *writeAheadLog) LastSeq() uint64 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.appended
+}
+
+// WaitDurable blocks until the record seq is synced to disk or ctx is
+// done. The record is synced anyway, ctx only limits the wait.
+func (w *writeAheadLog) WaitDurable(ctx context.Context, seq uint64) error {
+	w.lock.Lock()
+	if w.syncWanted < seq {
+		w.syncWanted = seq
+	}
+	w.lock.Unlock()
+	w.wake()
+
+	// waiters are woken up to see ctx done, the broadcast can't get in
+	// between checking ctx and waiting as it takes the lock
+	stop := context.AfterFunc(ctx, func() {
+		w.lock.Lock()
+		w.cond.Broadcast()
+		w.lock.Unlock()
+	})
+	defer stop()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for w.synced < seq {
+		if w.failedUpTo >= seq {
+			return w.lastErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		w.cond.Wait()
+	}
+	return nil
+}
+
+func (w *writeAheadLog) committer() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.kick:
+		case <-ticker.C:
+		case <-w.quit:
+			return
+		}
+		w.commit(false)
+	}
+}
+
+// close stops the committer and closes the current segment once
+// everything appended is synced
+func (w *writeAheadLog) close() {
+	close(w.quit)
+	w.commit(true)
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
+	w.f.Close()
+}
+
+// commit writes all the pending records and syncs them if the policy or
+// anybody waiting for durability requires that
+func (w *writeAheadLog) commit(forceSync bool) {
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
+
+	w.lock.Lock()
+	data := w.buf
+	last := w.appended
+	needSync := forceSync || w.policy != WAL_FSYNC_NEVER || w.syncWanted > w.synced
+	if data.Len() == 0 && (!needSync || w.synced == last) {
+		w.lock.Unlock()
+		return
+	}
+	w.buf = new(bytes.Buffer)
+	w.lock.Unlock()
+
+	_, err := w.f.Write(data.Bytes())
+	if err == nil && needSync {
+		err = w.f.Sync()
+	}
+
+	w.lock.Lock()
+	w.size += int64(data.Len())
+	if err != nil {
+		w.log.Error("Error writing WAL segment %s: %s", w.segment, err.Error())
+		w.failedUpTo = last
+		w.lastErr = err
+	} else if needSync {
+		w.synced = last
+	}
+	size := w.size
+	w.cond.Broadcast()
+	w.lock.Unlock()
+
+	if size > WAL_CHECKPOINT_SIZE && w.onFull != nil && atomic.CompareAndSwapInt32(&w.full, 0, 1) {
+		go func() {
+			w.onFull()
+			atomic.StoreInt32(&w.full, 0)
+		}()
+	}
+}
+
+// openSegment starts a new segment in dir closing the current one, it must
+// be called with commitLock held
+func (w *writeAheadLog) openSegment(dir string) error {
+	f, segment, err := openWALSegment(dir)
+	if err != nil {
+		return err
+	}
+	w.f.Close()
+	w.lock.Lock()
+	w.dir = dir
+	w.f = f
+	w.segment = segment
+	w.size = 0
+	w.lock.Unlock()
+	return nil
+}
+
+// rotate syncs the current segment and starts a new one. It returns the
+// segments preceding the new one.
+func (w *writeAheadLog) rotate() ([]string, error) {
+	w.commit(true)
+
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
+	err := w.openSegment(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := walSegments(w.dir)
+	if err != nil {
+		return nil, err
+	}
+	old := make([]string, 0, len(segments))
+	for _, s := range segments {
+		if s != w.segment {
+			old = append(old, s)
+		}
+	}
+	return old, nil
+}
+
+// moveTo syncs the current segment and continues the log in a new segment
+// in dir, segments left in the previous directory are not needed once
+// everything logged is synced to index files
+func (w *writeAheadLog) moveTo(dir string) error {
+	w.commit(true)
+
+	w.commitLock.Lock()
+	defer w.commitLock.Unlock()
+	return w.openSegment(dir)
+}
+
+// replayWAL adds metrics logged in WAL segments of the current generation
+// and passes them to index writers again, the segments are removed on the
+// next checkpoint. A segment is replayed up to the first damaged record,
+// typically the torn last one.
+func (t *MSTree) replayWAL() error {
+	segments, err := walSegments(t.genDir)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		replayed := 0
+		damaged, err := readLogRecords(segment, func(metric string) {
+			if t.AddNoSync(metric) {
+				replayed++
+				t.enqueue(metric)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if damaged > 0 {
+			t.log.Error("%d records from the first damaged one skipped replaying %s", damaged, segment)
+		}
+		t.log.Notice("%d metrics replayed from %s", replayed, segment)
+	}
+	return nil
+}
+
+// walCheckpoint makes sure everything logged in WAL so far is synced to
+// index files and removes the segments no longer needed
+func (t *MSTree) walCheckpoint() {
+	tm := time.Now()
+	// no Add can be between logging and passing a metric to writers
+	t.walLock.Lock()
+	old, err := t.wal.rotate()
+	if err != nil {
+		t.walLock.Unlock()
+		t.log.Error("Error rotating WAL: %s", err.Error())
+		return
+	}
+	barrier := t.writerBarrier()
+	t.walLock.Unlock()
+
+	barrier.Wait()
+	// metrics spilled instead of being queued are logged in WAL as well
+	err = t.overflow.sync()
+	if err != nil {
+		t.log.Error("Error syncing overflow file: %s", err.Error())
+		return
+	}
+	for _, segment := range old {
+		err = os.Remove(segment)
+		// the segments are gone if the tree has been switched to another
+		// generation meanwhile
+		if err != nil && !os.IsNotExist(err) {
+			t.log.Error("Error removing WAL segment %s: %s", segment, err.Error())
+		}
+	}
+	t.log.Info("WAL checkpoint complete in %s", time.Now().Sub(tm).String())
+}
+
+// StartWAL enables the write-ahead log for metrics added with Add. It
+// should be called after LoadIndex.
+func (t *MSTree) StartWAL(policy string, interval time.Duration) error {
+	if !t.enableSync {
+		return ErrWALDisabled
+	}
+	wal, err := newWAL(t.genDir, policy, interval, t.walCheckpoint, t.log)
+	if err != nil {
+		return err
+	}
+	t.wal = wal
+	t.log.Notice("Write-ahead log started, fsync policy: %s, interval: %s", policy, interval.String())
+	// get rid of the segments replayed on load
+	t.walCheckpoint()
+	return nil
+}
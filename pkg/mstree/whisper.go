@@ -0,0 +1,102 @@
+package mstree
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	WHISPER_SUFFIX = ".wsp"
+)
+
+// whisperMetric converts a path relative to the whisper root into a metric
+// name, i.e. a/b/c.wsp into a.b.c
+func whisperMetric(rel string) string {
+	rel = strings.TrimSuffix(rel, WHISPER_SUFFIX)
+	return strings.Replace(filepath.ToSlash(rel), "/", ".", -1)
+}
+
+// walkWhisper adds metrics of .wsp files found under dir modified after
+// since, a zero since means all of them
+func (t *MSTree) walkWhisper(root string, dir string, since time.Time, found *int64) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			t.log.Error("Error reading %s: %s", path, err.Error())
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !strings.HasSuffix(info.Name(), WHISPER_SUFFIX) {
+			return nil
+		}
+		if !since.IsZero() && info.ModTime().Before(since) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		t.add(whisperMetric(rel), true)
+		count := atomic.AddInt64(found, 1)
+		if count%1000000 == 0 {
+			t.log.Info("Imported %d whisper files", count)
+		}
+		return nil
+	})
+}
+
+// ImportWhisper adds metrics of all the .wsp files under the whisper
+// storage directory root modified after since (zero for all of them) the
+// same way Add does, so they're logged to WAL and synced to index files by
+// the index writers. Subdirectories are walked in parallel. It returns the
+// number of whisper files imported once the new metrics are synced.
+func (t *MSTree) ImportWhisper(root string, since time.Time) (int64, error) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		return 0, err
+	}
+	tm := time.Now()
+	var found int64
+	var globalErr error = nil
+	errLock := new(sync.Mutex)
+	sem := make(chan bool, runtime.GOMAXPROCS(0))
+	wg := new(sync.WaitGroup)
+	for _, entry := range entries {
+		path := filepath.Join(root, entry.Name())
+		if !entry.IsDir() {
+			err = t.walkWhisper(root, path, since, &found)
+			if err != nil {
+				globalErr = err
+			}
+			continue
+		}
+		wg.Add(1)
+		sem <- true
+		go func(dir string) {
+			defer wg.Done()
+			err := t.walkWhisper(root, dir, since, &found)
+			<-sem
+			if err != nil {
+				errLock.Lock()
+				globalErr = err
+				errLock.Unlock()
+			}
+		}(path)
+	}
+	wg.Wait()
+	if globalErr != nil {
+		return found, globalErr
+	}
+	if t.enableSync {
+		t.writerBarrier().Wait()
+	}
+	t.log.Info("Imported %d whisper files in %s", found, time.Now().Sub(tm).String())
+	return found, nil
+}
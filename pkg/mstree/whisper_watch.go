@@ -0,0 +1,278 @@
+package mstree
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A whisper watcher follows a whisper storage root adding metrics of newly
+// created files and deleting metrics of removed ones as the notifier
+// reports them. A periodic full rescan catches whatever the notifier has
+// missed. Only metrics seen as files by the watcher are ever deleted,
+// metrics added otherwise stay in the tree. Deletions get to disk by
+// compacting the affected index files after each rescan.
+
+// whisperEvent is a change under the whisper root reported by a notifier
+type whisperEvent struct {
+	path    string
+	dir     bool
+	created bool
+	// overflow means events were lost and a rescan is needed
+	overflow bool
+}
+
+// notifier reports changes in watched directories, a notifier without
+// events support just returns a nil channel
+type notifier interface {
+	watch(dir string) error
+	events() <-chan whisperEvent
+	close()
+}
+
+// pollNotifier reports no events, a watcher using it relies on rescans
+// only
+type pollNotifier struct{}
+
+func (pollNotifier) watch(dir string) error {
+	return nil
+}
+
+func (pollNotifier) events() <-chan whisperEvent {
+	return nil
+}
+
+func (pollNotifier) close() {}
+
+type whisperWatcher struct {
+	tree   *MSTree
+	root   string
+	notify notifier
+	// known metrics are the ones seen as files under root
+	known map[string]bool
+	// deleted are first level tokens with metrics deleted since the last
+	// compaction
+	deleted map[string]bool
+}
+
+var errWatcherStopped = errors.New("whisper watcher stopped")
+
+func (w *whisperWatcher) metric(path string) (string, bool) {
+	if !strings.HasSuffix(path, WHISPER_SUFFIX) {
+		return "", false
+	}
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return whisperMetric(rel), true
+}
+
+func (w *whisperWatcher) add(metric string) {
+	w.known[metric] = true
+	w.tree.Add(metric)
+}
+
+func (w *whisperWatcher) remove(metric string) {
+	delete(w.known, metric)
+	if removed, _ := w.tree.Delete(metric); removed {
+		w.deleted[strings.SplitN(metric, ".", 2)[0]] = true
+		w.tree.log.Debug("Metric '%s' deleted by whisper watcher", metric)
+	}
+}
+
+// scan watches dir and its subdirectories and adds metrics of the files
+// found there, seen collects the metrics if not nil
+func (w *whisperWatcher) scan(dir string, seen map[string]bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		select {
+		case <-w.tree.stop:
+			return errWatcherStopped
+		default:
+		}
+		if err != nil {
+			w.tree.log.Error("Error reading %s: %s", path, err.Error())
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			err = w.notify.watch(path)
+			if err != nil {
+				w.tree.log.Error("Error watching %s: %s", path, err.Error())
+			}
+			return nil
+		}
+		metric, ok := w.metric(path)
+		if !ok {
+			return nil
+		}
+		if seen != nil {
+			seen[metric] = true
+		}
+		if !w.known[metric] {
+			w.add(metric)
+		}
+		return nil
+	})
+}
+
+// rescan walks the whole root, adds the metrics missing and deletes the
+// known ones whose files are gone
+func (w *whisperWatcher) rescan() error {
+	tm := time.Now()
+	seen := make(map[string]bool)
+	err := w.scan(w.root, seen)
+	if err != nil {
+		return err
+	}
+	for metric := range w.known {
+		if !seen[metric] {
+			w.remove(metric)
+		}
+	}
+	w.tree.log.Info("Whisper rescan of %s complete in %s, %d metrics", w.root, time.Now().Sub(tm).String(), len(seen))
+	w.persist()
+	return nil
+}
+
+// removeDir deletes known metrics of a directory removed or moved away,
+// no events are reported for its files
+func (w *whisperWatcher) removeDir(path string) {
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil {
+		return
+	}
+	prefix := whisperMetric(rel) + "."
+	for metric := range w.known {
+		if strings.HasPrefix(metric, prefix) {
+			w.remove(metric)
+		}
+	}
+}
+
+func (w *whisperWatcher) handle(ev whisperEvent) error {
+	if ev.overflow {
+		w.tree.log.Notice("Whisper watcher has lost events, rescanning")
+		return w.rescan()
+	}
+	if ev.dir {
+		if ev.created {
+			return w.scan(ev.path, nil)
+		}
+		w.removeDir(ev.path)
+		return nil
+	}
+	metric, ok := w.metric(ev.path)
+	if !ok {
+		return nil
+	}
+	if ev.created {
+		w.add(metric)
+	} else {
+		w.remove(metric)
+	}
+	return nil
+}
+
+// persist compacts index files of the tokens with deleted metrics
+func (w *whisperWatcher) persist() {
+	if len(w.deleted) == 0 || !w.tree.enableSync {
+		w.deleted = make(map[string]bool)
+		return
+	}
+	t := w.tree
+	// metrics queued before deletion must not be recorded by compaction
+	t.writerBarrier().Wait()
+	t.compactLock.Lock()
+	for token := range w.deleted {
+		err := t.compactToken(token)
+		if err != nil {
+			w.tree.log.Error("Error compacting %s.idx: %s", token, err.Error())
+		}
+	}
+	t.compactLock.Unlock()
+	if t.wal != nil {
+		// deleted metrics must not be replayed from WAL
+		t.walCheckpoint()
+	}
+	w.deleted = make(map[string]bool)
+}
+
+func (w *whisperWatcher) run(rescan time.Duration) {
+	defer w.tree.watchers.Done()
+	defer w.notify.close()
+
+	events := w.notify.events()
+	var tick <-chan time.Time
+	if rescan > 0 {
+		ticker := time.NewTicker(rescan)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		var err error
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				w.tree.log.Error("Whisper watcher lost file events, relying on rescans")
+				events = nil
+				continue
+			}
+			err = w.handle(ev)
+		case <-tick:
+			err = w.rescan()
+		case <-w.tree.stop:
+			return
+		}
+		if err == errWatcherStopped {
+			return
+		}
+		if err != nil {
+			w.tree.log.Error("Whisper watcher error: %s", err.Error())
+		}
+	}
+}
+
+// WatchWhisper follows the whisper storage directory root adding metrics of
+// new .wsp files and deleting metrics of removed ones, the whole root is
+// rescanned every rescan interval (never if zero). Where file events aren't
+// supported the watcher relies on rescans only. It should be called after
+// LoadIndex, the initial scan is done before it returns. The mapped storage
+// mode can't delete metrics, so it isn't supported there.
+func (t *MSTree) WatchWhisper(root string, rescan time.Duration) error {
+	if t.storage == STORAGE_MAPPED {
+		return ErrNotSupported
+	}
+	stat, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("'%s' is not a directory", root)
+	}
+	n, err := newNotifier(t.log)
+	if err != nil {
+		return err
+	}
+	w := &whisperWatcher{
+		tree:    t,
+		root:    filepath.Clean(root),
+		notify:  n,
+		known:   make(map[string]bool),
+		deleted: make(map[string]bool),
+	}
+	err = w.rescan()
+	if err != nil {
+		n.close()
+		return err
+	}
+	t.log.Notice("Watching whisper storage %s, rescan interval %s", root, rescan.String())
+	t.watchers.Add(1)
+	go w.run(rescan)
+	return nil
+}
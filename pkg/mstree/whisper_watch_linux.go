@@ -0,0 +1,122 @@
+package mstree
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	INOTIFY_MASK = syscall.IN_CREATE | syscall.IN_MOVED_TO | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_ONLYDIR
+)
+
+type inotifyNotifier struct {
+	f    *os.File
+	fd   int
+	lock *sync.Mutex
+	dirs map[int]string
+	ch   chan whisperEvent
+	quit chan bool
+	log  *packageLogger
+}
+
+func newNotifier(log *packageLogger) (notifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// a non-blocking descriptor goes through the runtime poller, closing
+	// the file interrupts a pending read
+	n := &inotifyNotifier{
+		f:    os.NewFile(uintptr(fd), "inotify"),
+		fd:   fd,
+		lock: new(sync.Mutex),
+		dirs: make(map[int]string),
+		ch:   make(chan whisperEvent, 1024),
+		quit: make(chan bool),
+		log:  log,
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) watch(dir string) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	// IN_ONLYDIR is not a part of events, the mask makes it a watch flag
+	wd, err := syscall.InotifyAddWatch(n.fd, dir, INOTIFY_MASK)
+	if err != nil {
+		return os.NewSyscallError("inotify_add_watch", err)
+	}
+	n.dirs[wd] = dir
+	return nil
+}
+
+func (n *inotifyNotifier) events() <-chan whisperEvent {
+	return n.ch
+}
+
+func (n *inotifyNotifier) close() {
+	close(n.quit)
+	n.f.Close()
+}
+
+func (n *inotifyNotifier) event(wd int, mask uint32, name string) (whisperEvent, bool) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return whisperEvent{overflow: true}, true
+	}
+	if mask&syscall.IN_IGNORED != 0 {
+		// the directory is removed or unmounted
+		delete(n.dirs, wd)
+		return whisperEvent{}, false
+	}
+	dir, ok := n.dirs[wd]
+	if !ok || name == "" {
+		return whisperEvent{}, false
+	}
+	return whisperEvent{
+		path:    filepath.Join(dir, name),
+		dir:     mask&syscall.IN_ISDIR != 0,
+		created: mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0,
+	}, true
+}
+
+func (n *inotifyNotifier) read() {
+	defer close(n.ch)
+	buf := make([]byte, 64*1024)
+	for {
+		size, err := n.f.Read(buf)
+		if err != nil {
+			select {
+			case <-n.quit:
+			default:
+				n.log.Error("Error reading inotify events: %s", err.Error())
+			}
+			return
+		}
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= size {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(raw.Len)
+			if nameEnd > size {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			ev, ok := n.event(int(raw.Wd), raw.Mask, name)
+			if ok {
+				select {
+				case n.ch <- ev:
+				case <-n.quit:
+					return
+				}
+			}
+			offset = nameEnd
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+
+package mstree
+
+func newNotifier(log *packageLogger) (notifier, error) {
+	return pollNotifier{}, nil
+}
@@ -0,0 +1,158 @@
+package mstree
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Index files are appended by a fixed pool of writers, first level tokens
+// are sharded between them by hash, so a flood of distinct first level
+// tokens costs no goroutines. Every writer appends through its own appender
+// of the index store which keeps at most maxOpen tokens open.
+
+const (
+	DEFAULT_SYNC_WRITERS   = 8
+	DEFAULT_MAX_OPEN_FILES = 256
+)
+
+type indexWriter struct {
+	appender  IndexAppender
+	data      chan writeRequest
+	compact   chan *compaction
+	quit      chan bool
+	done      chan bool
+	queueSize int64
+	log       *packageLogger
+	// metrics the writer hasn't accepted because of a full queue
+	dropped  int64
+	spilled  int64
+	timeouts int64
+}
+
+func newIndexWriter(appender IndexAppender, bufSize int, log *packageLogger) *indexWriter {
+	return &indexWriter{
+		appender: appender,
+		data:     make(chan writeRequest, bufSize),
+		compact:  make(chan *compaction),
+		quit:     make(chan bool),
+		done:     make(chan bool),
+		log:      log,
+	}
+}
+
+func (iw *indexWriter) run() {
+	// while a compaction is in progress every line written for its token
+	// is also recorded to be appended to the compacted file
+	var current *compaction
+	var recorded []string
+	var finish chan StoreSnapshot
+	for {
+		select {
+		case req := <-iw.data:
+			if req.barrier != nil {
+				iw.appender.Sync()
+				req.barrier.Done()
+				continue
+			}
+			atomic.AddInt64(&iw.queueSize, -1)
+			if req.line == "" {
+				continue
+			}
+			if current != nil && current.token == req.token {
+				recorded = append(recorded, req.line)
+			}
+			err := iw.appender.Append(req.token, req.line)
+			if err != nil {
+				iw.log.Error("Index update error: %s", err.Error())
+				continue
+			}
+			iw.log.Debug("Metric '%s.%s' synced to disk", req.token, req.line)
+			if len(iw.data) == 0 {
+				iw.appender.Flush()
+			}
+		case <-iw.quit:
+			iw.appender.Close()
+			close(iw.done)
+			return
+		case c := <-iw.compact:
+			current = c
+			recorded = make([]string, 0)
+			finish = c.finish
+			c.started <- true
+		case s := <-finish:
+			if s != nil {
+				current.done <- iw.appender.Commit(s, recorded)
+			} else {
+				current.done <- nil
+			}
+			current, recorded, finish = nil, nil, nil
+		}
+	}
+}
+
+// SetWriterPool sets the number of index writers and the total limit of
+// index files they keep open. It has effect only before the first metric is
+// passed to writers.
+func (t *MSTree) SetWriterPool(writers int, maxOpenFiles int) error {
+	if writers <= 0 {
+		return fmt.Errorf("invalid number of index writers %d", writers)
+	}
+	if maxOpenFiles < writers {
+		return fmt.Errorf("max open files %d is less than the number of index writers %d", maxOpenFiles, writers)
+	}
+	t.writersLock.Lock()
+	defer t.writersLock.Unlock()
+	if t.writers != nil {
+		return fmt.Errorf("index writers are already started")
+	}
+	t.writerCount = writers
+	t.maxOpenFiles = maxOpenFiles
+	return nil
+}
+
+// writerFor returns the index writer responsible for indexToken, starting
+// the pool if it isn't started yet
+func (t *MSTree) writerFor(indexToken string) *indexWriter {
+	t.writersLock.Lock()
+	defer t.writersLock.Unlock()
+	if t.writers == nil {
+		tm := time.Now()
+		t.writers = make([]*indexWriter, t.writerCount)
+		for i := range t.writers {
+			t.writers[i] = newIndexWriter(t.store.Appender(t.maxOpenFiles/t.writerCount), t.syncBufferSize, t.log)
+			go t.writers[i].run()
+		}
+		t.log.Notice("%d index writers started in %s", t.writerCount, time.Now().Sub(tm).String())
+	}
+	h := fnv.New32a()
+	h.Write([]byte(indexToken))
+	return t.writers[h.Sum32()%uint32(len(t.writers))]
+}
+
+// writerBarrier queues a barrier to every index writer, waiting for the
+// returned WaitGroup makes sure everything queued before is synced to disk
+func (t *MSTree) writerBarrier() *sync.WaitGroup {
+	barrier := new(sync.WaitGroup)
+	t.writersLock.Lock()
+	for _, iw := range t.writers {
+		barrier.Add(1)
+		iw.data <- writeRequest{barrier: barrier}
+	}
+	t.writersLock.Unlock()
+	return barrier
+}
+
+func (t *MSTree) SyncQueueSize() (int64, int64) {
+	var qsize int64 = 0
+	t.writersLock.Lock()
+	for _, iw := range t.writers {
+		qsize += atomic.LoadInt64(&iw.queueSize)
+	}
+	count := len(t.writers)
+	t.writersLock.Unlock()
+	totalBufSize := int64(count * t.syncBufferSize)
+	return qsize, totalBufSize
+}
@@ -0,0 +1,239 @@
+package web
+
+import (
+	"fmt"
+	"github.com/viert/metricsearch/pkg/mstree"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Online reindex builds a new tree from a metrics file in background while
+// the current one keeps serving and syncing added metrics to its index
+// generation. The new tree writes a generation of its own aside, metrics
+// added meanwhile are recorded and added to the new tree as well, and the
+// new generation is made current only when everything recorded is synced
+// to it with adds held off.
+
+const (
+	REINDEX_RUNNING = "running"
+	REINDEX_DONE    = "done"
+	REINDEX_FAILED  = "failed"
+)
+
+type reindexJob struct {
+	source   string
+	started  time.Time
+	finished time.Time
+	progress int64
+	state    string
+	err      error
+	lock     *sync.Mutex
+	// recording is only changed with Server.treeLock held exclusively
+	recording bool
+	pending   []string
+}
+
+func (job *reindexJob) record(name string) {
+	job.lock.Lock()
+	job.pending = append(job.pending, name)
+	job.lock.Unlock()
+}
+
+func (job *reindexJob) running() bool {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	return job.state == REINDEX_RUNNING
+}
+
+func (job *reindexJob) finish(err error) {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	job.finished = time.Now()
+	job.err = err
+	if err != nil {
+		job.state = REINDEX_FAILED
+	} else {
+		job.state = REINDEX_DONE
+	}
+}
+
+// EnableReindex makes /admin/reindex available, newTree must return an
+// empty tree configured like the current one and startTree is called to
+// start its background jobs before it replaces the current one
+func (s *Server) EnableReindex(newTree func() (*mstree.MSTree, error), startTree func(*mstree.MSTree) error) {
+	s.newTree = newTree
+	s.startTree = startTree
+}
+
+func (s *Server) getTree() *mstree.MSTree {
+	s.treeLock.RLock()
+	defer s.treeLock.RUnlock()
+	return s.tree
+}
+
+// takePending returns metrics recorded so far, they're recorded anew from
+// scratch
+func (job *reindexJob) takePending() []string {
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	pending := job.pending
+	job.pending = make([]string, 0)
+	return pending
+}
+
+func (s *Server) runReindex(job *reindexJob, f *os.File, tmp bool) {
+	defer func() {
+		f.Close()
+		if tmp {
+			os.Remove(f.Name())
+		}
+	}()
+	log.Notice("Reindexing from %s", job.source)
+	tree, err := s.newTree()
+	if err != nil {
+		log.Error("Error creating tree for reindex: %s", err.Error())
+		job.finish(err)
+		return
+	}
+	err = tree.AddTxt(f, -1, &job.progress)
+	if err == nil {
+		err = tree.PrepareGeneration()
+	}
+	if err == nil {
+		err = s.startTree(tree)
+	}
+	added := 0
+	if err == nil {
+		// catch up with most of the metrics added meanwhile while adds
+		// still go on
+		for _, name := range job.takePending() {
+			tree.Add(name)
+			added++
+		}
+		s.treeLock.Lock()
+		for _, name := range job.takePending() {
+			tree.Add(name)
+			added++
+		}
+		err = tree.Replace(s.tree)
+		if err == nil {
+			s.tree = tree
+		}
+		job.recording = false
+		s.treeLock.Unlock()
+	}
+	job.takePending()
+	if err != nil {
+		log.Error("Reindexing error, keeping the current tree: %s", err.Error())
+		s.treeLock.Lock()
+		job.recording = false
+		s.treeLock.Unlock()
+		tree.Discard()
+		job.finish(err)
+		return
+	}
+	log.Notice("Reindex complete, %d metrics added while reindexing", added)
+	job.finish(nil)
+}
+
+func (s *Server) reindexStatus(w http.ResponseWriter) {
+	s.reindexLock.Lock()
+	job := s.reindex
+	s.reindexLock.Unlock()
+	if job == nil {
+		io.WriteString(w, "state: none\n")
+		return
+	}
+	job.lock.Lock()
+	defer job.lock.Unlock()
+	io.WriteString(w, fmt.Sprintf("state: %s\n", job.state))
+	io.WriteString(w, fmt.Sprintf("source: %s\n", job.source))
+	io.WriteString(w, fmt.Sprintf("started: %s\n", job.started.Format(time.RFC3339)))
+	io.WriteString(w, fmt.Sprintf("processed: %d\n", atomic.LoadInt64(&job.progress)))
+	if job.state == REINDEX_RUNNING {
+		io.WriteString(w, fmt.Sprintf("elapsed: %s\n", time.Now().Sub(job.started).String()))
+		io.WriteString(w, fmt.Sprintf("pending: %d\n", len(job.pending)))
+	} else {
+		io.WriteString(w, fmt.Sprintf("took: %s\n", job.finished.Sub(job.started).String()))
+	}
+	if job.err != nil {
+		io.WriteString(w, fmt.Sprintf("error: %s\n", job.err.Error()))
+	}
+}
+
+func (s *Server) reindexHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != "POST" {
+		s.reindexStatus(w)
+		return
+	}
+	if s.newTree == nil {
+		w.WriteHeader(http.StatusNotImplemented)
+		io.WriteString(w, "Online reindex is not enabled")
+		return
+	}
+	s.reindexLock.Lock()
+	defer s.reindexLock.Unlock()
+	if s.reindex != nil && s.reindex.running() {
+		w.WriteHeader(http.StatusConflict)
+		io.WriteString(w, "Reindex is already running")
+		return
+	}
+
+	var f *os.File
+	var err error
+	tmp := false
+	// not r.Form, parsing a form would consume an uploaded body
+	source := r.URL.Query().Get("file")
+	if source != "" {
+		f, err = os.Open(source)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Error opening metrics file: "+err.Error())
+			return
+		}
+	} else {
+		// the upload is saved first as the request body is gone once
+		// the handler returns
+		f, err = ioutil.TempFile("", "metricsearch-reindex-")
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "Error saving metrics file: "+err.Error())
+			return
+		}
+		tmp = true
+		n, err := io.Copy(f, r.Body)
+		if err == nil && n == 0 {
+			err = fmt.Errorf("specify 'file' parameter or upload metrics in the request body")
+		}
+		if err == nil {
+			_, err = f.Seek(0, 0)
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "Error receiving metrics file: "+err.Error())
+			return
+		}
+		source = "upload"
+	}
+
+	job := &reindexJob{
+		source:    source,
+		started:   time.Now(),
+		state:     REINDEX_RUNNING,
+		lock:      new(sync.Mutex),
+		recording: true,
+		pending:   make([]string, 0),
+	}
+	s.reindex = job
+	go s.runReindex(job, f, tmp)
+	w.WriteHeader(http.StatusAccepted)
+	io.WriteString(w, "Reindex started")
+}
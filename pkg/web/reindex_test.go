@@ -0,0 +1,127 @@
+package web
+
+import (
+	"fmt"
+	"github.com/viert/metricsearch/pkg/mstree"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func reindexState(t *testing.T, url string) string {
+	resp, err := http.Get(url + "/admin/reindex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return strings.SplitN(string(body), "\n", 2)[0]
+}
+
+func TestReindexConcurrentAdds(t *testing.T) {
+	indexDir := "/tmp/test_web_reindex"
+	os.RemoveAll(indexDir)
+	defer os.RemoveAll(indexDir)
+
+	newTree := func() (*mstree.MSTree, error) {
+		return mstree.NewTree(indexDir, 100, true)
+	}
+	startTree := func(tree *mstree.MSTree) error {
+		return tree.StartWAL(mstree.WAL_FSYNC_ALWAYS, time.Hour)
+	}
+	tree, err := newTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.LoadIndex()
+	err = startTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Add("old.metric")
+
+	server := NewServer(tree, false, "")
+	server.EnableReindex(newTree, startTree)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	lines := make([]string, 0, 20000)
+	for i := 0; i < 20000; i++ {
+		lines = append(lines, fmt.Sprintf("reindexed.metric%d", i))
+	}
+	resp, err := http.Post(ts.URL+"/admin/reindex", "text/plain", strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Reindex is not started: %s", resp.Status)
+	}
+
+	// metrics are added till the reindex is over, the swap included
+	var done int32
+	var added int64
+	wg := new(sync.WaitGroup)
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; atomic.LoadInt32(&done) == 0; i++ {
+				resp, err := http.Get(fmt.Sprintf("%s/add?name=added.g%d.m%d&sync=%d", ts.URL, g, i, i%2))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("Error adding metric: %s", resp.Status)
+					return
+				}
+				atomic.AddInt64(&added, 1)
+			}
+		}(g)
+	}
+	state := reindexState(t, ts.URL)
+	for deadline := time.Now().Add(30 * time.Second); state == "state: "+REINDEX_RUNNING && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		state = reindexState(t, ts.URL)
+	}
+	atomic.StoreInt32(&done, 1)
+	wg.Wait()
+	if state != "state: "+REINDEX_DONE {
+		t.Fatalf("Reindex is not done: %s", state)
+	}
+
+	check := func(tree *mstree.MSTree) {
+		if found := len(tree.Search("reindexed.*")); found != 20000 {
+			t.Errorf("20000 reindexed metrics expected, got %d", found)
+		}
+		if found := int64(len(tree.Search("added.*.*"))); found != added {
+			t.Errorf("%d metrics added while reindexing expected, got %d", added, found)
+		}
+		if len(tree.Search("old.metric")) != 0 {
+			t.Error("Metric of the previous index survived the reindex")
+		}
+	}
+	tree = server.getTree()
+	check(tree)
+	tree.Close()
+
+	tree, err = newTree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.LoadIndex()
+	check(tree)
+	tree.Close()
+	files, _ := ioutil.ReadDir(indexDir)
+	if len(files) != 2 {
+		t.Errorf("Exactly one generation and a link expected, got %d files", len(files))
+	}
+}
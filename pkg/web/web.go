@@ -0,0 +1,697 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	logging "github.com/op/go-logging"
+	"github.com/viert/metricsearch/pkg/mstree"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type Server struct {
+	tree        *mstree.MSTree
+	selfMonitor bool
+	// treeLock guards tree replaced by online reindex
+	treeLock    *sync.RWMutex
+	newTree     func() (*mstree.MSTree, error)
+	startTree   func(*mstree.MSTree) error
+	reindex     *reindexJob
+	reindexLock *sync.Mutex
+	// searchTimeout limits a single /search query or batch, 0 means no
+	// limit
+	searchTimeout time.Duration
+	// whisperRoot is the directory /admin/import-whisper may import
+	// from, empty disables the import
+	whisperRoot string
+	mux         *http.ServeMux
+}
+
+type handlerCounters struct {
+	add      uint64
+	search   uint64
+	dump     uint64
+	complete uint64
+	fuzzy    uint64
+	grep     uint64
+	count    uint64
+	batch    uint64
+}
+
+type abortCounters struct {
+	timeout   uint64
+	cancelled uint64
+}
+
+type batchResult struct {
+	Query   string   `json:"query"`
+	Results []string `json:"results"`
+}
+
+type rpsCounters struct {
+	add      float64
+	search   float64
+	dump     float64
+	complete float64
+	fuzzy    float64
+	grep     float64
+	count    float64
+	batch    float64
+}
+
+const (
+	monitorHost = "127.0.0.1:42000"
+
+	DEFAULT_COMPLETE_LIMIT = 100
+	DEFAULT_FUZZY_LIMIT    = 20
+	// search results streamed to the client are flushed every that many
+	SEARCH_FLUSH_EVERY = 1000
+	// larger /search/batch requests are rejected
+	MAX_BATCH_QUERIES = 1000
+)
+
+var (
+	log              *logging.Logger = logging.MustGetLogger("metricsearch")
+	totalRequests    handlerCounters
+	lastRequests     handlerCounters
+	searchAborts     abortCounters
+	rps              rpsCounters
+	monitoringPrefix string
+)
+
+func (s *Server) sendMetrics() {
+	conn, err := net.Dial("tcp", monitorHost)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	ts := time.Now().Unix()
+	tree := s.getTree()
+	sqs, _ := tree.SyncQueueSize()
+	fmt.Fprintf(conn, "%s.metricsearch.rps.add %.4f %d\n", monitoringPrefix, rps.add, ts)
+	fmt.Fprintf(conn, "%s.metricsearch.rps.search %.4f %d\n", monitoringPrefix, rps.search, ts)
+	fmt.Fprintf(conn, "%s.metricsearch.rps.dump %.4f %d\n", monitoringPrefix, rps.dump, ts)
+	fmt.Fprintf(conn, "%s.metricsearch.rps.complete %.4f %d\n", monitoringPrefix, rps.complete, ts)
+	fmt.Fprintf(conn, "%s.metricsearch.rps.fuzzy %.4f %d\n", monitoringPrefix, rps.fuzzy, ts)
+	fmt.Fprintf(conn, "%s.metricsearch.rps.grep %.4f %d\n", monitoringPrefix, rps.grep, ts)
+	fmt.Fprintf(conn, "%s.metricsearch.rps.count %.4f %d\n", monitoringPrefix, rps.count, ts)
+	fmt.Fprintf(conn, "%s.metricsearch.rps.batch %.4f %d\n", monitoringPrefix, rps.batch, ts)
+	fmt.Fprintf(conn, "%s.metricsearch.reqs.add %.2f %d\n", monitoringPrefix, float32(totalRequests.add), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.reqs.search %.2f %d\n", monitoringPrefix, float32(totalRequests.search), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.reqs.dump %.2f %d\n", monitoringPrefix, float32(totalRequests.dump), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.reqs.complete %.2f %d\n", monitoringPrefix, float32(totalRequests.complete), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.reqs.fuzzy %.2f %d\n", monitoringPrefix, float32(totalRequests.fuzzy), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.reqs.grep %.2f %d\n", monitoringPrefix, float32(totalRequests.grep), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.reqs.count %.2f %d\n", monitoringPrefix, float32(totalRequests.count), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.reqs.batch %.2f %d\n", monitoringPrefix, float32(totalRequests.batch), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.search_aborts.timeout %.2f %d\n", monitoringPrefix, float64(atomic.LoadUint64(&searchAborts.timeout)), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.search_aborts.cancelled %.2f %d\n", monitoringPrefix, float64(atomic.LoadUint64(&searchAborts.cancelled)), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.metrics %.2f %d\n", monitoringPrefix, float64(tree.TotalMetrics), ts)
+	fmt.Fprintf(conn, "%s.metricsearch.sync_queue %.2f %d\n", monitoringPrefix, float64(sqs), ts)
+	for _, qs := range tree.QueueStats() {
+		fmt.Fprintf(conn, "%s.metricsearch.sync_queue_writers.%d.queued %.2f %d\n", monitoringPrefix, qs.Writer, float64(qs.Queued), ts)
+		fmt.Fprintf(conn, "%s.metricsearch.sync_queue_writers.%d.saturation %.4f %d\n", monitoringPrefix, qs.Writer, qs.Saturation, ts)
+		fmt.Fprintf(conn, "%s.metricsearch.sync_queue_writers.%d.dropped %.2f %d\n", monitoringPrefix, qs.Writer, float64(qs.Dropped), ts)
+		fmt.Fprintf(conn, "%s.metricsearch.sync_queue_writers.%d.spilled %.2f %d\n", monitoringPrefix, qs.Writer, float64(qs.Spilled), ts)
+		fmt.Fprintf(conn, "%s.metricsearch.sync_queue_writers.%d.timeouts %.2f %d\n", monitoringPrefix, qs.Writer, float64(qs.Timeouts), ts)
+	}
+	fmt.Fprintf(conn, "%s.metricsearch.corrupt_files %.2f %d\n", monitoringPrefix, float64(len(tree.CorruptFiles())), ts)
+}
+
+func (s *Server) searchHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&totalRequests.search, 1)
+	w.Header().Set("Content-Type", "text/plain")
+	r.ParseForm()
+	query := r.Form.Get("query")
+	flusher, _ := w.(http.Flusher)
+	ctx, cancel := s.searchContext(r)
+	defer cancel()
+	count := 0
+	gone := false
+	tm := time.Now()
+	err := s.getTree().SearchFunc(ctx, query, func(path string, leaf bool) bool {
+		_, err := io.WriteString(w, path)
+		if err == nil {
+			if leaf {
+				_, err = io.WriteString(w, "\n")
+			} else {
+				_, err = io.WriteString(w, ".\n")
+			}
+		}
+		if err != nil {
+			// the client is gone, its request context may be not done yet
+			gone = true
+			return false
+		}
+		count++
+		if flusher != nil && count%SEARCH_FLUSH_EVERY == 0 {
+			flusher.Flush()
+		}
+		return true
+	})
+	dur := time.Now().Sub(tm)
+	if err == nil && gone {
+		err = context.Canceled
+	}
+	if err == context.DeadlineExceeded && count > 0 {
+		atomic.AddUint64(&searchAborts.timeout, 1)
+		log.Notice("Searching %s timed out after %s, %d results sent", query, dur.String(), count)
+		// the status is already sent, breaking the response is the only
+		// way to keep the client from taking partial results for complete
+		panic(http.ErrAbortHandler)
+	}
+	if s.searchAborted(w, err, "Searching "+query, dur) {
+		return
+	}
+	if dur > time.Millisecond {
+		// slower than 1ms
+		log.Debug("Searching %s took %s\n", query, dur.String())
+	}
+}
+
+// SetSearchTimeout limits the time a single /search query or batch may
+// take, the search is abandoned with 504 Gateway Timeout after that. 0
+// means no limit.
+func (s *Server) SetSearchTimeout(timeout time.Duration) {
+	s.searchTimeout = timeout
+}
+
+// SetWhisperRoot allows /admin/import-whisper to import whisper files from
+// root and its subdirectories
+func (s *Server) SetWhisperRoot(root string) {
+	s.whisperRoot = root
+}
+
+// searchContext returns the context searches of r run with: it's done as
+// soon as the client is gone or the search timeout is over
+func (s *Server) searchContext(r *http.Request) (context.Context, context.CancelFunc) {
+	if s.searchTimeout > 0 {
+		return context.WithTimeout(r.Context(), s.searchTimeout)
+	}
+	return context.WithCancel(r.Context())
+}
+
+// searchAborted counts and responds to a search abandoned by err before
+// anything is sent, it returns false if err is nil
+func (s *Server) searchAborted(w http.ResponseWriter, err error, what string, dur time.Duration) bool {
+	switch {
+	case err == nil:
+		return false
+	case err == context.DeadlineExceeded:
+		atomic.AddUint64(&searchAborts.timeout, 1)
+		log.Notice("%s timed out after %s", what, dur.String())
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusGatewayTimeout)
+		io.WriteString(w, fmt.Sprintf("Search timed out after %s\n", s.searchTimeout.String()))
+	default:
+		// nobody is there to respond to
+		atomic.AddUint64(&searchAborts.cancelled, 1)
+		log.Debug("%s cancelled by the client after %s", what, dur.String())
+	}
+	return true
+}
+
+func (s *Server) batchSearchHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&totalRequests.batch, 1)
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "Use POST with a JSON list of queries")
+		return
+	}
+	var queries []string
+	err := json.NewDecoder(r.Body).Decode(&queries)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Error parsing queries: "+err.Error())
+		return
+	}
+	if len(queries) > MAX_BATCH_QUERIES {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, fmt.Sprintf("Too many queries in a batch, %d is the maximum", MAX_BATCH_QUERIES))
+		return
+	}
+	ctx, cancel := s.searchContext(r)
+	defer cancel()
+	tm := time.Now()
+	data, err := s.getTree().SearchBatch(ctx, queries)
+	dur := time.Now().Sub(tm)
+	if s.searchAborted(w, err, fmt.Sprintf("Searching batch of %d queries", len(queries)), dur) {
+		return
+	}
+	if dur > time.Millisecond {
+		// slower than 1ms
+		log.Debug("Searching batch of %d queries took %s\n", len(queries), dur.String())
+	}
+	response := make([]batchResult, len(queries))
+	for i, query := range queries {
+		response[i] = batchResult{query, data[i]}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) countHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&totalRequests.count, 1)
+	w.Header().Set("Content-Type", "text/plain")
+	r.ParseForm()
+	query := r.Form.Get("query")
+	ctx, cancel := s.searchContext(r)
+	defer cancel()
+	tm := time.Now()
+	leaves, branches, err := s.getTree().CountContext(ctx, query)
+	dur := time.Now().Sub(tm)
+	if s.searchAborted(w, err, "Counting "+query, dur) {
+		return
+	}
+	if dur > time.Millisecond {
+		// slower than 1ms
+		log.Debug("Counting %s took %s\n", query, dur.String())
+	}
+	io.WriteString(w, fmt.Sprintf("leaves: %d\n", leaves))
+	io.WriteString(w, fmt.Sprintf("branches: %d\n", branches))
+}
+
+func (s *Server) completeHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&totalRequests.complete, 1)
+	w.Header().Set("Content-Type", "text/plain")
+	r.ParseForm()
+	prefix := r.Form.Get("prefix")
+	limit := DEFAULT_COMPLETE_LIMIT
+	if l := r.Form.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "'limit' parameter must be an integer")
+			return
+		}
+	}
+	ctx, cancel := s.searchContext(r)
+	defer cancel()
+	tm := time.Now()
+	data, err := s.getTree().CompleteContext(ctx, prefix, limit)
+	dur := time.Now().Sub(tm)
+	if s.searchAborted(w, err, "Completing "+prefix, dur) {
+		return
+	}
+	if dur > time.Millisecond {
+		// slower than 1ms
+		log.Debug("Completing %s took %s\n", prefix, dur.String())
+	}
+	for _, item := range data {
+		kind := "branch"
+		if item.Leaf {
+			kind = "leaf"
+		}
+		io.WriteString(w, fmt.Sprintf("%s\t%s\t%d\n", item.Path, kind, item.Size))
+	}
+}
+
+func (s *Server) fuzzyHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&totalRequests.fuzzy, 1)
+	w.Header().Set("Content-Type", "text/plain")
+	r.ParseForm()
+	query := r.Form.Get("query")
+	if query == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Specify 'query' parameter")
+		return
+	}
+	prefix := r.Form.Get("prefix")
+	limit := DEFAULT_FUZZY_LIMIT
+	if l := r.Form.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "'limit' parameter must be an integer")
+			return
+		}
+	}
+	ctx, cancel := s.searchContext(r)
+	defer cancel()
+	tm := time.Now()
+	data, err := s.getTree().FuzzySearchContext(ctx, query, prefix, limit)
+	if err == mstree.ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		io.WriteString(w, "Fuzzy search is not available: "+err.Error())
+		return
+	}
+	dur := time.Now().Sub(tm)
+	if s.searchAborted(w, err, "Fuzzy searching "+query, dur) {
+		return
+	}
+	if dur > time.Millisecond {
+		// slower than 1ms
+		log.Debug("Fuzzy searching %s took %s\n", query, dur.String())
+	}
+	for _, item := range data {
+		io.WriteString(w, fmt.Sprintf("%s\t%.4f\n", item.Path, item.Score))
+	}
+}
+
+func (s *Server) grepHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&totalRequests.grep, 1)
+	w.Header().Set("Content-Type", "text/plain")
+	r.ParseForm()
+	fragment := r.Form.Get("q")
+	if fragment == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Specify 'q' parameter")
+		return
+	}
+	if strings.Contains(fragment, ".") {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "'q' parameter must be a part of a single token and can't contain '.'")
+		return
+	}
+	ctx, cancel := s.searchContext(r)
+	defer cancel()
+	tm := time.Now()
+	data, err := s.getTree().GrepContext(ctx, fragment)
+	if err == mstree.ErrNotSupported {
+		w.WriteHeader(http.StatusNotImplemented)
+		io.WriteString(w, "Grep is not available: "+err.Error())
+		return
+	}
+	dur := time.Now().Sub(tm)
+	if s.searchAborted(w, err, "Grepping "+fragment, dur) {
+		return
+	}
+	if dur > time.Millisecond {
+		// slower than 1ms
+		log.Debug("Grepping %s took %s\n", fragment, dur.String())
+	}
+	for _, item := range data {
+		io.WriteString(w, item+"\n")
+	}
+}
+
+func (s *Server) addHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&totalRequests.add, 1)
+	w.Header().Set("Content-Type", "text/plain")
+	r.ParseForm()
+	name := r.Form.Get("name")
+	if name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		io.WriteString(w, "Specify 'name' parameter")
+		return
+	}
+	tm := time.Now()
+	// the tree is not replaced while adding so a metric is either added
+	// to the new tree or recorded to be added to it
+	s.treeLock.RLock()
+	defer s.treeLock.RUnlock()
+	s.reindexLock.Lock()
+	job := s.reindex
+	s.reindexLock.Unlock()
+	if job != nil && job.recording {
+		job.record(name)
+	}
+	if r.Form.Get("sync") == "1" {
+		err := s.tree.AddDurable(name)
+		if err == mstree.ErrWALDisabled {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "sync=1 requires write-ahead log to be enabled")
+			return
+		} else if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "Error syncing metric: "+err.Error())
+			return
+		}
+	} else {
+		s.tree.Add(name)
+	}
+	dur := time.Now().Sub(tm)
+	if dur > time.Millisecond*100 {
+		log.Debug("Indexing %s took %s\n", name, dur.String())
+	}
+	io.WriteString(w, "Ok")
+}
+
+func (s *Server) compactHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "Use POST to compact the index")
+		return
+	}
+	tm := time.Now()
+	err := s.getTree().Compact()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "Error compacting index: "+err.Error())
+		return
+	}
+	log.Info("Forced index compaction took %s", time.Now().Sub(tm).String())
+	io.WriteString(w, "Ok")
+}
+
+// countingWriter tells if anything is written to the response yet
+type countingWriter struct {
+	w       io.Writer
+	written int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.written += int64(n)
+	return n, err
+}
+
+func (s *Server) snapshotHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "Use POST to take a snapshot")
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"metricsearch-%d.tar\"", time.Now().Unix()))
+	tm := time.Now()
+	cw := &countingWriter{w: w}
+	err := s.getTree().Snapshot(cw)
+	if err != nil {
+		log.Error("Error streaming snapshot: %s", err.Error())
+		// the status is sent already if streaming has started, a broken
+		// archive is rejected by restore anyway
+		if cw.written == 0 {
+			w.Header().Set("Content-Type", "text/plain")
+			w.Header().Del("Content-Disposition")
+			w.WriteHeader(http.StatusInternalServerError)
+			io.WriteString(w, "Error taking snapshot: "+err.Error())
+		}
+		return
+	}
+	log.Info("Snapshot streamed in %s", time.Now().Sub(tm).String())
+}
+
+func (s *Server) stackHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	buf := make([]byte, 65536)
+	n := runtime.Stack(buf, true)
+	w.Write(buf[:n])
+}
+
+func (s *Server) importWhisperHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		io.WriteString(w, "Use POST to import whisper files")
+		return
+	}
+	if s.whisperRoot == "" {
+		w.WriteHeader(http.StatusNotImplemented)
+		io.WriteString(w, "Whisper import is not enabled")
+		return
+	}
+	r.ParseForm()
+	dir := r.Form.Get("dir")
+	if dir == "" {
+		dir = s.whisperRoot
+	}
+	if !withinDir(s.whisperRoot, dir) {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "'dir' parameter must be within "+s.whisperRoot)
+		return
+	}
+	var since time.Time
+	if ma := r.Form.Get("max_age"); ma != "" {
+		maxAge, err := time.ParseDuration(ma)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, "'max_age' parameter must be a duration, i.e. 720h")
+			return
+		}
+		since = time.Now().Add(-maxAge)
+	}
+	tm := time.Now()
+	count, err := s.getTree().ImportWhisper(dir, since)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, "Error importing whisper files: "+err.Error())
+		return
+	}
+	log.Info("Importing %d whisper files from %s took %s", count, dir, time.Now().Sub(tm).String())
+	io.WriteString(w, fmt.Sprintf("Imported %d whisper files\n", count))
+}
+
+// withinDir tells if path is root or a directory below it once symlinks
+// are resolved
+func withinDir(root string, path string) bool {
+	root, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+func (s *Server) dumpHandler(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&totalRequests.dump, 1)
+	w.Header().Set("Content-Type", "text/plain")
+	s.getTree().Dump(w)
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	io.WriteString(w, "Total requests (online):\n=============================\n")
+	io.WriteString(w, fmt.Sprintf("  add:      %d\n", totalRequests.add))
+	io.WriteString(w, fmt.Sprintf("  search:   %d\n", totalRequests.search))
+	io.WriteString(w, fmt.Sprintf("  dump:     %d\n", totalRequests.dump))
+	io.WriteString(w, fmt.Sprintf("  complete: %d\n", totalRequests.complete))
+	io.WriteString(w, fmt.Sprintf("  fuzzy:    %d\n", totalRequests.fuzzy))
+	io.WriteString(w, fmt.Sprintf("  grep:     %d\n", totalRequests.grep))
+	io.WriteString(w, fmt.Sprintf("  count:    %d\n", totalRequests.count))
+	io.WriteString(w, fmt.Sprintf("  batch:    %d\n", totalRequests.batch))
+	io.WriteString(w, "\n")
+	io.WriteString(w, "Aborted searches:\n=============================\n")
+	io.WriteString(w, fmt.Sprintf("  timeout:   %d\n", atomic.LoadUint64(&searchAborts.timeout)))
+	io.WriteString(w, fmt.Sprintf("  cancelled: %d\n", atomic.LoadUint64(&searchAborts.cancelled)))
+	io.WriteString(w, "\n")
+	if s.selfMonitor {
+		// RPS is only calculated along with sending self monitoring metrics
+		io.WriteString(w, "RPS (refreshes every minute):\n=============================\n")
+		io.WriteString(w, fmt.Sprintf("  add:      %.3f\n", rps.add))
+		io.WriteString(w, fmt.Sprintf("  search:   %.3f\n", rps.search))
+		io.WriteString(w, fmt.Sprintf("  dump:     %.3f\n", rps.dump))
+		io.WriteString(w, fmt.Sprintf("  complete: %.3f\n", rps.complete))
+		io.WriteString(w, fmt.Sprintf("  fuzzy:    %.3f\n", rps.fuzzy))
+		io.WriteString(w, fmt.Sprintf("  grep:     %.3f\n", rps.grep))
+		io.WriteString(w, fmt.Sprintf("  count:    %.3f\n", rps.count))
+		io.WriteString(w, fmt.Sprintf("  batch:    %.3f\n", rps.batch))
+		io.WriteString(w, "\n")
+	}
+	tree := s.getTree()
+	sqs, _ := tree.SyncQueueSize()
+	io.WriteString(w, fmt.Sprintf("Total Metrics: %d\n", tree.TotalMetrics))
+	io.WriteString(w, fmt.Sprintf("Distinct Tokens: %d\n", tree.DistinctTokens()))
+	io.WriteString(w, fmt.Sprintf("Sync Queue Size: %d\n", sqs))
+	queueStats := tree.QueueStats()
+	if len(queueStats) > 0 {
+		io.WriteString(w, "Sync Queue By Writer (queued, saturation, dropped, spilled, timeouts):\n")
+		for _, qs := range queueStats {
+			io.WriteString(w, fmt.Sprintf("  %d: %d %.1f%% %d %d %d\n", qs.Writer, qs.Queued, qs.Saturation*100, qs.Dropped, qs.Spilled, qs.Timeouts))
+		}
+	}
+	corrupt := tree.CorruptFiles()
+	io.WriteString(w, fmt.Sprintf("Corrupt Index Files: %d\n", len(corrupt)))
+	for _, cf := range corrupt {
+		io.WriteString(w, fmt.Sprintf("  %s (%s), quarantined to %s\n", cf.File, cf.Reason, cf.Quarantined))
+	}
+}
+
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	corrupt := s.getTree().CorruptFiles()
+	if len(corrupt) > 0 {
+		w.WriteHeader(http.StatusInternalServerError)
+		io.WriteString(w, fmt.Sprintf("%d corrupt index files found while loading, see /stats\n", len(corrupt)))
+		return
+	}
+	io.WriteString(w, "Ok")
+}
+
+func (s *Server) recalcRPS() {
+	if s.selfMonitor {
+		ticker := time.Tick(time.Minute)
+		for _ = range ticker {
+			rps.add = float64(totalRequests.add-lastRequests.add) / 60
+			rps.dump = float64(totalRequests.dump-lastRequests.dump) / 60
+			rps.search = float64(totalRequests.search-lastRequests.search) / 60
+			rps.complete = float64(totalRequests.complete-lastRequests.complete) / 60
+			rps.fuzzy = float64(totalRequests.fuzzy-lastRequests.fuzzy) / 60
+			rps.grep = float64(totalRequests.grep-lastRequests.grep) / 60
+			rps.count = float64(totalRequests.count-lastRequests.count) / 60
+			rps.batch = float64(totalRequests.batch-lastRequests.batch) / 60
+			lastRequests = totalRequests
+			s.sendMetrics()
+		}
+	}
+}
+
+func NewServer(tree *mstree.MSTree, selfMonitor bool, selfMonitorPrefix string) *Server {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	selfHostname := strings.Replace(host, ".", "_", -1)
+	if selfMonitorPrefix != "" {
+		monitoringPrefix = fmt.Sprintf("%s.%s", selfMonitorPrefix, selfHostname)
+	} else {
+		monitoringPrefix = selfHostname
+	}
+	server := &Server{tree, selfMonitor, new(sync.RWMutex), nil, nil, nil, new(sync.Mutex), 0, "", http.NewServeMux()}
+	server.mux.HandleFunc("/search", server.searchHandler)
+	server.mux.HandleFunc("/search/batch", server.batchSearchHandler)
+	server.mux.HandleFunc("/count", server.countHandler)
+	server.mux.HandleFunc("/add", server.addHandler)
+	server.mux.HandleFunc("/complete", server.completeHandler)
+	server.mux.HandleFunc("/fuzzy", server.fuzzyHandler)
+	server.mux.HandleFunc("/grep", server.grepHandler)
+	server.mux.HandleFunc("/debug/stack", server.stackHandler)
+	server.mux.HandleFunc("/dump", server.dumpHandler)
+	server.mux.HandleFunc("/admin/compact", server.compactHandler)
+	server.mux.HandleFunc("/admin/snapshot", server.snapshotHandler)
+	server.mux.HandleFunc("/admin/reindex", server.reindexHandler)
+	server.mux.HandleFunc("/admin/import-whisper", server.importWhisperHandler)
+	server.mux.HandleFunc("/health", server.healthHandler)
+	server.mux.HandleFunc("/stats", server.statsHandler)
+	return server
+}
+
+// ServeHTTP serves the API of the server
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) Start(listenAddr string) {
+	log.Notice("Starting background stats job")
+	go s.recalcRPS()
+	log.Notice("Starting HTTP")
+	err := http.ListenAndServe(listenAddr, s.mux)
+	if err != nil {
+		log.Error(err.Error())
+		panic(err)
+	}
+}
@@ -0,0 +1,272 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/viert/metricsearch/pkg/mstree"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	// enough for a search to flush results and check its context after
+	TEST_METRICS = 3 * SEARCH_FLUSH_EVERY
+)
+
+func testServer(t *testing.T, timeout time.Duration) *Server {
+	indexDir := "/tmp/test_web_search"
+	os.RemoveAll(indexDir)
+	t.Cleanup(func() { os.RemoveAll(indexDir) })
+	tree, err := mstree.NewTree(indexDir, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < TEST_METRICS; i++ {
+		tree.Add(fmt.Sprintf("abort.metric%d", i))
+	}
+	server := NewServer(tree, false, "")
+	server.SetSearchTimeout(timeout)
+	return server
+}
+
+// stallingWriter calls onFlush when the handler flushes results the first
+// time and fails writes after that if failing is set
+type stallingWriter struct {
+	*httptest.ResponseRecorder
+	onFlush func()
+	flushed bool
+	failing bool
+}
+
+func (sw *stallingWriter) Flush() {
+	if !sw.flushed {
+		sw.flushed = true
+		sw.onFlush()
+	}
+	sw.ResponseRecorder.Flush()
+}
+
+func (sw *stallingWriter) Write(p []byte) (int, error) {
+	if sw.flushed && sw.failing {
+		return 0, errors.New("connection reset by peer")
+	}
+	return sw.ResponseRecorder.Write(p)
+}
+
+func (sw *stallingWriter) WriteString(str string) (int, error) {
+	return sw.Write([]byte(str))
+}
+
+// serveSearch runs the search handler, it returns the value the handler
+// panicked with
+func serveSearch(server *Server, w http.ResponseWriter, r *http.Request) (aborted interface{}) {
+	defer func() {
+		aborted = recover()
+	}()
+	server.ServeHTTP(w, r)
+	return nil
+}
+
+func TestSearchTimeout(t *testing.T) {
+	// the deadline is over before any search starts
+	ts := httptest.NewServer(testServer(t, time.Nanosecond))
+	defer ts.Close()
+	urls := []string{
+		"/search?query=abort.*",
+		"/count?query=abort.*",
+		"/complete?prefix=abort.metric&limit=0",
+		"/grep?q=metric",
+		"/fuzzy?query=abort+metric",
+	}
+	for _, url := range urls {
+		timeouts := atomic.LoadUint64(&searchAborts.timeout)
+		resp, err := http.Get(ts.URL + url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusGatewayTimeout {
+			t.Errorf("%s: 504 expected, got %s", url, resp.Status)
+		}
+		if atomic.LoadUint64(&searchAborts.timeout) != timeouts+1 {
+			t.Errorf("%s: timed out search is not counted", url)
+		}
+	}
+
+	resp, err := http.Post(ts.URL+"/search/batch", "application/json", strings.NewReader(`["abort.*", "*"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("/search/batch: 504 expected, got %s", resp.Status)
+	}
+
+	queries := make([]string, MAX_BATCH_QUERIES+1)
+	for i := range queries {
+		queries[i] = `"abort.*"`
+	}
+	resp, err = http.Post(ts.URL+"/search/batch", "application/json", strings.NewReader("["+strings.Join(queries, ",")+"]"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("/search/batch: 400 expected for %d queries, got %s", len(queries), resp.Status)
+	}
+}
+
+func TestSearchAbortAfterStreaming(t *testing.T) {
+	timeout := 50 * time.Millisecond
+	server := testServer(t, timeout)
+	timeouts := atomic.LoadUint64(&searchAborts.timeout)
+	// the client is slow to take the first results
+	w := &stallingWriter{ResponseRecorder: httptest.NewRecorder()}
+	w.onFlush = func() { time.Sleep(2 * timeout) }
+	aborted := serveSearch(server, w, httptest.NewRequest("GET", "/search?query=abort.*", nil))
+	if aborted != http.ErrAbortHandler {
+		t.Errorf("Response timed out after streaming is not aborted: %v", aborted)
+	}
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("Results are expected to be streamed before the timeout: %d", w.Code)
+	}
+	if atomic.LoadUint64(&searchAborts.timeout) != timeouts+1 {
+		t.Error("Search timed out after streaming is not counted")
+	}
+
+	// with a timeout long enough everything is sent
+	server.SetSearchTimeout(time.Minute)
+	w = &stallingWriter{ResponseRecorder: httptest.NewRecorder(), onFlush: func() {}}
+	aborted = serveSearch(server, w, httptest.NewRequest("GET", "/search?query=abort.*", nil))
+	if aborted != nil || strings.Count(w.Body.String(), "\n") != TEST_METRICS {
+		t.Errorf("Search is not complete: %v", aborted)
+	}
+}
+
+func TestSearchCancelOnDisconnect(t *testing.T) {
+	server := testServer(t, 0)
+
+	// the request context is cancelled by the server once the client is
+	// gone
+	cancelled := atomic.LoadUint64(&searchAborts.cancelled)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := &stallingWriter{ResponseRecorder: httptest.NewRecorder(), onFlush: cancel}
+	r := httptest.NewRequest("GET", "/search?query=abort.*", nil).WithContext(ctx)
+	aborted := serveSearch(server, w, r)
+	if aborted != nil {
+		t.Errorf("Search cancelled by the client panicked: %v", aborted)
+	}
+	if strings.Count(w.Body.String(), "\n") >= TEST_METRICS {
+		t.Error("Search is not stopped when the client is gone")
+	}
+	if atomic.LoadUint64(&searchAborts.cancelled) != cancelled+1 {
+		t.Error("Search cancelled by the client is not counted")
+	}
+
+	// writes fail before the request context is cancelled
+	cancelled = atomic.LoadUint64(&searchAborts.cancelled)
+	w = &stallingWriter{ResponseRecorder: httptest.NewRecorder(), onFlush: func() {}, failing: true}
+	serveSearch(server, w, httptest.NewRequest("GET", "/search?query=abort.*", nil))
+	if atomic.LoadUint64(&searchAborts.cancelled) != cancelled+1 {
+		t.Error("Search stopped by a failed write is not counted")
+	}
+
+	// the other searches are cancelled as well
+	for _, url := range []string{"/count?query=abort.*", "/complete?prefix=abort.metric", "/grep?q=metric"} {
+		cancelled = atomic.LoadUint64(&searchAborts.cancelled)
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest("GET", url, nil).WithContext(ctx))
+		if w.Body.Len() != 0 || atomic.LoadUint64(&searchAborts.cancelled) != cancelled+1 {
+			t.Errorf("%s: search is not cancelled: %q", url, w.Body.String())
+		}
+	}
+}
+
+func TestStatsWithoutSelfMonitor(t *testing.T) {
+	server := testServer(t, 0)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/stats", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Aborted searches") {
+		t.Errorf("/stats is not served without self monitoring: %d\n%s", w.Code, w.Body.String())
+	}
+}
+
+func TestSnapshotError(t *testing.T) {
+	server := testServer(t, 0)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/admin/snapshot", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("405 expected for GET /admin/snapshot, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/admin/snapshot", nil))
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Errorf("Snapshot is not streamed: %d", w.Code)
+	}
+
+	// the snapshot is prepared in the index directory
+	os.RemoveAll("/tmp/test_web_search")
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/admin/snapshot", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("500 expected when the snapshot can't be taken, got %d", w.Code)
+	}
+}
+
+func TestCompactRequiresPost(t *testing.T) {
+	server := testServer(t, 0)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("GET", "/admin/compact", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("405 expected for GET /admin/compact, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, httptest.NewRequest("POST", "/admin/compact", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("POST /admin/compact failed: %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestImportWhisperRoot(t *testing.T) {
+	whisperRoot := "/tmp/test_web_whisper"
+	os.RemoveAll(whisperRoot)
+	defer os.RemoveAll(whisperRoot)
+	os.MkdirAll(whisperRoot+"/carbon/cpu", 0755)
+	os.WriteFile(whisperRoot+"/carbon/cpu/user.wsp", nil, 0644)
+	os.Symlink("/etc", whisperRoot+"/etc")
+
+	server := testServer(t, 0)
+	importWhisper := func(method string, dir string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(method, "/admin/import-whisper?dir="+dir, nil))
+		return w
+	}
+	if w := importWhisper("POST", whisperRoot); w.Code != http.StatusNotImplemented {
+		t.Errorf("501 expected without whisper root configured, got %d", w.Code)
+	}
+
+	server.SetWhisperRoot(whisperRoot)
+	if w := importWhisper("GET", whisperRoot); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("405 expected for GET, got %d", w.Code)
+	}
+	for _, dir := range []string{"/etc", whisperRoot + "/..", whisperRoot + "/etc"} {
+		if w := importWhisper("POST", dir); w.Code != http.StatusForbidden {
+			t.Errorf("403 expected for %s, got %d", dir, w.Code)
+		}
+	}
+	for _, dir := range []string{"", whisperRoot + "/carbon"} {
+		if w := importWhisper("POST", dir); w.Code != http.StatusOK {
+			t.Errorf("Import from '%s' failed: %d %s", dir, w.Code, w.Body.String())
+		}
+	}
+	if found := server.getTree().Search("carbon.cpu.user"); len(found) != 1 {
+		t.Errorf("Imported metric is not found: %v", found)
+	}
+}